@@ -0,0 +1,273 @@
+package cleaner
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// newRunID returns an identifier for this run, used to name its artifacts.
+// The random suffix tells apart the runs started within the same second, as
+// those against several clusters are.
+func newRunID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// parseRecipients parses the age recipients given on the command line and in
+// recipient files (one public key per line, # comments allowed).
+func parseRecipients(keys, files []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range keys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	return recipients, nil
+}
+
+// backupSecret returns the secret as stored in backups, with its full metadata
+// except for the managed fields.
+func backupSecret(secret v1.Secret) *v1.Secret {
+	backup := secret.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// backupService returns the service as stored in backups.
+func backupService(service v1.Service) *v1.Service {
+	backup := service.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// backupResourceRecord is the PAX record of a backup entry naming the
+// resource of the object, as group.resource, for the objects restore has no
+// built-in support for.
+const backupResourceRecord = "ORPHANEDSECRETSDELETER.resource"
+
+// backupArchiveExt is the extension of the backup archives.
+const backupArchiveExt = ".tar"
+
+// backupWriter writes the objects about to be deleted into a tar archive,
+// one YAML manifest per object encrypted with age on its own and stored as
+// <namespace>/<kind>/<name>.yaml.age. Every object is decryptable as soon as
+// it was added, even if the run dies before the archive is closed. It is safe
+// for concurrent use.
+type backupWriter struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	tw         *tar.Writer
+	recipients []age.Recipient
+
+	runID string
+	// cluster separates the archives of the clusters of a run in the store.
+	cluster string
+	// store receives the archive as written so far before every batch of
+	// deletions, and once it is complete. When the archive is only kept
+	// remotely, the local copy is temporary.
+	store     backupStore
+	temporary bool
+	// unsynced is set while objects added to the archive are not in the
+	// store yet.
+	unsynced bool
+}
+
+func newBackupWriter(dir, runID string, recipients []age.Recipient) (*backupWriter, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt the backup for")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating backup directory %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, backupArchiveName(runID))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating backup archive: %v", err)
+	}
+	return &backupWriter{
+		path:       path,
+		file:       file,
+		tw:         tar.NewWriter(file),
+		recipients: recipients,
+
+		runID: runID,
+	}, nil
+}
+
+// add stores obj in the archive. It must succeed before the object is deleted:
+// once it returned, the encrypted object is synced to disk and decryptable
+// from the archive as written so far. resource, the group.resource of the
+// object, is recorded along with it when not empty.
+func (b *backupWriter) add(kind, resource, namespace, name string, obj interface{}) error {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding %s %s/%s: %v", kind, namespace, name, err)
+	}
+	var encrypted bytes.Buffer
+	enc, err := age.Encrypt(&encrypted, b.recipients...)
+	if err == nil {
+		if _, err = enc.Write(data); err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error encrypting backup of %s %s/%s: %v", kind, namespace, name, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	header := &tar.Header{
+		Name:    namespace + "/" + strings.ToLower(kind) + "/" + name + ".yaml.age",
+		Mode:    0o600,
+		Size:    int64(encrypted.Len()),
+		ModTime: time.Now(),
+	}
+	if resource != "" {
+		header.PAXRecords = map[string]string{backupResourceRecord: resource}
+	}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("error writing backup of %s %s/%s: %v", kind, namespace, name, err)
+	}
+	if _, err := b.tw.Write(encrypted.Bytes()); err != nil {
+		return fmt.Errorf("error writing backup of %s %s/%s: %v", kind, namespace, name, err)
+	}
+	// Flush pads the entry, so the archive ends on a complete entry
+	if err := b.tw.Flush(); err != nil {
+		return fmt.Errorf("error writing backup of %s %s/%s: %v", kind, namespace, name, err)
+	}
+	b.unsynced = true
+	return b.file.Sync()
+}
+
+// sync uploads the archive as written so far to the store when objects were
+// added since the last upload. It must succeed before the objects added are
+// deleted, so that a run dying before Close does not lose the only copy of
+// objects already gone.
+func (b *backupWriter) sync(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.store == nil || !b.unsynced {
+		return nil
+	}
+	key := b.key(filepath.Base(b.path))
+	if err := b.store.Upload(ctx, key, b.path); err != nil {
+		return fmt.Errorf("error uploading backup archive %s: %v", b.path, err)
+	}
+	b.unsynced = false
+	return nil
+}
+
+// runManifest describes the run uploaded along with its backup archive.
+type runManifest struct {
+	RunID   string    `json:"runID"`
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+}
+
+// checkStore uploads the manifest of the run under the prefix the archive is
+// uploaded to, so a store that cannot be written to fails the run before
+// anything is deleted instead of once the backup is all that is left of the
+// deleted objects.
+func (b *backupWriter) checkStore(ctx context.Context) error {
+	if b.store == nil {
+		return nil
+	}
+	f, err := os.CreateTemp("", "orphaned-secrets-run")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = json.NewEncoder(f).Encode(runManifest{RunID: b.runID, Version: buildVersion.Version, Started: time.Now().UTC()})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	key := b.key("run.json")
+	if err := b.store.Upload(ctx, key, f.Name()); err != nil {
+		return fmt.Errorf("error uploading %s: %v", b.store.Location(key), err)
+	}
+	return nil
+}
+
+// key returns the key of a file of the run in the store.
+func (b *backupWriter) key(name string) string {
+	return backupKey(b.runID, b.cluster, name)
+}
+
+// backupKey returns the key a file of a run is stored under, below a prefix
+// named after the cluster in a run against several clusters.
+func backupKey(runID, cluster, name string) string {
+	if cluster == "" {
+		return path.Join(runID, name)
+	}
+	return path.Join(runID, clusterFileName(cluster), name)
+}
+
+// backupArchiveName returns the file name of the backup archive of a run.
+func backupArchiveName(runID string) string {
+	return runID + backupArchiveExt
+}
+
+// Close finalizes the archive and uploads it to the backup store, under a
+// prefix named after the run, replacing the partial archive uploaded by sync.
+func (b *backupWriter) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range []io.Closer{b.tw, b.file} {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("error closing backup archive %s: %v", b.path, err)
+		}
+	}
+	if b.store == nil {
+		return nil
+	}
+
+	// The archive is uploaded even when the run was interrupted, as it holds
+	// the objects deleted so far
+	key := b.key(filepath.Base(b.path))
+	if err := b.store.Upload(context.Background(), key, b.path); err != nil {
+		return fmt.Errorf("error uploading backup archive %s: %v", b.path, err)
+	}
+	if b.temporary {
+		os.RemoveAll(filepath.Dir(b.path))
+	}
+	b.path = b.store.Location(key)
+	return nil
+}
@@ -0,0 +1,349 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/oauth2/google"
+)
+
+// backupStore ships finished backup archives to remote storage and fetches
+// them back for restores.
+type backupStore interface {
+	// Upload stores the local file under key, relative to the store prefix.
+	Upload(ctx context.Context, key, file string) error
+	// Download writes the object stored under key to w.
+	Download(ctx context.Context, key string, w io.Writer) error
+	// Location returns a human readable location of key.
+	Location(key string) string
+}
+
+// newBackupStore returns the backend for a backup URL:
+//
+//	s3://bucket/prefix               AWS S3 or an S3 compatible endpoint
+//	gs://bucket/prefix               Google Cloud Storage
+//	azblob://account/container/prefix Azure Blob Storage
+//
+// Credentials come from the default credential chain of the SDK of each
+// platform, workload identity included. encryptionKey
+// selects the server-side encryption key: an AWS KMS key ID, a Cloud KMS key
+// name or an Azure encryption scope. Without it the provider managed keys are
+// used.
+func newBackupStore(rawURL, s3Endpoint, encryptionKey string) (backupStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return newS3Store(u.Host, prefix, s3Endpoint, encryptionKey)
+	case "gs":
+		return newGCSStore(u.Host, prefix, encryptionKey)
+	case "azblob":
+		container, prefix, _ := strings.Cut(prefix, "/")
+		if container == "" {
+			return nil, fmt.Errorf("backup URL %q has no container", rawURL)
+		}
+		return newAzureStore(u.Host, container, prefix, encryptionKey)
+	}
+	return nil, fmt.Errorf("unsupported backup URL scheme %q, must be one of s3, gs or azblob", u.Scheme)
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// uploadAttempts is how many times an upload failing with a network error or
+// a server error is attempted.
+const uploadAttempts = 3
+
+// putFile uploads file with client as the body of the request built by
+// newRequest, retrying with a backoff on network and server errors.
+func putFile(ctx context.Context, client *http.Client, file string, newRequest func(body io.Reader) (*http.Request, error)) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := putFileOnce(ctx, client, file, newRequest)
+		if err == nil || !retry || attempt == uploadAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// putFileOnce makes a single upload attempt, reporting whether a failure is
+// worth retrying.
+func putFileOnce(ctx context.Context, client *http.Client, file string, newRequest func(body io.Reader) (*http.Request, error)) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	req, err := newRequest(f)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = info.Size()
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		// The query is left out as it may carry credentials
+		return retry, fmt.Errorf("upload to %s%s failed with %s: %s", req.URL.Host, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return false, nil
+}
+
+// objectNotFoundError is returned by Download when there is no object under
+// the key.
+type objectNotFoundError struct{ location string }
+
+func (e objectNotFoundError) Error() string {
+	return e.location + " not found"
+}
+
+// getObject copies the body of a GET request sent with client to w.
+func getObject(client *http.Client, req *http.Request, w io.Writer) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return objectNotFoundError{location: req.URL.Host + req.URL.Path}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		// The query is left out as it may carry credentials
+		return fmt.Errorf("download from %s%s failed with %s: %s", req.URL.Host, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// s3Store uploads to S3 or an S3 compatible endpoint with the AWS SDK, which
+// takes the credentials and the region from its default chain: environment,
+// shared config, web identity (IRSA), container credentials (EKS Pod
+// Identity) and instance profile.
+type s3Store struct {
+	bucket, prefix string
+	kmsKeyID       string
+	client         *s3.Client
+}
+
+func newS3Store(bucket, prefix, endpoint, kmsKeyID string) (*s3Store, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error loading the AWS configuration: %v", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			// Custom endpoints are addressed path-style
+			o.BaseEndpoint = aws.String(strings.TrimSuffix(endpoint, "/"))
+			o.UsePathStyle = true
+		}
+	})
+	return &s3Store{bucket: bucket, prefix: prefix, kmsKeyID: kmsKeyID, client: client}, nil
+}
+
+func (s *s3Store) Location(key string) string {
+	return "s3://" + s.bucket + "/" + joinKey(s.prefix, key)
+}
+
+func (s *s3Store) Upload(ctx context.Context, key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(joinKey(s.prefix, key)),
+		Body:                 f,
+		ContentLength:        aws.Int64(info.Size()),
+		ContentType:          aws.String("application/octet-stream"),
+		ServerSideEncryption: s3types.ServerSideEncryptionAes256,
+	}
+	if s.kmsKeyID != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	_, err = s.client.PutObject(ctx, input)
+	return err
+}
+
+func (s *s3Store) Download(ctx context.Context, key string, w io.Writer) error {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinKey(s.prefix, key)),
+	})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return objectNotFoundError{location: s.Location(key)}
+	}
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	_, err = io.Copy(w, out.Body)
+	return err
+}
+
+// gcsStore uploads to Google Cloud Storage through the JSON API, with an HTTP
+// client authenticated by the Application Default Credentials: the file in
+// GOOGLE_APPLICATION_CREDENTIALS, service account key or workload identity
+// federation, the gcloud credentials or the metadata server, as with GKE
+// workload identity.
+type gcsStore struct {
+	bucket, prefix string
+	kmsKeyName     string
+	client         *http.Client
+}
+
+// gcsScope is the OAuth scope requested for Google Cloud Storage.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+func newGCSStore(bucket, prefix, kmsKeyName string) (*gcsStore, error) {
+	client, err := google.DefaultClient(context.Background(), gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("error finding Google Cloud credentials: %v", err)
+	}
+	return &gcsStore{bucket: bucket, prefix: prefix, kmsKeyName: kmsKeyName, client: client}, nil
+}
+
+func (s *gcsStore) Location(key string) string {
+	return "gs://" + s.bucket + "/" + joinKey(s.prefix, key)
+}
+
+func (s *gcsStore) Upload(ctx context.Context, key, file string) error {
+	query := url.Values{
+		"uploadType": {"media"},
+		"name":       {joinKey(s.prefix, key)},
+	}
+	if s.kmsKeyName != "" {
+		query.Set("kmsKeyName", s.kmsKeyName)
+	}
+	uploadURL := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + query.Encode()
+	return putFile(ctx, s.client, file, func(body io.Reader) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, uploadURL, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+}
+
+func (s *gcsStore) Download(ctx context.Context, key string, w io.Writer) error {
+	objectURL := "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(joinKey(s.prefix, key)) + "?alt=media"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return err
+	}
+	return getObject(s.client, req, w)
+}
+
+// azureStore uploads block blobs to Azure Blob Storage with the Azure SDK,
+// authenticated with the SAS token in AZURE_STORAGE_SAS_TOKEN or, when unset,
+// with the default Azure credential chain: environment, workload identity and
+// managed identity.
+type azureStore struct {
+	account, container, prefix string
+	encryptionScope            string
+	client                     *azblob.Client
+}
+
+func newAzureStore(account, container, prefix, encryptionScope string) (*azureStore, error) {
+	serviceURL := "https://" + account + ".blob.core.windows.net/"
+	var client *azblob.Client
+	var err error
+	if sasToken := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"); sasToken != "" {
+		client, err = azblob.NewClientWithNoCredential(serviceURL+"?"+sasToken, nil)
+	} else {
+		var credential *azidentity.DefaultAzureCredential
+		if credential, err = azidentity.NewDefaultAzureCredential(nil); err == nil {
+			client, err = azblob.NewClient(serviceURL, credential, nil)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating the Azure Blob Storage client: %v", err)
+	}
+	return &azureStore{
+		account:         account,
+		container:       container,
+		prefix:          prefix,
+		encryptionScope: encryptionScope,
+		client:          client,
+	}, nil
+}
+
+func (s *azureStore) Location(key string) string {
+	return "azblob://" + path.Join(s.account, s.container, joinKey(s.prefix, key))
+}
+
+func (s *azureStore) Upload(ctx context.Context, key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var options azblob.UploadFileOptions
+	if s.encryptionScope != "" {
+		options.CPKScopeInfo = &blob.CPKScopeInfo{EncryptionScope: &s.encryptionScope}
+	}
+	_, err = s.client.UploadFile(ctx, s.container, joinKey(s.prefix, key), f, &options)
+	return err
+}
+
+func (s *azureStore) Download(ctx context.Context, key string, w io.Writer) error {
+	resp, err := s.client.DownloadStream(ctx, s.container, joinKey(s.prefix, key), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+		return objectNotFoundError{location: s.Location(key)}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,264 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// The run may die at any time after deleting an object, so what add wrote
+// must be restorable without Close.
+func TestBackupDecryptableBeforeClose(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := newBackupWriter(t.TempDir(), "run", []age.Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.file.Close()
+	for _, name := range []string{"a", "b"} {
+		secret := v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a"},
+			Data:       map[string][]byte{"password": []byte("hunter2")},
+		}
+		if err := backup.add("Secret", "secrets", "team-a", name, backupSecret(secret)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive, err := os.Open(backup.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	clientset := fake.NewSimpleClientset()
+	restored, err := restoreArchive(context.Background(), clientset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), archive, []age.Identity{identity}, restoreFilter{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 2 {
+		t.Fatalf("restored %d secrets, want 2", restored)
+	}
+	secret, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["password"]) != "hunter2" {
+		t.Errorf("restored data = %q, want hunter2", secret.Data["password"])
+	}
+}
+
+func TestRestoreClusterBackup(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID := newRunID()
+	clean := cleanFlags{backupDir: t.TempDir()}
+	store := &memoryStore{}
+	for _, cluster := range []string{"prod", "staging"} {
+		clean := clean.forCluster(cluster)
+		backup, err := newBackupWriter(clean.backupDir, runID, []age.Recipient{identity.Recipient()})
+		if err != nil {
+			t.Fatalf("cluster %s: %v", cluster, err)
+		}
+		backup.store = store
+		backup.cluster = clean.cluster
+		secret := v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db-" + cluster, Namespace: "team-a"}}
+		if err := backup.add("Secret", "secrets", "team-a", secret.Name, backupSecret(secret)); err != nil {
+			t.Fatal(err)
+		}
+		if err := backup.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		cluster string
+		want    string
+	}{
+		{cluster: "prod", want: "db-prod"},
+		{cluster: "staging", want: "db-staging"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cluster, func(t *testing.T) {
+			archive, err := downloadArchive(context.Background(), store, runID, tt.cluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(archive)
+			f, err := os.Open(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			clientset := fake.NewSimpleClientset()
+			if _, err := restoreArchive(context.Background(), clientset, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), f, []age.Identity{identity}, restoreFilter{}, false); err != nil {
+				t.Fatal(err)
+			}
+			secrets, err := clientset.CoreV1().Secrets("team-a").List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(secrets.Items) != 1 || secrets.Items[0].Name != tt.want {
+				t.Errorf("restored %v, want %s", secrets.Items, tt.want)
+			}
+		})
+	}
+
+	if _, err := downloadArchive(context.Background(), store, runID, ""); err == nil {
+		t.Error("downloaded the archive of a single cluster run from a run against several clusters")
+	} else if _, notFound := err.(objectNotFoundError); !notFound {
+		t.Errorf("download error = %v, want not found", err)
+	}
+}
+
+// The objects of the rules are restored through the dynamic client, and those
+// of an unknown resource do not stop the others from being restored.
+func TestRestoreRuleObjects(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := newBackupWriter(t.TempDir(), "run", []age.Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "backups.example.com/v1",
+		"kind":       "BackupJob",
+		"metadata": map[string]interface{}{
+			"name":            "nightly",
+			"namespace":       "team-a",
+			"resourceVersion": "42",
+			"annotations":     map[string]interface{}{reasonAnnotation: "matched by rule stale-backups"},
+		},
+		"spec": map[string]interface{}{"schedule": "@daily"},
+	}}
+	widget := unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"name": "w", "namespace": "team-a"},
+	}}
+	secret := v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "team-a"}}
+	entries := []struct {
+		kind, resource, name string
+		obj                  interface{}
+	}{
+		{kind: "BackupJob", resource: "backupjobs.backups.example.com", name: "nightly", obj: &job},
+		// Backed up before the resource was recorded
+		{kind: "Widget", name: "w", obj: &widget},
+		{kind: "Secret", name: "db", obj: backupSecret(secret)},
+	}
+	for _, entry := range entries {
+		if err := backup.add(entry.kind, entry.resource, "team-a", entry.name, entry.obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backup.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := os.Open(backup.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	gvr := schema.GroupVersionResource{Group: "backups.example.com", Version: "v1", Resource: "backupjobs"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{gvr: "BackupJobList"})
+	clientset := fake.NewSimpleClientset()
+	restored, err := restoreArchive(context.Background(), clientset, dynamicClient, archive, []age.Identity{identity}, restoreFilter{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 2 {
+		t.Errorf("restored %d objects, want 2", restored)
+	}
+	if _, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "db", metav1.GetOptions{}); err != nil {
+		t.Errorf("secret after the unknown resource not restored: %v", err)
+	}
+	got, err := dynamicClient.Resource(gvr).Namespace("team-a").Get(context.Background(), "nightly", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule, _, _ := unstructured.NestedString(got.Object, "spec", "schedule"); schedule != "@daily" {
+		t.Errorf("restored schedule = %q, want @daily", schedule)
+	}
+	if _, ok := got.GetAnnotations()[reasonAnnotation]; ok {
+		t.Errorf("restored object kept the annotation %s", reasonAnnotation)
+	}
+}
+
+// storedWidgetCleaner is a widgetCleaner checking that the backup archive is
+// in the store before every deletion.
+type storedWidgetCleaner struct {
+	widgetCleaner
+	store *memoryStore
+	key   string
+}
+
+func (c *storedWidgetCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	if _, ok := c.store.objects[c.key]; !ok {
+		return fmt.Errorf("%s deleted before the backup archive was stored", obj.Meta.Name)
+	}
+	return c.widgetCleaner.Delete(ctx, obj, options)
+}
+
+// The objects are only deleted once their backup is in the backup store, and
+// not at all when it cannot be uploaded.
+func TestRunCleanerSyncsBackupBeforeDeleting(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		store       backupStore
+		wantDeleted int
+		wantErr     bool
+	}{
+		{name: "stored", store: &memoryStore{}, wantDeleted: 3},
+		{name: "upload failing", store: &failingStore{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup, err := newBackupWriter(t.TempDir(), "run", []age.Recipient{identity.Recipient()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backup.file.Close()
+			backup.store = tt.store
+			widgets := newWidgets(3, time.Hour)
+			for i := range widgets {
+				meta := widgets[i].Meta
+				widgets[i].Backup = func() interface{} { return meta }
+			}
+			memory, _ := tt.store.(*memoryStore)
+			if memory == nil {
+				memory = &memoryStore{}
+			}
+			cleaner := &storedWidgetCleaner{widgetCleaner: widgetCleaner{widgets: widgets}, store: memory, key: backup.key(backupArchiveName("run"))}
+			opts := options{maxDeletionPercent: 100, backup: backup}
+			err = runCleaner(context.Background(), fake.NewSimpleClientset(), "widgets", cleaner, "team-a", nil, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(cleaner.deleted) != tt.wantDeleted {
+				t.Errorf("deleted %v, want %d widgets", cleaner.deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// deleteRunLabel marks the secrets to delete with the ID of the run, so that
+// they can be deleted with a single DeleteCollection per namespace.
+const deleteRunLabel = "orphan-cleaner/delete-run"
+
+// labelForDeletion adds the deletion label to the secret. The patch is
+// conditional on the resourceVersion seen at list time, as DeleteCollection
+// takes no per-object preconditions.
+func labelForDeletion(ctx context.Context, clientset kubernetes.Interface, secret v1.Secret, runID string) (*v1.Secret, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": secret.ResourceVersion,
+			"labels": map[string]string{
+				deleteRunLabel: runID,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clientset.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+}
+
+// unlabelSecrets removes the deletion label from the secrets labeled by a run
+// that stopped before deleting them. The secrets already deleted are skipped.
+func unlabelSecrets(ctx context.Context, clientset kubernetes.Interface, secrets []v1.Secret) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{
+				deleteRunLabel: nil,
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, secret := range secrets {
+		_, err := clientset.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		if err != nil && !errors.IsNotFound(err) {
+			logger.Warn("Error removing the deletion label", "namespace", secret.Namespace, "resource", "secret/"+secret.Name, "label", deleteRunLabel, "error", err)
+		}
+	}
+}
+
+// deleteLabeledSecrets deletes the secrets labeled by labelForDeletion in a
+// single request, and records the outcome for each of them. DeleteCollection
+// reports nothing per object, so the secrets are listed again afterwards and
+// only those gone, or being finalized, are recorded as deleted.
+func deleteLabeledSecrets(ctx context.Context, clientset kubernetes.Interface, namespace string, secrets []v1.Secret, opts options) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	err := clientset.CoreV1().Secrets(namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: deleteRunLabel + "=" + opts.runID,
+	})
+	var left *v1.SecretList
+	if err == nil {
+		left, err = clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+	}
+	if err != nil {
+		for _, secret := range secrets {
+			opts.recordSecret(secret, actionError, err.Error())
+			emitEvent(ctx, clientset, opts, "Secret", secret.ObjectMeta, v1.EventTypeWarning, "OrphanedSecretDeleteFailed", "Failed to delete orphaned secret: "+err.Error())
+		}
+		return fmt.Errorf("Error deleting %d labeled secrets: %v", len(secrets), err)
+	}
+	remaining := map[types.UID]bool{}
+	for _, secret := range left.Items {
+		if secret.DeletionTimestamp == nil {
+			remaining[secret.UID] = true
+		}
+	}
+	var kept []v1.Secret
+	for _, secret := range secrets {
+		if remaining[secret.UID] {
+			logger.Warn("Not deleting secret as it changed since it was labeled", "namespace", namespace, "resource", "secret/"+secret.Name, "action", actionSkip)
+			opts.recordSecret(secret, actionSkip, changedReason)
+			kept = append(kept, secret)
+			continue
+		}
+		opts.recordSecret(secret, actionDelete, orphanedReason)
+		emitEvent(ctx, clientset, opts, "Secret", secret.ObjectMeta, v1.EventTypeNormal, "OrphanedSecretDeleted", "Deleted orphaned secret as it is "+orphanedReason)
+	}
+	unlabelSecrets(ctx, clientset, kept)
+	logger.Log(ctx, levelDeletion, "Deleted labeled secrets", "namespace", namespace, "count", len(secrets)-len(kept))
+	return nil
+}
@@ -0,0 +1,110 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestBatchDeleteRemovesLabelsOnError(t *testing.T) {
+	secrets := []runtime.Object{
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "team-a"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team-a"}},
+	}
+	clientset := fake.NewSimpleClientset(secrets...)
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetName() == "b" && string(patch.GetPatch()) != `{"metadata":{"labels":{"orphan-cleaner/delete-run":null}}}` {
+			return true, nil, errors.New("etcd unavailable")
+		}
+		return false, nil, nil
+	})
+
+	opts := options{batchDelete: true, runID: "run", maxDeletionPercent: 100}
+	c := &secretCleaner{clientset: clientset, namespace: "team-a", opts: opts}
+	var objects []CleanupObject
+	for _, obj := range secrets {
+		secret := *obj.(*v1.Secret)
+		secret.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+		objects = append(objects, secretObject(secret))
+	}
+	cleaner := &fixedSecretCleaner{secretCleaner: c, objects: objects}
+	if err := runCleaner(context.Background(), clientset, resourceSecrets, cleaner, "team-a", nil, opts); err == nil {
+		t.Fatal("runCleaner succeeded although labeling b failed")
+	}
+
+	a, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label, ok := a.Labels[deleteRunLabel]; ok {
+		t.Errorf("secret a kept the label %s=%s", deleteRunLabel, label)
+	}
+}
+
+// Only the secrets gone after the DeleteCollection are recorded as deleted:
+// the label of b was removed by someone else before the request.
+func TestBatchDeleteRecordsOnlyDeletedSecrets(t *testing.T) {
+	secrets := []runtime.Object{
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "team-a", UID: "1"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "team-a", UID: "2"}},
+	}
+	clientset := fake.NewSimpleClientset(secrets...)
+	clientset.PrependReactor("delete-collection", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, clientset.Tracker().Delete(action.GetResource(), "team-a", "a")
+	})
+
+	recorder := &resultRecorder{}
+	opts := options{batchDelete: true, runID: "run", maxDeletionPercent: 100, recorders: []decisionRecorder{recorder}}
+	c := &secretCleaner{clientset: clientset, namespace: "team-a", opts: opts}
+	var objects []CleanupObject
+	for _, obj := range secrets {
+		secret := *obj.(*v1.Secret)
+		secret.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+		objects = append(objects, secretObject(secret))
+	}
+	cleaner := &fixedSecretCleaner{secretCleaner: c, objects: objects}
+	if err := runCleaner(context.Background(), clientset, resourceSecrets, cleaner, "team-a", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := map[string]Action{}
+	for _, obj := range recorder.objects {
+		actions[obj.Name] = obj.Action
+	}
+	if actions["a"] != ActionDelete || actions["b"] != ActionSkip {
+		t.Errorf("recorded %v, want a deleted and b skipped", actions)
+	}
+	b, err := clientset.CoreV1().Secrets("team-a").Get(context.Background(), "b", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label, ok := b.Labels[deleteRunLabel]; ok {
+		t.Errorf("secret b kept the label %s=%s", deleteRunLabel, label)
+	}
+}
+
+// fixedSecretCleaner is a secretCleaner deleting the given secrets.
+type fixedSecretCleaner struct {
+	*secretCleaner
+	objects []CleanupObject
+}
+
+func (c *fixedSecretCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	return c.objects, nil
+}
+
+func (c *fixedSecretCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	return true, orphanedReason, nil
+}
+
+func (c *fixedSecretCleaner) Prepare(ctx context.Context, obj CleanupObject) (CleanupObject, bool, error) {
+	return obj, true, nil
+}
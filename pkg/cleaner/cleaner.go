@@ -0,0 +1,382 @@
+// Package cleaner finds and deletes the objects left behind by deleted
+// instances. An instance is known by the prefix its pods are named with: the
+// secrets of a namespace whose name carries the prefix of no live pod, and
+// which nothing references, are orphaned. Services, ConfigMaps,
+// PersistentVolumeClaims and the other resources are cleaned up in similar
+// ways.
+//
+// The orphaned-secrets-deleter command is built on this package, see Main.
+// Other tools embed the cleanup with NewCleaner:
+//
+//	c, err := cleaner.NewCleaner(config, cleaner.WithResources("secrets", "services"))
+//	if err != nil {
+//		return err
+//	}
+//	result, err := c.Detect(ctx, "default")
+//	if err != nil {
+//		return err
+//	}
+//	for _, object := range result.Orphans() {
+//		fmt.Println(object.Kind, object.Name, object.Reason)
+//	}
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+)
+
+// Defaults shared by the command flags and NewCleaner.
+const (
+	defaultKeepAnnotation     = "orphan-cleaner/keep"
+	defaultMaxDeletionPercent = 50
+	defaultPVCMinAge          = 7 * 24 * time.Hour
+	defaultJobMaxAge          = 7 * 24 * time.Hour
+	defaultServiceGrace       = time.Hour
+)
+
+// Cleaner finds and deletes the orphans of namespaces. It is safe for
+// concurrent use.
+type Cleaner struct {
+	clientset kubernetes.Interface
+	opts      options
+}
+
+// Option configures a Cleaner.
+type Option func(*Cleaner) error
+
+// NewCleaner returns a Cleaner talking to the cluster of the config. Without
+// options, it behaves like the command without flags: secrets and services
+// are cleaned up, the instance prefixes being the first capture group of
+// "^(.{10})-an-" in the names of the pods.
+func NewCleaner(config *rest.Config, options ...Option) (*Cleaner, error) {
+	config = rest.CopyConfig(config)
+	if config.UserAgent == "" {
+		config.UserAgent = userAgent("")
+	}
+	clientset, err := newClientset(config)
+	if err != nil {
+		return nil, err
+	}
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Kubernetes client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Kubernetes client: %v", err)
+	}
+	return NewCleanerForClients(clientset, metadataClient, dynamicClient, options...)
+}
+
+// NewCleanerForClients returns a Cleaner using the given clients, such as the
+// fake clients of client-go. The metadata client lists the secrets without
+// their data, the dynamic client reads the custom resources referencing them.
+func NewCleanerForClients(clientset kubernetes.Interface, metadataClient metadata.Interface, dynamicClient dynamic.Interface, options ...Option) (*Cleaner, error) {
+	c := &Cleaner{clientset: clientset}
+	c.opts.metadata = metadataClient
+	c.opts.dynamic = dynamicClient
+	c.opts.podNamePattern, _ = compilePodNamePattern(defaultPodNamePattern)
+	c.opts.protected, _ = compileProtectPatterns(nil)
+	c.opts.excludedNamespaces, _ = compileExcludedNamespaces(nil)
+	c.opts.resources, _ = parseResources(defaultResources)
+	c.opts.prefixSource = prefixSourcePods
+	c.opts.keepAnnotation = defaultKeepAnnotation
+	c.opts.maxDeletionPercent = defaultMaxDeletionPercent
+	c.opts.pvcMinAge = defaultPVCMinAge
+	c.opts.jobMaxAge = defaultJobMaxAge
+	c.opts.serviceGrace = defaultServiceGrace
+	c.opts.events = true
+	c.opts.runID = newRunID()
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// WithPodNamePattern sets the regular expression matched against the names
+// of the pods, whose first capture group is the prefix of their instance.
+func WithPodNamePattern(pattern string) Option {
+	return func(c *Cleaner) error {
+		re, err := compilePodNamePattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pod name pattern: %v", err)
+		}
+		c.opts.podNamePattern = re
+		return nil
+	}
+}
+
+// WithPrefixSource sets where the prefixes of the live instances come from:
+// "pods", "workloads" or "all".
+func WithPrefixSource(source string) Option {
+	return func(c *Cleaner) error {
+		if err := validatePrefixSource(source); err != nil {
+			return fmt.Errorf("invalid prefix source: %v", err)
+		}
+		c.opts.prefixSource = source
+		return nil
+	}
+}
+
+// WithResources sets the kinds of objects to clean up, secrets and services
+// by default.
+func WithResources(resources ...string) Option {
+	return func(c *Cleaner) error {
+		scope, err := parseResources(resources)
+		if err != nil {
+			return fmt.Errorf("invalid resources: %v", err)
+		}
+		c.opts.resources = scope
+		return nil
+	}
+}
+
+// WithProtect adds name patterns of objects that are never deleted: shell globs,
+// or regular expressions when prefixed with "regex:".
+func WithProtect(patterns ...string) Option {
+	return func(c *Cleaner) error {
+		protected, err := compileProtectPatterns(patterns)
+		if err != nil {
+			return fmt.Errorf("invalid protect pattern: %v", err)
+		}
+		c.opts.protected = protected
+		return nil
+	}
+}
+
+// WithKeepAnnotation sets the annotation pinning the objects it is set to
+// "true" on. An empty annotation disables it.
+func WithKeepAnnotation(annotation string) Option {
+	return func(c *Cleaner) error {
+		c.opts.keepAnnotation = annotation
+		return nil
+	}
+}
+
+// WithSecretSelector restricts the secrets considered to those matching the
+// label selector.
+func WithSecretSelector(selector string) Option {
+	return func(c *Cleaner) error {
+		if _, err := labels.Parse(selector); err != nil {
+			return fmt.Errorf("invalid secret selector: %v", err)
+		}
+		c.opts.secretListOptions.LabelSelector = selector
+		return nil
+	}
+}
+
+// WithDeleteIf sets the CEL expression a secret must match to be deleted, in
+// place of the prefix check.
+func WithDeleteIf(source string) Option {
+	return func(c *Cleaner) error {
+		expr, err := compileExpression(source, "secret")
+		if err != nil {
+			return fmt.Errorf("invalid delete-if expression: %v", err)
+		}
+		c.opts.deleteIf = expr
+		return nil
+	}
+}
+
+// WithMinAge keeps the objects younger than the duration.
+func WithMinAge(minAge time.Duration) Option {
+	return func(c *Cleaner) error {
+		c.opts.minAge = minAge
+		return nil
+	}
+}
+
+// WithIncludeOwned also considers the objects with ownerReferences, which are
+// left to the garbage collector by default.
+func WithIncludeOwned(include bool) Option {
+	return func(c *Cleaner) error {
+		c.opts.includeOwned = include
+		return nil
+	}
+}
+
+// WithIncludeGitOps also considers the objects deployed by Argo CD or Flux.
+func WithIncludeGitOps(include bool) Option {
+	return func(c *Cleaner) error {
+		c.opts.includeGitOps = include
+		return nil
+	}
+}
+
+// WithForceEmpty cleans up the namespaces without any instance too.
+func WithForceEmpty(force bool) Option {
+	return func(c *Cleaner) error {
+		c.opts.forceEmpty = force
+		return nil
+	}
+}
+
+// WithMaxDeletionPercent skips the resources of a namespace when more than
+// this percentage of their objects would be deleted, 50 by default. 0 and
+// 100 disable the check.
+func WithMaxDeletionPercent(percent int) Option {
+	return func(c *Cleaner) error {
+		c.opts.maxDeletionPercent = percent
+		return nil
+	}
+}
+
+// WithServerDryRun sends the deletions in server-side dry-run mode.
+func WithServerDryRun(serverDryRun bool) Option {
+	return func(c *Cleaner) error {
+		c.opts.serverDryRun = serverDryRun
+		c.opts.events = c.opts.events && !serverDryRun
+		return nil
+	}
+}
+
+// WithEvents sets whether an event is emitted for every deleted object, which
+// is the default.
+func WithEvents(events bool) Option {
+	return func(c *Cleaner) error {
+		c.opts.events = events && !c.opts.serverDryRun
+		return nil
+	}
+}
+
+// SetLogger replaces the logger the package reports progress with.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Action is what was done with an object.
+type Action string
+
+const (
+	// ActionKeep is an object that is not orphaned.
+	ActionKeep Action = actionKeep
+	// ActionDelete is an orphan deleted, or only found by Detect.
+	ActionDelete Action = actionDelete
+	// ActionSkip is an orphan left alone by a safety check.
+	ActionSkip Action = actionSkip
+	// ActionMark is an orphan marked for deletion by a later run.
+	ActionMark Action = actionMark
+	// ActionError is an orphan that failed to be deleted.
+	ActionError Action = actionError
+)
+
+// Result is the outcome of processing a namespace.
+type Result struct {
+	Namespace string
+	// Prefixes are the prefixes of the live instances of the namespace.
+	Prefixes []string
+	// Skipped is set when the namespace was left alone, as it is a system
+	// namespace or the one the cleaner runs in, did not opt in or holds no
+	// instance.
+	Skipped bool
+	// Objects lists the objects considered, in the order they were.
+	Objects []ObjectResult
+}
+
+// Orphans returns the objects deleted, or to delete for Detect.
+func (r *Result) Orphans() []ObjectResult {
+	var orphans []ObjectResult
+	for _, object := range r.Objects {
+		if object.Action == ActionDelete {
+			orphans = append(orphans, object)
+		}
+	}
+	return orphans
+}
+
+// ObjectResult is what was done with an object, and why.
+type ObjectResult struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       string
+	Created   time.Time
+	Action    Action
+	Reason    string
+	// DryRun is set when the deletion was not persisted.
+	DryRun bool
+}
+
+// resultRecorder collects the decisions of a namespace into its result.
+type resultRecorder struct {
+	mu      sync.Mutex
+	objects []ObjectResult
+}
+
+func (r *resultRecorder) record(d decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.objects = append(r.objects, ObjectResult{
+		Kind:      d.Kind,
+		Namespace: d.Namespace,
+		Name:      d.Name,
+		UID:       d.UID,
+		Created:   d.Created,
+		Action:    Action(d.Action),
+		Reason:    d.Reason,
+		DryRun:    d.DryRun,
+	})
+}
+
+// Detect finds the orphans of a namespace without deleting them.
+func (c *Cleaner) Detect(ctx context.Context, namespace string) (*Result, error) {
+	return c.run(ctx, namespace, true)
+}
+
+// Clean deletes the orphans of a namespace.
+func (c *Cleaner) Clean(ctx context.Context, namespace string) (*Result, error) {
+	return c.run(ctx, namespace, false)
+}
+
+func (c *Cleaner) run(ctx context.Context, namespace string, dryRun bool) (*Result, error) {
+	result := &Result{Namespace: namespace}
+	if pattern, excluded := matchProtected(c.opts.excludedNamespaces, namespace); excluded {
+		logger.Info("Skipping excluded namespace", "namespace", namespace, "pattern", pattern.String(), "action", actionSkip)
+		result.Skipped = true
+		return result, nil
+	}
+	opts := c.opts
+	opts.deadline = ctx
+	opts.dryRun = opts.dryRun || dryRun
+	opts.storage = &storageReferences{}
+	recorder := &resultRecorder{}
+	opts.recorders = []decisionRecorder{recorder}
+
+	ns, err := c.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return result, fmt.Errorf("Error getting namespace %s: %v", namespace, err)
+	}
+	if !opts.optedIn(*ns) {
+		result.Skipped = true
+		return result, nil
+	}
+	if opts, err = namespaceOptions(opts, *ns); err != nil {
+		return result, err
+	}
+	if result.Prefixes, err = gatherPrefixes(ctx, c.clientset, namespace, opts); err != nil {
+		return result, fmt.Errorf("Error retrieving pods from namespace %s: %v", namespace, err)
+	}
+	if skipWithoutPrefixes(result.Prefixes, namespace, opts) {
+		result.Skipped = true
+		return result, nil
+	}
+	err = cleanupNamespace(ctx, c.clientset, result.Prefixes, namespace, opts, opts.resources)
+	result.Objects = recorder.objects
+	if err != nil {
+		return result, fmt.Errorf("Error cleaning up namespace %s: %v", namespace, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,43 @@
+package cleaner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// The system namespaces are excluded through the library as well as through
+// the command line, whatever they hold.
+func TestCleanerSkipsSystemNamespaces(t *testing.T) {
+	created := metav1.NewTime(time.Now().Add(-48 * time.Hour))
+	var objects []runtime.Object
+	for _, namespace := range systemNamespaces {
+		objects = append(objects,
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+			&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "klmnopqrst-an-0", Namespace: namespace}},
+			&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "abcdefghij-certificate", Namespace: namespace, CreationTimestamp: created}},
+		)
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	c, err := NewCleanerForClients(clientset, nil, nil, WithForceEmpty(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, namespace := range systemNamespaces {
+		result, err := c.Clean(context.Background(), namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Skipped || len(result.Objects) > 0 {
+			t.Errorf("%s not skipped: %+v", namespace, result)
+		}
+	}
+	for _, action := range clientset.Actions() {
+		t.Errorf("unexpected %s of %s in a system namespace", action.GetVerb(), action.GetResource().Resource)
+	}
+}
@@ -0,0 +1,146 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// cleanupRunResource is the cluster scoped CleanupRun custom resource defined
+// in manifests/cleanuprun-crd.yaml.
+var cleanupRunResource = schema.GroupVersionResource{
+	Group:    "orphan-cleaner.cloud.timescale.com",
+	Version:  "v1alpha1",
+	Resource: "cleanupruns",
+}
+
+// maxCleanupRunObjects bounds the objects listed in a CleanupRun status, to
+// stay well below the size limit of a Kubernetes object.
+const maxCleanupRunObjects = 1000
+
+// Phases of a CleanupRun.
+const (
+	cleanupRunSucceeded = "Succeeded"
+	cleanupRunFailed    = "Failed"
+)
+
+type cleanupRunSpec struct {
+	AllNamespaces bool   `json:"allNamespaces,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	DryRun        bool   `json:"dryRun,omitempty"`
+}
+
+type cleanupRunObject struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+}
+
+type cleanupRunStatus struct {
+	Phase          string             `json:"phase"`
+	StartTime      metav1.Time        `json:"startTime"`
+	CompletionTime metav1.Time        `json:"completionTime"`
+	Error          string             `json:"error,omitempty"`
+	Summary        summaryTotals      `json:"summary"`
+	Objects        []cleanupRunObject `json:"objects,omitempty"`
+	// OmittedObjects counts the objects left out of Objects.
+	OmittedObjects int `json:"omittedObjects,omitempty"`
+}
+
+// cleanupRunRecorder collects the objects that were not kept, and publishes
+// them as a CleanupRun once the run is over, so the results can be queried
+// with kubectl and consumed by other controllers.
+type cleanupRunRecorder struct {
+	mu     sync.Mutex
+	spec   cleanupRunSpec
+	start  time.Time
+	status cleanupRunStatus
+}
+
+func newCleanupRunRecorder(spec cleanupRunSpec) *cleanupRunRecorder {
+	return &cleanupRunRecorder{spec: spec, start: time.Now()}
+}
+
+func (r *cleanupRunRecorder) record(d decision) {
+	if d.Action == actionKeep {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.status.Objects) >= maxCleanupRunObjects {
+		r.status.OmittedObjects++
+		return
+	}
+	r.status.Objects = append(r.status.Objects, cleanupRunObject{
+		Namespace: d.Namespace,
+		Kind:      d.Kind,
+		Name:      d.Name,
+		Action:    d.Action,
+		Reason:    d.Reason,
+	})
+}
+
+// publish creates the CleanupRun of the run and fills in its status.
+func (r *cleanupRunRecorder) publish(ctx context.Context, client dynamic.Interface, runID string, totals summaryTotals, runErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Phase = cleanupRunSucceeded
+	status.StartTime = metav1.NewTime(r.start)
+	status.CompletionTime = metav1.Now()
+	status.Summary = totals
+	if runErr != nil {
+		status.Phase = cleanupRunFailed
+		status.Error = runErr.Error()
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(cleanupRunResource.GroupVersion().String())
+	obj.SetKind("CleanupRun")
+	obj.SetName("run-" + strings.ToLower(runID))
+	spec, err := toUnstructuredMap(r.spec)
+	if err != nil {
+		return err
+	}
+	obj.Object["spec"] = spec
+
+	runs := client.Resource(cleanupRunResource)
+	created, err := runs.Create(ctx, obj, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil {
+		return err
+	}
+	// The status subresource ignores the status passed on creation
+	if created.Object["status"], err = toUnstructuredMap(status); err != nil {
+		return err
+	}
+	_, err = runs.UpdateStatus(ctx, created, metav1.UpdateOptions{FieldManager: fieldManager})
+	return err
+}
+
+func toUnstructuredMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+func fromUnstructuredMap(m map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,182 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterTarget is a cluster to clean up in a multi-cluster run.
+type clusterTarget struct {
+	name       string
+	kubeconfig string
+	context    string
+	overrides  *cleanupPolicySpec
+}
+
+// outputMu keeps the clusters cleaned up in parallel from interleaving the
+// tables and summaries printed at the end of their runs.
+var outputMu sync.Mutex
+
+// forEachCluster calls run for every cluster selected by --contexts,
+// --all-contexts or --clusters-file, --cluster-workers of them at a time, or
+// once for the cluster of --context otherwise. A failing cluster does not stop
+// the others from being cleaned up. The files written by a run are named after
+// its cluster, so the clusters do not overwrite each other's. With
+// --fleet-report, the totals and failures of all clusters are written to a
+// single file once they are done.
+func forEachCluster(ctx context.Context, kube *kubeFlags, detect detectFlags, run func(kube *kubeFlags, detect detectFlags) (*runSummary, error)) error {
+	if !kube.multiCluster() {
+		if detect.fleetReport != "" {
+			return fmt.Errorf("--fleet-report requires --contexts, --all-contexts or --clusters-file")
+		}
+		_, err := run(kube, detect)
+		return err
+	}
+	clusters, err := kube.clusters()
+	if err != nil {
+		return err
+	}
+	if kube.clusterWorkers < 1 {
+		return fmt.Errorf("Invalid --cluster-workers: must be at least 1")
+	}
+	if err := validateFleetReportFormat(detect.fleetReportFormat); err != nil {
+		return fmt.Errorf("Invalid --fleet-report-format: %v", err)
+	}
+
+	start := time.Now()
+	summaries := make([]*runSummary, len(clusters))
+	errs := make([]error, len(clusters))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < kube.clusterWorkers && i < len(clusters); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				cluster := clusters[i]
+				logger.Info("Cleaning up cluster", "cluster", cluster.name)
+				summaries[i], errs[i] = run(kube.forCluster(cluster), detect.forCluster(cluster))
+				if _, interrupted := errs[i].(interruptedError); errs[i] != nil && !interrupted {
+					logger.Error("Error cleaning up cluster", "cluster", cluster.name, "error", errs[i])
+				}
+			}
+		}()
+	}
+	for i := range clusters {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if detect.fleetReport != "" {
+		report := newFleetReport(clusters, summaries, errs, start)
+		if err := report.writeFile(detect.fleetReport, detect.fleetReportFormat); err != nil {
+			return fmt.Errorf("Error writing fleet report: %v", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return interruptedError{}
+	}
+	failures := clusterErrors{total: len(clusters)}
+	for i, err := range errs {
+		switch err.(type) {
+		case nil:
+		case interruptedError:
+			return err
+		default:
+			failures.failed = append(failures.failed, clusterError{cluster: clusters[i].name, err: err})
+		}
+	}
+	if len(failures.failed) > 0 {
+		sort.Slice(failures.failed, func(i, j int) bool { return failures.failed[i].cluster < failures.failed[j].cluster })
+		return failures
+	}
+	return nil
+}
+
+// forCluster returns a copy of the flags for a run against the cluster.
+func (d detectFlags) forCluster(cluster clusterTarget) detectFlags {
+	d.cluster = cluster.name
+	d.clusterOverrides = cluster.overrides
+	d.csvReport = clusterPath(d.csvReport, cluster.name)
+	d.summaryFile = clusterPath(d.summaryFile, cluster.name)
+	if d.exportDir != "" {
+		d.exportDir = filepath.Join(d.exportDir, clusterFileName(cluster.name))
+	}
+	return d
+}
+
+// forCluster returns a copy of the flags for a run against the cluster, with
+// the backups and quarantined secrets kept apart from those of the others.
+func (c cleanFlags) forCluster(cluster string) cleanFlags {
+	c.cluster = cluster
+	if c.quarantineDir != "" {
+		c.quarantineDir = filepath.Join(c.quarantineDir, clusterFileName(cluster))
+	}
+	if c.backupDir != "" {
+		c.backupDir = filepath.Join(c.backupDir, clusterFileName(cluster))
+	}
+	return c
+}
+
+// clusterPath inserts the cluster name into the name of the file at path,
+// before its extension: summary.txt becomes summary-prod.txt.
+func clusterPath(path, cluster string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + clusterFileName(cluster) + ext
+}
+
+// clusterFileName returns the cluster name as a single path component. The
+// names of contexts may hold anything, like the slashes and colons of EKS
+// ARNs, so the characters other than letters, digits, "-", "_" and non
+// leading "." are replaced, and a hash of the name keeps the result unique.
+func clusterFileName(cluster string) string {
+	var b strings.Builder
+	for i, r := range cluster {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.String() == cluster {
+		return cluster
+	}
+	h := fnv.New32a()
+	h.Write([]byte(cluster))
+	return fmt.Sprintf("%s-%08x", b.String(), h.Sum32())
+}
+
+// clusterError is the failure of cleaning up a cluster.
+type clusterError struct {
+	cluster string
+	err     error
+}
+
+// clusterErrors collects the failures of a run over several clusters.
+type clusterErrors struct {
+	failed []clusterError
+	total  int
+}
+
+func (e clusterErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Error cleaning up %d of %d clusters:", len(e.failed), e.total)
+	for _, failure := range e.failed {
+		fmt.Fprintf(&b, "\n  %s: %s", failure.cluster, strings.ReplaceAll(strings.TrimSpace(failure.err.Error()), "\n", "\n  "))
+	}
+	return b.String()
+}
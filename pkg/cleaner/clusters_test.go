@@ -0,0 +1,82 @@
+package cleaner
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestClusterOverridesNarrowTheFlags(t *testing.T) {
+	var detect detectFlags
+	var clean cleanFlags
+	fs := pflag.NewFlagSet("clean", pflag.ContinueOnError)
+	detect.register(fs)
+	clean.register(fs)
+	if err := fs.Parse([]string{"--namespace=team-a", "--resources=secrets,services"}); err != nil {
+		t.Fatal(err)
+	}
+	cluster := clusterTarget{name: "staging", overrides: &cleanupPolicySpec{
+		DryRun:    true,
+		Resources: []string{resourceSecrets, resourceConfigMaps},
+	}}
+	detect = detect.forCluster(cluster)
+	clean = clean.forCluster(cluster.name)
+	opts, err := detect.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clean.apply(&opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resource := range resourceNames() {
+		if want := resource == resourceSecrets; opts.resources[resource] != want {
+			t.Errorf("resources[%s] = %v, want %v", resource, opts.resources[resource], want)
+		}
+	}
+	cleaner := &widgetCleaner{widgets: newWidgets(1, time.Hour)}
+	opts.maxDeletionPercent = 100
+	if err := runCleaner(context.Background(), fake.NewSimpleClientset(), "widgets", cleaner, "team-a", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(cleaner.deleted) > 0 {
+		t.Errorf("the dry-run cluster deleted %v", cleaner.deleted)
+	}
+}
+
+// The names of contexts end up in the paths of the backups, quarantined
+// secrets and reports, and must not reach out of their directories.
+func TestClusterPathsStayInTheirDirectories(t *testing.T) {
+	for _, name := range []string{"arn:aws:eks:us-east-1:123456789012:cluster/prod", "../x", ".."} {
+		t.Run(name, func(t *testing.T) {
+			clean := cleanFlags{quarantineDir: "/var/quarantine", backupDir: "/var/backups"}.forCluster(name)
+			for dir, got := range map[string]string{"/var/quarantine": clean.quarantineDir, "/var/backups": clean.backupDir} {
+				if filepath.Dir(got) != dir || filepath.Base(got) == ".." {
+					t.Errorf("directory %s of %s is not a single component in %s", got, name, dir)
+				}
+			}
+			detect := detectFlags{summaryFile: "/var/reports/summary.txt", exportDir: "/var/export"}.forCluster(clusterTarget{name: name})
+			if filepath.Dir(detect.summaryFile) != "/var/reports" || !strings.HasSuffix(detect.summaryFile, ".txt") {
+				t.Errorf("summary file %s of %s is not in /var/reports", detect.summaryFile, name)
+			}
+			if filepath.Dir(detect.exportDir) != "/var/export" {
+				t.Errorf("export directory %s of %s is not in /var/export", detect.exportDir, name)
+			}
+			if key := backupKey("run-1", name, "archive.tar"); path.Dir(path.Dir(key)) != "run-1" {
+				t.Errorf("backup key %s of %s is not below the run", key, name)
+			}
+		})
+	}
+	if got := clusterFileName("prod-eu.1"); got != "prod-eu.1" {
+		t.Errorf("clusterFileName(prod-eu.1) = %s, want it unchanged", got)
+	}
+	if clusterFileName("a/b") == clusterFileName("a:b") {
+		t.Error("different names share a file name")
+	}
+}
@@ -0,0 +1,998 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+)
+
+func newRootCommand() *cobra.Command {
+	var kube kubeFlags
+	var configFile string
+	var logLevel, logFormat string
+	var verbose, quiet bool
+	root := &cobra.Command{
+		Use:   "orphaned-secrets-deleter",
+		Short: "Find and delete secrets and services left behind by deleted instances",
+		Long: `Find and delete secrets and services left behind by deleted instances.
+
+Every flag can also be set through an environment variable named after it,
+e.g. ` + envName("dry-run") + ` for --dry-run. Repeatable flags take a comma-separated list.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		// Flags take precedence over the environment, which takes precedence
+		// over the config file
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadEnv(cmd); err != nil {
+				return err
+			}
+			if configFile != "" {
+				if err := loadConfigFile(cmd, configFile); err != nil {
+					return err
+				}
+			}
+			return setupLogger(logLevel, logFormat, verbose, quiet)
+		},
+	}
+	root.PersistentFlags().StringVar(&configFile, "config", "", "YAML file with default values for the flags, keyed by flag name. Flags given on the command line and "+envPrefix+"* environment variables take precedence")
+	root.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Minimum level of the log messages: debug, info, warn or error")
+	root.PersistentFlags().StringVar(&logFormat, "log-format", logFormatText, "Format of the log messages: \"text\" (key=value pairs) or \"json\"")
+	root.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Also report the objects that are kept and why, same as --log-level=debug")
+	root.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only report deletions, warnings and errors")
+	kube.register(root.PersistentFlags())
+
+	root.AddCommand(
+		newListCommand(&kube),
+		newCleanCommand(&kube),
+		newReportCommand(&kube),
+		newRestoreCommand(&kube),
+		newControllerCommand(&kube),
+		newGenerateCommand(),
+		newVersionCommand(),
+	)
+	return root
+}
+
+// newListCommand detects orphans without deleting anything.
+func newListCommand(kube *kubeFlags) *cobra.Command {
+	var detect detectFlags
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the orphaned secrets and services without deleting them",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logOutput = detect.logDestination()
+			if err := detect.serve(); err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			return forEachCluster(ctx, kube, detect, func(kube *kubeFlags, detect detectFlags) (*runSummary, error) {
+				opts, err := detect.options()
+				if err != nil {
+					return nil, err
+				}
+				opts.dryRun = true
+				return opts.summary, runCleanup(ctx, kube, detect, opts)
+			})
+		},
+	}
+	detect.register(cmd.Flags())
+	return cmd
+}
+
+// newCleanCommand deletes the orphans.
+func newCleanCommand(kube *kubeFlags) *cobra.Command {
+	var detect detectFlags
+	var clean cleanFlags
+	var schedule, healthAddr string
+	var jitter time.Duration
+	cmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Delete the orphaned secrets and services",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cron *cronSchedule
+			if schedule != "" {
+				var err error
+				if cron, err = parseCron(schedule); err != nil {
+					return fmt.Errorf("Invalid --schedule: %v", err)
+				}
+			}
+			logOutput = detect.logDestination()
+			if err := detect.serve(); err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			runCluster := func(kube *kubeFlags, detect detectFlags) (*runSummary, error) {
+				opts, err := detect.options()
+				if err != nil {
+					return nil, err
+				}
+				clean := clean.forCluster(detect.cluster)
+				if err := clean.apply(&opts); err != nil {
+					return nil, err
+				}
+				err = runCleanup(ctx, kube, detect, opts)
+				if opts.backup != nil {
+					// The archive must be finalized even if the run failed halfway
+					if err := opts.backup.Close(); err != nil {
+						return opts.summary, fmt.Errorf("Error writing backup: %v", err)
+					}
+					logger.Info("Backup of the deleted objects written", "path", opts.backup.path)
+				}
+				return opts.summary, err
+			}
+			runOnce := func() error {
+				return forEachCluster(ctx, kube, detect, runCluster)
+			}
+			if cron == nil {
+				return runOnce()
+			}
+			if healthAddr != "" {
+				if kube.multiCluster() {
+					return fmt.Errorf("--health-addr cannot be combined with --contexts or --all-contexts")
+				}
+				clientset, err := kube.clientset()
+				if err != nil {
+					return err
+				}
+				health := newHealthServer()
+				health.addReadyCheck("apiserver", apiServerCheck(clientset))
+				if err := health.serve(healthAddr); err != nil {
+					return fmt.Errorf("Error serving health probes: %v", err)
+				}
+			}
+			return runScheduled(ctx, cron, jitter, runOnce)
+		},
+	}
+	detect.register(cmd.Flags())
+	clean.register(cmd.Flags())
+	cmd.Flags().StringVar(&schedule, "schedule", "", "Keep running and clean up at the times matching this cron expression, e.g. \"0 */6 * * *\" or @daily, instead of once. A run is skipped while the previous one is still in progress")
+	cmd.Flags().DurationVar(&jitter, "schedule-jitter", 0, "Delay every scheduled run by a random duration up to this one, so replicas in several clusters do not hit their API servers at once")
+	cmd.Flags().StringVar(&healthAddr, "health-addr", "", "Address to serve the /healthz and /readyz probes on with --schedule, e.g. :8081")
+	return cmd
+}
+
+// controllerIgnoredFlags are the flags of detectFlags and cleanFlags that only
+// take effect at the end of a run, or in the output of a single run, which the
+// controller has neither of. They are hidden and rejected by the controller.
+var controllerIgnoredFlags = []string{
+	"cleanup-run",
+	"color",
+	"export-dir",
+	"fleet-report",
+	"fleet-report-format",
+	"history-configmap",
+	"history-limit",
+	"history-namespace",
+	"notify-deletions",
+	"progress",
+	"progress-interval",
+	"pushgateway-job",
+	"pushgateway-url",
+	"slack-webhook",
+	"summary-file",
+	"teams-webhook",
+	"timeout",
+	"webhook",
+	"webhook-content-type",
+	"webhook-template",
+}
+
+// newControllerCommand cleans up continuously until it is terminated.
+func newControllerCommand(kube *kubeFlags) *cobra.Command {
+	var detect detectFlags
+	var clean cleanFlags
+	var debounce, resync time.Duration
+	var policies bool
+	var healthAddr string
+	election := leaderElection{}
+	cmd := &cobra.Command{
+		Use:   "controller",
+		Short: "Watch pods and secrets and delete orphans as they appear",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, name := range controllerIgnoredFlags {
+				if cmd.Flags().Changed(name) {
+					return fmt.Errorf("--%s is not supported by the controller", name)
+				}
+			}
+			if detect.namespacesFrom != "" {
+				return fmt.Errorf("--namespaces-from is not supported by the controller")
+			}
+			if kube.multiCluster() {
+				return fmt.Errorf("--contexts and --all-contexts are not supported by the controller")
+			}
+			if detect.output != outputText && detect.output != outputJSON {
+				return fmt.Errorf("Invalid --output: the controller only supports %s and %s", outputText, outputJSON)
+			}
+			logOutput = detect.logDestination()
+			opts, err := detect.options()
+			if err != nil {
+				return err
+			}
+			if err := clean.apply(&opts); err != nil {
+				return err
+			}
+			// There is no end of the run to report progress towards
+			opts.progress = nil
+			ctx, stop := signalContext()
+			defer stop()
+			kube := kube.forRun(opts.runID)
+			clientset, err := kube.clientset()
+			if err != nil {
+				return err
+			}
+			if opts.metadata, err = kube.metadataClient(); err != nil {
+				return err
+			}
+			if opts.dynamic, err = kube.dynamicClient(); err != nil {
+				return err
+			}
+			if detect.preflight {
+				if err := preflight(ctx, clientset, detect.preflightNamespaces(opts), requiredPermissions(opts, detect.allNamespaces)); err != nil {
+					return err
+				}
+			}
+			if err := detect.serve(); err != nil {
+				return err
+			}
+			namespace := detect.namespace
+			if detect.allNamespaces {
+				namespace = ""
+			}
+			var dynamicClient dynamic.Interface
+			if policies {
+				dynamicClient = opts.dynamic
+			}
+			c, err := newController(clientset, dynamicClient, namespace, opts, debounce, resync)
+			if err != nil {
+				return err
+			}
+			if healthAddr != "" {
+				health := newHealthServer()
+				health.addReadyCheck("apiserver", apiServerCheck(clientset))
+				health.addReadyCheck("informers", c.synced)
+				if err := health.serve(healthAddr); err != nil {
+					return fmt.Errorf("Error serving health probes: %v", err)
+				}
+			}
+			err = election.run(ctx, clientset, func(ctx context.Context) error {
+				return c.run(ctx, detect.workers)
+			})
+			if opts.backup != nil {
+				if err := opts.backup.Close(); err != nil {
+					return fmt.Errorf("Error writing backup: %v", err)
+				}
+				logger.Info("Backup of the deleted objects written", "path", opts.backup.path)
+			}
+			if err := opts.closeRecorders(); err != nil {
+				return fmt.Errorf("Error writing reports: %v", err)
+			}
+			return err
+		},
+	}
+	detect.register(cmd.Flags())
+	clean.register(cmd.Flags())
+	// A table is only rendered at the end of a run, which never comes
+	output := cmd.Flags().Lookup("output")
+	output.DefValue = outputText
+	output.Value.Set(outputText)
+	for _, name := range controllerIgnoredFlags {
+		cmd.Flags().MarkHidden(name)
+	}
+	// The budget is never renewed, as the run only ends with the process
+	cmd.Flags().Lookup("max-deletions").Usage = "Maximum number of objects deleted until the controller is restarted, after which it keeps running without deleting anything (0 means unlimited)"
+	cmd.Flags().DurationVar(&debounce, "debounce", 30*time.Second, "Delay between a pod deletion or secret creation and the reconciliation of its namespace, so bursts of events are handled at once")
+	cmd.Flags().BoolVar(&policies, "policies", false, "Apply the OrphanCleanupPolicy objects of the namespaces (see manifests/orphancleanuppolicy-crd.yaml)")
+	cmd.Flags().StringVar(&healthAddr, "health-addr", "", "Address to serve the /healthz and /readyz probes on, e.g. :8081")
+	cmd.Flags().BoolVar(&election.enabled, "leader-elect", false, "Elect a leader among the replicas through a Lease, so only one of them cleans up")
+	cmd.Flags().StringVar(&election.namespace, "leader-election-namespace", "", "Namespace of the leader election Lease. Defaults to the namespace the tool runs in")
+	cmd.Flags().StringVar(&election.name, "leader-election-id", "orphaned-secrets-deleter", "Name of the leader election Lease")
+	cmd.Flags().DurationVar(&election.leaseDuration, "leader-election-lease-duration", 15*time.Second, "Duration standby replicas wait before taking over an unrenewed lease")
+	cmd.Flags().DurationVar(&election.renewDeadline, "leader-election-renew-deadline", 10*time.Second, "Duration the leader retries renewing the lease before giving up leadership")
+	cmd.Flags().DurationVar(&election.retryPeriod, "leader-election-retry-period", 2*time.Second, "Interval between attempts to acquire or renew the lease")
+	cmd.Flags().DurationVar(&resync, "resync-period", time.Hour, "Interval at which every namespace is reconciled regardless of events")
+	return cmd
+}
+
+// newReportCommand prints how many orphans every namespace holds.
+func newReportCommand(kube *kubeFlags) *cobra.Command {
+	var detect detectFlags
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Summarize the orphaned secrets and services per namespace",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			detect.discardLogs = true
+			logOutput = detect.logDestination()
+			if err := detect.serve(); err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			return forEachCluster(ctx, kube, detect, func(kube *kubeFlags, detect detectFlags) (*runSummary, error) {
+				opts, err := detect.options()
+				if err != nil {
+					return nil, err
+				}
+				opts.dryRun = true
+				opts.report = newCandidateReport()
+				if err := runCleanup(ctx, kube, detect, opts); err != nil {
+					return opts.summary, err
+				}
+				outputMu.Lock()
+				defer outputMu.Unlock()
+				if detect.cluster != "" {
+					fmt.Printf("Cluster %s:\n", detect.cluster)
+				}
+				return opts.summary, opts.report.write(os.Stdout)
+			})
+		},
+	}
+	detect.register(cmd.Flags())
+	return cmd
+}
+
+func runCleanup(ctx context.Context, kube *kubeFlags, detect detectFlags, opts options) error {
+	kube = kube.forRun(opts.runID)
+	clientset, err := kube.clientset()
+	if err == nil {
+		opts.metadata, err = kube.metadataClient()
+	}
+	if err == nil {
+		opts.dynamic, err = kube.dynamicClient()
+	}
+	if err != nil {
+		opts.closeRecorders()
+		return err
+	}
+	opts.deadline = ctx
+	opts.storage = &storageReferences{}
+	if opts, err = opts.withProtectConfigMap(ctx, clientset); err != nil {
+		opts.closeRecorders()
+		return err
+	}
+	if detect.preflight {
+		if err := preflight(ctx, clientset, detect.preflightNamespaces(opts), requiredPermissions(opts, detect.allNamespaces)); err != nil {
+			opts.closeRecorders()
+			return err
+		}
+	}
+	if detect.timeout > 0 {
+		var cancel context.CancelFunc
+		opts.deadline, cancel = context.WithTimeout(ctx, detect.timeout)
+		defer cancel()
+	}
+	logger.Info("Starting run", append([]any{"runId", opts.runID}, buildVersion.logAttrs()...)...)
+	start := time.Now()
+	err = run(ctx, clientset, detect.allNamespaces || opts.namespaceList != nil, detect.namespace, opts)
+	unprocessed := opts.summary.snapshot().Unprocessed
+	if ctx.Err() != nil {
+		err = interruptedError{unprocessed: unprocessed}
+	} else if unprocessed > 0 && opts.deadline.Err() != nil {
+		if err != nil {
+			logger.Error("Run failed", "error", err)
+		}
+		err = timeoutError{timeout: detect.timeout, unprocessed: unprocessed}
+	}
+	// The results are reported even if the run was interrupted
+	reportCtx := context.Background()
+	metrics.runDone(time.Since(start), err)
+	if opts.runMetrics != nil {
+		opts.runMetrics.runDone(time.Since(start), err)
+		if err := opts.runMetrics.push(detect.pushgatewayURL, detect.pushgatewayJob, detect.cluster); err != nil {
+			logger.Error("Error pushing metrics", "url", detect.pushgatewayURL, "error", err)
+		}
+	}
+	opts.notifier.runDone(opts.summary, err)
+	if opts.cleanupRun != nil {
+		if err := publishCleanupRun(reportCtx, kube, detect, opts, err); err != nil {
+			logger.Error("Error creating the CleanupRun", "error", err)
+		}
+	}
+	if opts.history != nil && !opts.dryRun {
+		if err := opts.history.add(reportCtx, clientset, opts.runID, opts.summary.snapshot(), err); err != nil {
+			logger.Error("Error recording the run history", "configmap", opts.history.namespace+"/"+opts.history.name, "error", err)
+		}
+	}
+	if err := opts.closeRecorders(); err != nil {
+		return fmt.Errorf("Error writing reports: %v", err)
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if opts.table != nil && opts.report == nil {
+		if err := opts.table.write(os.Stdout); err != nil {
+			return err
+		}
+	}
+	if structuredLogs {
+		opts.summary.log()
+	} else {
+		opts.summary.write(logOutput)
+	}
+	if detect.summaryFile != "" {
+		if err := opts.summary.writeFile(detect.summaryFile); err != nil {
+			return fmt.Errorf("Error writing summary: %v", err)
+		}
+	}
+	return err
+}
+
+// detectFlags holds the flags that decide what is considered orphaned.
+type detectFlags struct {
+	allNamespaces         bool
+	namespace             string
+	output                string
+	podNamePattern        string
+	prefixSource          string
+	protect               []string
+	keepAnnotation        string
+	protectConfigMap      string
+	ignoreFile            string
+	deleteIf              string
+	deleteServiceIf       string
+	deleteNetworkPolicyIf string
+	opaURL                string
+	opaTimeout            time.Duration
+	secretSelector        string
+	secretFieldSelector   string
+	includeOwned          bool
+	includeGitOps         bool
+	resources             []string
+	configMaps            bool
+	pvcs                  bool
+	pvcMinAge             time.Duration
+	serviceGrace          time.Duration
+	endpoints             bool
+	serviceAccounts       bool
+	networkPolicies       bool
+	jobs                  bool
+	jobMaxAge             time.Duration
+	hpas                  bool
+	rulesFile             string
+	releasedVolumes       string
+	minAge                time.Duration
+	forceEmpty            bool
+	maxDeletionPercent    int
+	workers               int
+	exportDir             string
+	csvReport             string
+	summaryFile           string
+	explain               bool
+	color                 string
+	progress              string
+	progressInterval      time.Duration
+	metricsAddr           string
+	pprofAddr             string
+	shardIndex            int
+	excludeNamespaces     []string
+	namespaceRegex        string
+	namespacesFrom        string
+	optIn                 bool
+	shardCount            int
+	pushgatewayURL        string
+	pushgatewayJob        string
+	timeout               time.Duration
+	preflight             bool
+	// fleetReport is the file the report of a multi-cluster run is written
+	// to, as JSON or CSV.
+	fleetReport       string
+	fleetReportFormat string
+	// cluster names the cluster of the run, when running against several
+	// clusters, and clusterOverrides are the settings of its --clusters-file
+	// entry.
+	cluster          string
+	clusterOverrides *cleanupPolicySpec
+	// discardLogs silences the progress messages whatever the --output, for
+	// commands whose stdout must only hold their result.
+	discardLogs bool
+}
+
+// logDestination returns where the progress messages go: stderr when stdout
+// carries the --output. It is set once per command, before the clusters are
+// cleaned up in parallel and log through it.
+func (d *detectFlags) logDestination() io.Writer {
+	if d.discardLogs {
+		return io.Discard
+	}
+	switch d.output {
+	case outputTable, outputScript, outputYAML, outputJSON:
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// preflightNamespaces returns the namespaces the permissions are checked in,
+// "" standing for all of them.
+func (d *detectFlags) preflightNamespaces(opts options) []string {
+	switch {
+	case opts.namespaceList != nil:
+		return opts.namespaceList
+	case d.allNamespaces:
+		return []string{""}
+	}
+	return []string{d.namespace}
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM, so the run
+// stops cleanly. A second signal terminates the process right away.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// serve starts serving the metrics and the profiling endpoints if requested.
+// It is called once per process, as a scheduled clean up runs several times.
+func (d *detectFlags) serve() error {
+	if d.metricsAddr != "" {
+		if err := serveMetrics(d.metricsAddr); err != nil {
+			return fmt.Errorf("Error serving metrics: %v", err)
+		}
+	}
+	if d.pprofAddr != "" {
+		if err := serveProfiling(d.pprofAddr); err != nil {
+			return fmt.Errorf("Error serving profiles: %v", err)
+		}
+	}
+	return nil
+}
+
+func (d *detectFlags) register(fs *pflag.FlagSet) {
+	fs.BoolVar(&d.allNamespaces, "all", false, "Process all namespaces with the label cloud.timescale.com/is-customer-resource=\"true\"")
+	fs.StringVar(&d.namespace, "namespace", "", "namespace to clean up secrets")
+	fs.StringVar(&d.output, "output", outputTable, "Output format: \"table\" prints a table of the decisions at the end of the run, \"text\" reports progress, \"script\" deletes nothing and prints a shell script with the kubectl commands to delete the orphans, \"yaml\" deletes nothing and prints the manifests of the orphans, \"json\" prints a JSON record per decision")
+	fs.BoolVar(&d.explain, "explain", false, "Print the rule that decided whether each secret and service is kept or deleted (protected name, keep annotation, reference by a pod, service account or ingress, ownerReferences, age, missing -certificate suffix, prefix match)")
+	fs.StringVar(&d.progress, "progress", progressAuto, "How to report progress with --all: \"bar\" draws a progress bar on stderr, \"log\" logs it every --progress-interval, \"auto\" picks bar on a terminal and log otherwise, \"none\" disables it")
+	fs.DurationVar(&d.progressInterval, "progress-interval", 30*time.Second, "Interval between progress log messages")
+	fs.StringVar(&d.metricsAddr, "metrics-addr", "", "Address to expose Prometheus metrics on at /metrics while running, e.g. :9090")
+	fs.BoolVar(&d.optIn, "opt-in", false, "Only process the namespaces annotated with "+enabledAnnotation+"=true, whatever their labels, so namespace owners decide whether they are cleaned up")
+	fs.StringVar(&d.namespacesFrom, "namespaces-from", "", "Process the namespaces listed in this file, one per line, instead of the labeled ones. \"-\" reads them from stdin")
+	fs.StringVar(&d.namespaceRegex, "namespace-regex", "", "Only process the labeled namespaces whose whole name matches this regular expression with --all, e.g. \"project-sandbox-.*\"")
+	fs.StringArrayVar(&d.excludeNamespaces, "exclude-namespace", nil, "Namespace never to clean up, as a glob or a regex: prefixed regular expression. May be repeated. "+strings.Join(systemNamespaces, ", ")+" and the namespace the tool runs in are always excluded")
+	fs.IntVar(&d.shardIndex, "shard-index", 0, "Index of this run among --shard-count parallel runs, from 0")
+	fs.IntVar(&d.shardCount, "shard-count", 1, "Number of parallel runs splitting the namespaces of --all between them by the hash of their name")
+	fs.StringVar(&d.pprofAddr, "pprof-addr", "", "Address to serve the Go profiling endpoints on at /debug/pprof/ while running, e.g. localhost:6060")
+	fs.StringVar(&d.pushgatewayURL, "pushgateway-url", "", "URL of a Prometheus Pushgateway to push the metrics to at the end of the run")
+	fs.StringVar(&d.pushgatewayJob, "pushgateway-job", "orphaned-secrets-deleter", "Job name the metrics are pushed under")
+	fs.DurationVar(&d.timeout, "timeout", 0, fmt.Sprintf("Maximum duration of the run. Once it expired no further namespace is started, the ones in progress are finished and the tool exits with code %d, listing the unprocessed namespaces in the summary (0 means no limit)", exitTimeout))
+	fs.BoolVar(&d.preflight, "preflight", true, "Check with SelfSubjectAccessReviews that the run is allowed to read and delete what it cleans up, and to read what references it, before starting, and fail with the list of missing permissions otherwise")
+	fs.StringVar(&d.fleetReport, "fleet-report", "", "With --contexts, --all-contexts or --clusters-file, write a report of the totals and failures of every cluster and of the whole fleet to this file")
+	fs.StringVar(&d.fleetReportFormat, "fleet-report-format", fleetReportJSON, "Format of the --fleet-report: json or csv")
+	fs.StringVar(&d.summaryFile, "summary-file", "", "Also write the summary printed at the end of the run to this file")
+	fs.StringVar(&d.csvReport, "csv-report", "", "Write a CSV audit report with a row per decision (namespace, kind, name, age, size, reason, action) to this file")
+	fs.StringVar(&d.color, "color", colorAuto, "Color the actions in the table output: \"auto\" (when writing to a terminal), \"always\" or \"never\"")
+	fs.StringVar(&d.exportDir, "export-dir", "", "With --output=yaml, write the manifests to <dir>/<kind>/<namespace>/<name>.yaml instead of stdout")
+	fs.StringVar(&d.podNamePattern, "pod-name-pattern", defaultPodNamePattern, "Regular expression matched against pod names; its first capture group is the prefix that secrets must contain to be kept")
+	fs.StringVar(&d.prefixSource, "prefix-source", prefixSourcePods, "Where to extract the prefixes of live instances from: \"pods\", \"workloads\" (StatefulSets and Deployments) or \"all\"")
+	fs.StringVar(&d.deleteIf, "delete-if", "", "CEL expression deciding whether a secret that passed the safety checks (protected, ignored, keep annotation, referenced, managed by a controller, ownerReferences, min age) is orphaned, replacing the -certificate suffix and prefix heuristics. It sees secret (name, namespace, labels, annotations, type, created, age, ownerReferences) and the list of live instance prefixes, e.g. 'secret.name.endsWith(\"-certificate\") && !prefixes.exists(p, secret.name.contains(p))'")
+	fs.StringVar(&d.deleteServiceIf, "delete-service-if", "", "CEL expression deciding whether a service is orphaned, replacing the selector check. It sees service (name, namespace, labels, annotations, type, selector, created, age, ownerReferences) and prefixes")
+	fs.DurationVar(&d.serviceGrace, "service-grace", defaultServiceGrace, "Only delete a service once its selector has matched no pod and its EndpointSlices have been empty for this duration, so rollouts and restarts do not orphan it. Services without a selector are always kept")
+	fs.BoolVar(&d.endpoints, "endpoints", false, "Also clean up the EndpointSlices and Endpoints left behind by deleted services, or pointing only to pods gone for --service-grace, so DNS and kube-proxy stop routing to them. They are not backed up, as the control plane recreates them for live services")
+	fs.StringVar(&d.deleteNetworkPolicyIf, "delete-networkpolicy-if", "", "CEL expression deciding whether a NetworkPolicy whose podSelector matches no pod is orphaned, with --networkpolicies, replacing the prefix heuristic. It sees networkPolicy (name, namespace, labels, annotations, podSelector, created, age, ownerReferences) and prefixes")
+	fs.StringVar(&d.opaURL, "opa-url", "", "Data API URL of an Open Policy Agent decision, e.g. http://localhost:8181/v1/data/orphancleaner/decision, asked about every orphan with the object (without its data), the reason, the prefixes, the run ID and whether it is a dry run as input. The orphan is only deleted if the result has \"delete\": true; an undefined result or an unreachable server keeps it")
+	fs.DurationVar(&d.opaTimeout, "opa-timeout", 5*time.Second, "Timeout of a query to the OPA server")
+	fs.StringVar(&d.ignoreFile, "ignore-file", "", "File excluding objects of any resource from the cleanup, such as a mounted ConfigMap, in the style of .gitignore: a glob per line matching the name, or namespace/name when it contains a slash, \"!\" re-including what an earlier line excluded and \"#\" starting comments")
+	fs.StringVar(&d.protectConfigMap, "protect-from-configmap", "", "ConfigMap, as namespace/name, whose values hold more protected patterns, one per line. It is read at the start of every run, or of every reconciliation of the controller")
+	fs.StringVar(&d.keepAnnotation, "keep-annotation", defaultKeepAnnotation, "Never delete the secrets with this annotation set to \"true\", so teams can pin secrets they know are unreferenced. An empty value disables it")
+	fs.StringArrayVar(&d.protect, "protect", nil, "Name pattern of the objects of any resource never deleted, in addition to the built-in "+strings.Join(defaultProtectPatterns, ", ")+". Shell glob by default, or a regular expression when prefixed with \"regex:\". May be repeated")
+	fs.StringVar(&d.secretSelector, "secret-selector", "", "Label selector restricting which secrets are considered for deletion")
+	fs.StringVar(&d.secretFieldSelector, "secret-field-selector", "", "Field selector restricting which secrets are considered for deletion (e.g. type=kubernetes.io/tls)")
+	fs.BoolVar(&d.includeOwned, "include-owned", false, "Also consider secrets that have ownerReferences; by default they are left to the Kubernetes garbage collector")
+	fs.BoolVar(&d.includeGitOps, "include-gitops", false, "Also consider secrets and services deployed by Argo CD or Flux; by default they are left alone as their reconciliation would recreate them")
+	fs.StringSliceVar(&d.resources, "resources", defaultResources, "Kinds of objects to clean up, among "+strings.Join(resourceNames(), ", ")+". An OrphanCleanupPolicy can only narrow them down")
+	fs.BoolVar(&d.configMaps, "configmaps", false, "Also clean up the ConfigMaps named after an instance, like its pods according to --pod-name-pattern, once the instance is gone. ConfigMaps used by pods and "+strings.Join(defaultConfigMapProtectPatterns, ", ")+" are always kept")
+	fs.BoolVar(&d.pvcs, "pvcs", false, "Also clean up the PersistentVolumeClaims of instances that are gone, deleting their data unless the volume is retained. Claims mounted by a pod, owned by an object or belonging to a StatefulSet are always kept, and only their manifest is backed up")
+	fs.BoolVar(&d.serviceAccounts, "serviceaccounts", false, "Also clean up the ServiceAccounts named after an instance once the instance is gone. The default ServiceAccount, those run as by pods, StatefulSets or Deployments and those bound by RoleBindings of other namespaces or ClusterRoleBindings are always kept")
+	fs.BoolVar(&d.networkPolicies, "networkpolicies", false, "Also clean up the NetworkPolicies named after an instance once the instance is gone and their podSelector matches no pod. Policies selecting all pods of the namespace are always kept")
+	fs.BoolVar(&d.jobs, "jobs", false, "Also delete the Jobs, and their pods, that completed or failed more than --job-max-age ago. Jobs with ttlSecondsAfterFinished or owned by a CronJob are left to their controllers")
+	fs.DurationVar(&d.jobMaxAge, "job-max-age", defaultJobMaxAge, "How long a finished Job is kept with --jobs")
+	fs.BoolVar(&d.hpas, "hpas", false, "Also clean up the HorizontalPodAutoscalers whose Deployment, StatefulSet, ReplicaSet or ReplicationController is gone. Those scaling other kinds are always kept")
+	fs.StringVar(&d.rulesFile, "rules-file", "", "YAML file of rules cleaning up other resources, custom resources included, through the dynamic client: per rule the group, version and resource, the Namespaced or Cluster scope, a CEL match expression and keep expressions seeing object (with spec and status) and prefixes, references of other objects naming the object at a path, and whether its name must carry the prefix of a gone instance. The cleaner needs list and delete permissions on these resources")
+	fs.DurationVar(&d.pvcMinAge, "pvc-min-age", defaultPVCMinAge, "Never delete PersistentVolumeClaims younger than this duration, with --pvcs")
+	fs.StringVar(&d.releasedVolumes, "released-volumes", "", "With --all, also clean up the PersistentVolumes left Released by the claims of deleted namespaces, once released for --pvc-min-age. Only the volumes a run saw Released while their namespace still existed as a cleaned up namespace, which it annotates with "+releasedSeenAnnotation+", are considered: \"delete\" deletes the PersistentVolume objects, leaving the storage of Retain volumes in place, \"reclaim\" sets their reclaim policy to Delete so the provisioner deletes the storage too. The reclaimable capacity is reported")
+	fs.DurationVar(&d.minAge, "min-age", 0, "Never delete objects younger than this duration (e.g. 1h)")
+	fs.BoolVar(&d.forceEmpty, "force-empty", false, "Clean up namespaces even when no pod prefixes were found in them")
+	fs.IntVar(&d.maxDeletionPercent, "max-deletion-percent", defaultMaxDeletionPercent, "Skip a resource of a namespace when more than this percentage of its objects would be deleted (0 or 100 disables the check)")
+	fs.IntVar(&d.workers, "workers", 15, "Number of namespaces processed in parallel with --all")
+}
+
+// options validates the flags and turns them into cleanup options.
+func (d *detectFlags) options() (options, error) {
+	var namespaceList []string
+	if d.namespacesFrom != "" {
+		if d.namespace != "" || d.allNamespaces {
+			return options{}, fmt.Errorf("--namespaces-from cannot be combined with --namespace or --all")
+		}
+		var err error
+		if namespaceList, err = readNamespaceList(d.namespacesFrom); err != nil {
+			return options{}, fmt.Errorf("Invalid --namespaces-from: %v", err)
+		}
+	} else if d.namespace == "" && !d.allNamespaces {
+		return options{}, fmt.Errorf("Please specify the namespace using the --namespace flag.")
+	}
+	podNameRegexp, err := compilePodNamePattern(d.podNamePattern)
+	if err != nil {
+		return options{}, fmt.Errorf("Invalid --pod-name-pattern: %v", err)
+	}
+	if d.workers < 1 {
+		return options{}, fmt.Errorf("Invalid --workers: must be at least 1")
+	}
+	if err := validateOutput(d.output); err != nil {
+		return options{}, fmt.Errorf("Invalid --output: %v", err)
+	}
+	if err := validateReleasedVolumes(d.releasedVolumes); err != nil {
+		return options{}, fmt.Errorf("Invalid --released-volumes: %v", err)
+	}
+	if err := validatePrefixSource(d.prefixSource); err != nil {
+		return options{}, fmt.Errorf("Invalid --prefix-source: %v", err)
+	}
+	protected, err := compileProtectPatterns(d.protect)
+	if err != nil {
+		return options{}, fmt.Errorf("Invalid --protect: %v", err)
+	}
+	var ignore *ignoreList
+	if d.ignoreFile != "" {
+		if ignore, err = loadIgnoreFile(d.ignoreFile); err != nil {
+			return options{}, fmt.Errorf("Invalid --ignore-file: %v", err)
+		}
+	}
+	var rules []cleanupRule
+	if d.rulesFile != "" {
+		if rules, err = loadRulesFile(d.rulesFile); err != nil {
+			return options{}, fmt.Errorf("Invalid --rules-file: %v", err)
+		}
+	}
+	resources, err := parseResources(d.resources)
+	if err != nil {
+		return options{}, fmt.Errorf("Invalid --resources: %v", err)
+	}
+	// The flags predating --resources add their kind
+	for resource, enabled := range map[string]bool{
+		resourceEndpoints:       d.endpoints,
+		resourceConfigMaps:      d.configMaps,
+		resourcePVCs:            d.pvcs,
+		resourceServiceAccounts: d.serviceAccounts,
+		resourceNetworkPolicies: d.networkPolicies,
+		resourceJobs:            d.jobs,
+		resourceHPAs:            d.hpas,
+		resourceRules:           d.rulesFile != "",
+	} {
+		resources[resource] = resources[resource] || enabled
+	}
+	if resources[resourceRules] && d.rulesFile == "" {
+		return options{}, fmt.Errorf("Invalid --resources: %s requires --rules-file", resourceRules)
+	}
+	var deleteIf, deleteServiceIf, deleteNetworkPolicyIf *expression
+	if d.deleteIf != "" {
+		if deleteIf, err = compileExpression(d.deleteIf, "secret"); err != nil {
+			return options{}, fmt.Errorf("Invalid --delete-if: %v", err)
+		}
+	}
+	if d.deleteServiceIf != "" {
+		if deleteServiceIf, err = compileExpression(d.deleteServiceIf, "service"); err != nil {
+			return options{}, fmt.Errorf("Invalid --delete-service-if: %v", err)
+		}
+	}
+	if d.deleteNetworkPolicyIf != "" {
+		if deleteNetworkPolicyIf, err = compileExpression(d.deleteNetworkPolicyIf, "networkPolicy"); err != nil {
+			return options{}, fmt.Errorf("Invalid --delete-networkpolicy-if: %v", err)
+		}
+	}
+	var opa *opaPolicy
+	if d.opaURL != "" {
+		if u, err := url.Parse(d.opaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return options{}, fmt.Errorf("Invalid --opa-url: must be an http or https URL")
+		}
+		opa = newOPAPolicy(d.opaURL, d.opaTimeout)
+	}
+	if namespace, name, _ := strings.Cut(d.protectConfigMap, "/"); d.protectConfigMap != "" && (namespace == "" || name == "") {
+		return options{}, fmt.Errorf("Invalid --protect-from-configmap: must be namespace/name")
+	}
+	if _, err := labels.Parse(d.secretSelector); err != nil {
+		return options{}, fmt.Errorf("Invalid --secret-selector: %v", err)
+	}
+	if _, err := fields.ParseSelector(d.secretFieldSelector); err != nil {
+		return options{}, fmt.Errorf("Invalid --secret-field-selector: %v", err)
+	}
+	excludedNamespaces, err := compileExcludedNamespaces(d.excludeNamespaces)
+	if err != nil {
+		return options{}, fmt.Errorf("Invalid --exclude-namespace: %v", err)
+	}
+	if pattern, excluded := matchProtected(excludedNamespaces, d.namespace); excluded && !d.allNamespaces {
+		return options{}, fmt.Errorf("Invalid --namespace: %s is excluded by %s", d.namespace, pattern)
+	}
+	var namespaceRegexp *regexp.Regexp
+	if d.namespaceRegex != "" {
+		if namespaceRegexp, err = regexp.Compile("^(?:" + d.namespaceRegex + ")$"); err != nil {
+			return options{}, fmt.Errorf("Invalid --namespace-regex: %v", err)
+		}
+	}
+	if d.shardCount < 1 || d.shardIndex < 0 || d.shardIndex >= d.shardCount {
+		return options{}, fmt.Errorf("Invalid --shard-index: must be between 0 and --shard-count minus one")
+	}
+	if d.exportDir != "" && d.output != outputYAML {
+		return options{}, fmt.Errorf("--export-dir requires --output=%s", outputYAML)
+	}
+
+	opts := options{
+		podNamePattern:        podNameRegexp,
+		protected:             protected,
+		keepAnnotation:        d.keepAnnotation,
+		protectConfigMap:      d.protectConfigMap,
+		ignore:                ignore,
+		deleteIf:              deleteIf,
+		deleteServiceIf:       deleteServiceIf,
+		deleteNetworkPolicyIf: deleteNetworkPolicyIf,
+		opa:                   opa,
+		includeOwned:          d.includeOwned,
+		includeGitOps:         d.includeGitOps,
+		resources:             resources,
+		pvcMinAge:             d.pvcMinAge,
+		serviceGrace:          d.serviceGrace,
+		jobMaxAge:             d.jobMaxAge,
+		rules:                 rules,
+		releasedVolumes:       d.releasedVolumes,
+		minAge:                d.minAge,
+		maxDeletionPercent:    d.maxDeletionPercent,
+		secretListOptions: metav1.ListOptions{
+			LabelSelector: d.secretSelector,
+			FieldSelector: d.secretFieldSelector,
+		},
+		forceEmpty:         d.forceEmpty,
+		prefixSource:       d.prefixSource,
+		workers:            d.workers,
+		shard:              namespaceShard{index: d.shardIndex, count: d.shardCount},
+		excludedNamespaces: excludedNamespaces,
+		namespaceRegexp:    namespaceRegexp,
+		namespaceList:      namespaceList,
+		optIn:              d.optIn,
+	}
+	switch d.output {
+	case outputTable:
+		color, err := useColor(d.color, os.Stdout)
+		if err != nil {
+			return options{}, fmt.Errorf("Invalid --color: %v", err)
+		}
+		opts.table = newTableRecorder(color)
+		opts.recorders = append(opts.recorders, opts.table)
+	case outputScript:
+		opts.script = newScriptWriter(os.Stdout)
+	case outputYAML:
+		opts.export = newManifestWriter(os.Stdout, d.exportDir)
+	case outputJSON:
+		opts.recorders = append(opts.recorders, newJSONRecorder(os.Stdout))
+	}
+	if d.explain {
+		opts.recorders = append(opts.recorders, newExplainRecorder(logWriter{}))
+	}
+	if d.allNamespaces || d.namespacesFrom != "" {
+		if opts.progress, err = newProgressReporter(d.progress, d.progressInterval); err != nil {
+			return options{}, fmt.Errorf("Invalid --progress: %v", err)
+		}
+		if opts.progress != nil {
+			opts.recorders = append(opts.recorders, opts.progress)
+		}
+	}
+	opts.runID = newRunID()
+	opts.summary = newRunSummary()
+	opts.summary.cluster = d.cluster
+	opts.recorders = append(opts.recorders, opts.summary, metrics)
+	if d.pushgatewayURL != "" {
+		opts.runMetrics = newCleanerMetrics()
+		opts.recorders = append(opts.recorders, opts.runMetrics)
+	}
+	if d.clusterOverrides != nil {
+		var scope cleanupScope
+		if opts, scope, err = applyPolicy(opts, *d.clusterOverrides); err != nil {
+			return options{}, fmt.Errorf("Invalid overrides of cluster %s: %v", d.cluster, err)
+		}
+		// The overrides narrow down the resources of the flags
+		opts.resources = opts.resources.and(scope)
+	}
+	// Opened last, as nothing closes it when building the options fails
+	if d.csvReport != "" {
+		csvReport, err := newCSVRecorder(d.csvReport)
+		if err != nil {
+			return options{}, fmt.Errorf("Invalid --csv-report: %v", err)
+		}
+		opts.recorders = append(opts.recorders, csvReport)
+	}
+	return opts, nil
+}
+
+// cleanFlags holds the flags that control how orphans are deleted.
+type cleanFlags struct {
+	dryRun                   bool
+	serverDryRun             bool
+	batchDelete              bool
+	maxDeletions             int
+	maxDeletionsPerNamespace int
+	markGrace                time.Duration
+	quarantineDir            string
+	backupDir                string
+	// cluster is set by forCluster for the runs against several clusters.
+	cluster              string
+	backupURL            string
+	backupS3Endpoint     string
+	backupEncryptionKey  string
+	backupRecipients     []string
+	backupRecipientFiles []string
+	events               bool
+	auditLog             string
+	slackWebhooks        []string
+	teamsWebhooks        []string
+	notifyDeletions      bool
+	webhooks             []string
+	webhookTemplate      string
+	webhookContentType   string
+	historyConfigMap     string
+	historyNamespace     string
+	historyLimit         int
+	cleanupRun           bool
+}
+
+func (c *cleanFlags) register(fs *pflag.FlagSet) {
+	fs.BoolVar(&c.dryRun, "dry-run", false, "Print messages without deleting secrets")
+	fs.BoolVar(&c.batchDelete, "batch-delete", false, "Label the orphaned secrets of a namespace with "+deleteRunLabel+" and delete them with a single DeleteCollection request instead of one request each. Services are always deleted one by one, as they do not support DeleteCollection")
+	fs.BoolVar(&c.serverDryRun, "server-dry-run", false, "Send delete requests in server-side dry-run mode, so admission and RBAC are checked without persisting the deletion")
+	fs.IntVar(&c.maxDeletions, "max-deletions", 0, "Maximum number of objects deleted during the whole run (0 means unlimited)")
+	fs.IntVar(&c.maxDeletionsPerNamespace, "max-deletions-per-namespace", 0, "Maximum number of objects of a resource deleted in a single namespace (0 means unlimited)")
+	fs.DurationVar(&c.markGrace, "mark-grace", 0, "Enable two-phase deletion: orphaned secrets are first annotated with "+candidateSinceAnnotation+" and only deleted by a later run once this duration has passed and they are still orphaned")
+	fs.StringVar(&c.quarantineDir, "quarantine", "", "Directory to export every secret to, after annotating it with the detection details, right before it is deleted")
+	fs.StringVar(&c.backupDir, "backup-dir", "", "Directory to write a tar archive of every object deleted to, each object encrypted with age and synced to disk before it is deleted")
+	fs.StringVar(&c.backupURL, "backup-url", "", "Object storage location to upload the backup archive to, under a prefix named after the run: s3://bucket/prefix, gs://bucket/prefix or azblob://account/container/prefix")
+	fs.StringVar(&c.backupS3Endpoint, "backup-s3-endpoint", "", "Endpoint of an S3 compatible object store to use instead of AWS")
+	fs.StringVar(&c.backupEncryptionKey, "backup-encryption-key", "", "Server-side encryption key for uploaded backups: AWS KMS key ID, Cloud KMS key name or Azure encryption scope. Provider managed keys are used by default")
+	fs.StringArrayVar(&c.backupRecipients, "backup-recipient", nil, "age public key the backup archive is encrypted for. May be repeated")
+	fs.StringArrayVar(&c.backupRecipientFiles, "backup-recipients-file", nil, "File with age public keys the backup archive is encrypted for, one per line. May be repeated")
+	fs.StringVar(&c.auditLog, "audit-log", "", "Append a JSON line per deletion attempt, with the object UID and resourceVersion, the reason, the run ID and the outcome, to this file")
+	fs.StringArrayVar(&c.slackWebhooks, "slack-webhook", nil, "Slack incoming webhook URL to post a summary of the run to. May be repeated")
+	fs.StringArrayVar(&c.teamsWebhooks, "teams-webhook", nil, "Microsoft Teams incoming webhook URL to post a summary of the run to. May be repeated")
+	fs.StringArrayVar(&c.webhooks, "webhook", nil, "URL to post a notification to at the end of the run, rendered with --webhook-template. May be repeated")
+	fs.StringVar(&c.webhookTemplate, "webhook-template", "", "File with a Go template rendering the --webhook payload from the notification (.Event, .RunID, .Text, .Decision, .Summary, .Error). Defaults to the notification as JSON")
+	fs.StringVar(&c.webhookContentType, "webhook-content-type", "application/json", "Content type of the --webhook payload")
+	fs.BoolVar(&c.notifyDeletions, "notify-deletions", false, "Also post a message to the webhooks for every deletion")
+	fs.StringVar(&c.historyConfigMap, "history-configmap", "", "Name of a ConfigMap to record a summary of every run in, keyed by run ID")
+	fs.StringVar(&c.historyNamespace, "history-namespace", "", "Namespace of the --history-configmap. Defaults to the namespace the tool runs in")
+	fs.IntVar(&c.historyLimit, "history-limit", 10, "Number of runs kept in the --history-configmap")
+	fs.BoolVar(&c.cleanupRun, "cleanup-run", false, "Create a CleanupRun custom resource listing the objects deleted and skipped by the run (see manifests/cleanuprun-crd.yaml)")
+	fs.BoolVar(&c.events, "events", true, "Emit a Kubernetes event in the namespace of every deleted object (reason OrphanedSecretDeleted or OrphanedServiceDeleted)")
+}
+
+// notificationSinks returns the webhooks to notify about the run.
+func (c *cleanFlags) notificationSinks() ([]notificationSink, error) {
+	var sinks []notificationSink
+	for _, url := range c.slackWebhooks {
+		sinks = append(sinks, chatWebhook{service: chatSlack, url: url})
+	}
+	for _, url := range c.teamsWebhooks {
+		sinks = append(sinks, chatWebhook{service: chatTeams, url: url})
+	}
+	if len(c.webhooks) == 0 {
+		return sinks, nil
+	}
+	tmpl, err := parseWebhookTemplate(c.webhookTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --webhook-template: %v", err)
+	}
+	for _, url := range c.webhooks {
+		sinks = append(sinks, templateWebhook{url: url, contentType: c.webhookContentType, tmpl: tmpl})
+	}
+	return sinks, nil
+}
+
+// apply adds the deletion settings to opts and opens the backup archive. The
+// reports of opts are closed when it fails.
+func (c *cleanFlags) apply(opts *options) (err error) {
+	defer func() {
+		if err != nil {
+			opts.closeRecorders()
+		}
+	}()
+	// A cluster may have been set to dry-run mode by its overrides
+	opts.dryRun = opts.dryRun || c.dryRun
+	opts.serverDryRun = c.serverDryRun
+	if c.batchDelete && c.serverDryRun {
+		return fmt.Errorf("--batch-delete cannot be combined with --server-dry-run, as the secrets could not be labeled")
+	}
+	opts.batchDelete = c.batchDelete
+	opts.budget = newDeletionBudget(c.maxDeletions)
+	opts.maxPerNamespace = c.maxDeletionsPerNamespace
+	opts.markGrace = c.markGrace
+	opts.quarantineDir = c.quarantineDir
+	opts.events = c.events && !c.serverDryRun
+	if c.cleanupRun {
+		opts.cleanupRun = newCleanupRunRecorder(cleanupRunSpec{DryRun: !opts.mutates()})
+		opts.recorders = append(opts.recorders, opts.cleanupRun)
+	}
+	if c.historyConfigMap != "" {
+		if c.historyLimit < 1 {
+			return fmt.Errorf("Invalid --history-limit: must be at least 1")
+		}
+		opts.history = &historyConfigMap{namespace: c.historyNamespace, name: c.historyConfigMap, limit: c.historyLimit}
+		if opts.history.namespace == "" {
+			opts.history.namespace = ownNamespace()
+		}
+	}
+	sinks, err := c.notificationSinks()
+	if err != nil {
+		return err
+	}
+	if len(sinks) > 0 {
+		opts.notifier = &notifier{sinks: sinks, deletions: c.notifyDeletions, runID: opts.runID}
+		opts.recorders = append(opts.recorders, opts.notifier)
+	}
+	if c.auditLog != "" {
+		audit, err := newAuditRecorder(c.auditLog)
+		if err != nil {
+			return fmt.Errorf("Invalid --audit-log: %v", err)
+		}
+		opts.recorders = append(opts.recorders, audit)
+	}
+
+	if (c.backupDir == "" && c.backupURL == "") || !opts.mutates() {
+		return nil
+	}
+	recipients, err := parseRecipients(c.backupRecipients, c.backupRecipientFiles)
+	if err != nil {
+		return fmt.Errorf("Invalid backup recipients: %v", err)
+	}
+	var store backupStore
+	if c.backupURL != "" {
+		if store, err = newBackupStore(c.backupURL, c.backupS3Endpoint, c.backupEncryptionKey); err != nil {
+			return fmt.Errorf("Invalid --backup-url: %v", err)
+		}
+	}
+	dir := c.backupDir
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "orphaned-secrets-backup"); err != nil {
+			return fmt.Errorf("Error creating backup: %v", err)
+		}
+	}
+	opts.backup, err = newBackupWriter(dir, opts.runID, recipients)
+	if err != nil {
+		return fmt.Errorf("Error creating backup: %v", err)
+	}
+	opts.backup.store = store
+	opts.backup.cluster = c.cluster
+	opts.backup.temporary = c.backupDir == ""
+	if err := opts.backup.checkStore(context.Background()); err != nil {
+		opts.backup.file.Close()
+		os.Remove(opts.backup.path)
+		opts.backup = nil
+		return fmt.Errorf("Error writing to --backup-url, nothing was deleted: %v", err)
+	}
+	return nil
+}
+
+// publishCleanupRun records the results of the run in a CleanupRun.
+func publishCleanupRun(ctx context.Context, kube *kubeFlags, detect detectFlags, opts options, runErr error) error {
+	client, err := kube.dynamicClient()
+	if err != nil {
+		return err
+	}
+	opts.cleanupRun.spec.AllNamespaces = detect.allNamespaces
+	opts.cleanupRun.spec.Namespace = detect.namespace
+	return opts.cleanupRun.publish(ctx, client, opts.runID, opts.summary.snapshot(), runErr)
+}
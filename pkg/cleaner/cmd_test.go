@@ -0,0 +1,60 @@
+package cleaner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestApplyFailureClosesCSVReport(t *testing.T) {
+	var detect detectFlags
+	var clean cleanFlags
+	report := filepath.Join(t.TempDir(), "report.csv")
+	fs := pflag.NewFlagSet("clean", pflag.ContinueOnError)
+	detect.register(fs)
+	clean.register(fs)
+	args := []string{"--namespace=team-a", "--csv-report=" + report, "--backup-url=ftp://backups", "--backup-recipient=age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := detect.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clean.apply(&opts); err == nil {
+		t.Fatal("apply accepted an ftp --backup-url")
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(csvHeader, ","); !strings.HasPrefix(string(data), want) {
+		t.Errorf("report = %q, want the header flushed by Close", data)
+	}
+}
+
+func TestControllerRejectsRunFlags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{args: []string{"--timeout=1h"}, wantErr: "--timeout is not supported by the controller"},
+		{args: []string{"--cleanup-run"}, wantErr: "--cleanup-run is not supported by the controller"},
+		{args: []string{"--webhook=https://hooks.example.com"}, wantErr: "--webhook is not supported by the controller"},
+		{args: []string{"--namespaces-from=-"}, wantErr: "--namespaces-from is not supported by the controller"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args[0], func(t *testing.T) {
+			cmd := newControllerCommand(&kubeFlags{})
+			cmd.SetArgs(tt.args)
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			if err := cmd.Execute(); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package cleaner
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfigFile applies the settings of a YAML configuration file to the
+// flags of cmd. The keys are the flag names, lists are used for repeatable
+// flags:
+//
+//	all: true
+//	workers: 30
+//	min-age: 1h
+//	protect:
+//	  - "*-ca"
+//	  - "regex:^keep-"
+//
+// Flags given on the command line take precedence over the file. Keys that
+// belong to other subcommands are ignored, so one file can serve them all.
+func loadConfigFile(cmd *cobra.Command, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %v", err)
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+
+	known := knownFlags(cmd.Root())
+	for key, value := range values {
+		if !known[key] {
+			return fmt.Errorf("Error in config file %s: unknown setting %q", path, key)
+		}
+		f := cmd.Flags().Lookup(key)
+		if f == nil || f.Changed {
+			continue
+		}
+		if err := setFlag(f, value); err != nil {
+			return fmt.Errorf("Error in config file %s: invalid %s: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+// setFlag assigns a decoded YAML value to a flag.
+func setFlag(f *pflag.Flag, value interface{}) error {
+	values := []interface{}{value}
+	if list, ok := value.([]interface{}); ok {
+		values = list
+	}
+	for _, v := range values {
+		if err := f.Value.Set(formatValue(v)); err != nil {
+			return err
+		}
+	}
+	// Mark the flag as set so lower precedence sources leave it alone
+	f.Changed = true
+	return nil
+}
+
+// formatValue turns a decoded YAML value into its flag representation. YAML
+// numbers are decoded as floats, which must not end up in exponent notation.
+func formatValue(value interface{}) string {
+	if number, ok := value.(float64); ok && number == math.Trunc(number) {
+		return strconv.FormatInt(int64(number), 10)
+	}
+	return fmt.Sprint(value)
+}
+
+// envPrefix is prepended to the flag names to form environment variables.
+const envPrefix = "OSD_"
+
+// envName returns the environment variable configuring a flag, e.g.
+// OSD_DRY_RUN for --dry-run.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// loadEnv applies OSD_* environment variables to the flags of cmd that were
+// not given on the command line. Repeatable flags take a comma-separated list.
+func loadEnv(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Changed || err != nil {
+			return
+		}
+		values := []string{value}
+		if strings.HasSuffix(f.Value.Type(), "Array") || strings.HasSuffix(f.Value.Type(), "Slice") {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = fmt.Errorf("Invalid %s: %v", envName(f.Name), setErr)
+				return
+			}
+		}
+		f.Changed = true
+	})
+	return err
+}
+
+// knownFlags returns the names of the flags of cmd and all its subcommands.
+func knownFlags(cmd *cobra.Command) map[string]bool {
+	known := map[string]bool{}
+	var visit func(*cobra.Command)
+	visit = func(c *cobra.Command) {
+		c.Flags().VisitAll(func(f *pflag.Flag) { known[f.Name] = true })
+		c.PersistentFlags().VisitAll(func(f *pflag.Flag) { known[f.Name] = true })
+		for _, sub := range c.Commands() {
+			visit(sub)
+		}
+	}
+	visit(cmd)
+	return known
+}
@@ -0,0 +1,181 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultConfigMapProtectPatterns are the ConfigMaps published into every
+// namespace by the control plane, never to be deleted.
+var defaultConfigMapProtectPatterns = []string{
+	"kube-root-ca.crt",
+	"openshift-service-ca.crt",
+}
+
+// protectedConfigMaps are the compiled defaultConfigMapProtectPatterns.
+var protectedConfigMaps = mustCompileProtectPatterns(defaultConfigMapProtectPatterns)
+
+func mustCompileProtectPatterns(raw []string) []namePattern {
+	patterns := make([]namePattern, 0, len(raw))
+	for _, value := range raw {
+		pattern, err := parseNamePattern(value)
+		if err != nil {
+			panic(err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// decideConfigMap decides whether a ConfigMap is orphaned, and explains why.
+// ConfigMaps are considered per instance when their name matches the pod name
+// pattern, like the pods of the instance, and orphaned once no live instance
+// has their prefix.
+func decideConfigMap(configMap v1.ConfigMap, podPrefixes []string, refs map[string]string, opts options) (bool, string) {
+	if pattern, ok := matchProtected(protectedConfigMaps, configMap.Name); ok {
+		return false, fmt.Sprintf("name matches protected pattern %s", pattern)
+	}
+	if user, ok := refs[configMap.Name]; ok {
+		return false, "referenced by " + user
+	}
+	match := opts.podNamePattern.FindStringSubmatch(configMap.Name)
+	if match == nil || match[1] == "" {
+		return false, "not named after an instance"
+	}
+	for _, prefix := range podPrefixes {
+		if prefix == match[1] {
+			return false, fmt.Sprintf("matches pod prefix %s", prefix)
+		}
+	}
+	return true, orphanedReason
+}
+
+// gatherConfigMapReferences maps the names of the ConfigMaps used by the pods
+// of a namespace, in volumes or environment variables, to the first pod using
+// them.
+func gatherConfigMapReferences(ctx context.Context, clientset kubernetes.Interface, namespace string, opts options) (map[string]string, error) {
+	pods, err := listPods(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %v", err)
+	}
+	refs := map[string]string{}
+	add := func(name, user string) {
+		if _, found := refs[name]; name != "" && !found {
+			refs[name] = user
+		}
+	}
+	for _, pod := range pods {
+		for _, volume := range pod.Spec.Volumes {
+			user := fmt.Sprintf("pod/%s volume %s", pod.Name, volume.Name)
+			if volume.ConfigMap != nil {
+				add(volume.ConfigMap.Name, user)
+			}
+			if volume.Projected != nil {
+				for _, source := range volume.Projected.Sources {
+					if source.ConfigMap != nil {
+						add(source.ConfigMap.Name, user)
+					}
+				}
+			}
+		}
+		containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			user := fmt.Sprintf("pod/%s container %s", pod.Name, container.Name)
+			for _, source := range container.EnvFrom {
+				if source.ConfigMapRef != nil {
+					add(source.ConfigMapRef.Name, user)
+				}
+			}
+			for _, env := range container.Env {
+				if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+					add(env.ValueFrom.ConfigMapKeyRef.Name, user)
+				}
+			}
+		}
+	}
+	return refs, nil
+}
+
+// configMapCleaner cleans up the orphaned ConfigMaps of a namespace.
+type configMapCleaner struct {
+	clientset   kubernetes.Interface
+	podPrefixes []string
+	namespace   string
+	opts        options
+	refs        map[string]string
+}
+
+func newConfigMapCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &configMapCleaner{clientset: clientset, podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+func (c *configMapCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	configMaps, err := listConfigMaps(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing configmaps: %v", err)
+	}
+	if c.refs, err = gatherConfigMapReferences(ctx, c.clientset, c.namespace, c.opts); err != nil {
+		return nil, err
+	}
+	objects := make([]CleanupObject, 0, len(configMaps))
+	for _, configMap := range configMaps {
+		configMap := configMap
+		objects = append(objects, CleanupObject{
+			Kind:   "ConfigMap",
+			Meta:   configMap.ObjectMeta,
+			Size:   configMapSize(configMap),
+			Object: configMap,
+			Export: func() interface{} { return exportableConfigMap(configMap) },
+			Backup: func() interface{} { return backupConfigMap(configMap) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *configMapCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decideConfigMap(obj.Object.(v1.ConfigMap), c.podPrefixes, c.refs, c.opts)
+	return shouldDelete, reason, nil
+}
+
+func (c *configMapCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	return c.clientset.CoreV1().ConfigMaps(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *configMapCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "ConfigMap", reason, err)
+}
+
+// configMapSize returns the number of bytes of data held by the ConfigMap.
+func configMapSize(configMap v1.ConfigMap) int {
+	size := 0
+	for _, value := range configMap.Data {
+		size += len(value)
+	}
+	for _, value := range configMap.BinaryData {
+		size += len(value)
+	}
+	return size
+}
+
+// backupConfigMap returns the ConfigMap as stored in backups.
+func backupConfigMap(configMap v1.ConfigMap) *v1.ConfigMap {
+	backup := configMap.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// exportableConfigMap strips the server populated fields of a ConfigMap.
+func exportableConfigMap(configMap v1.ConfigMap) *v1.ConfigMap {
+	exported := configMap.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	return exported
+}
@@ -0,0 +1,328 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// customerNamespaceSelector selects the namespaces processed with --all.
+const customerNamespaceSelector = "cloud.timescale.com/is-customer-resource=true"
+
+// controller cleans up continuously. Shared informers on the metadata of pods
+// and secrets, which spares caching the data of every secret, queue the
+// namespace of a deleted pod or a new secret for reconciliation, so
+// orphans are removed shortly after their instance went away rather than at
+// the next full scan. Every namespace is still reconciled once per resync
+// period to catch up on missed events.
+type controller struct {
+	clientset kubernetes.Interface
+	opts      options
+	// namespace restricts the controller to a single namespace, otherwise
+	// all customer namespaces are watched.
+	namespace string
+	debounce  time.Duration
+	resync    time.Duration
+	queue     workqueue.RateLimitingInterface
+	factory   metadatainformer.SharedInformerFactory
+	// namespaceFactory watches the customer namespaces with --all.
+	namespaceFactory informers.SharedInformerFactory
+	namespaceLister  corelisters.NamespaceLister
+	// policyFactory watches the OrphanCleanupPolicy objects, when enabled.
+	policyFactory dynamicinformer.DynamicSharedInformerFactory
+	policyLister  cache.GenericLister
+	hasSynced     []cache.InformerSynced
+	// started is set once the informers were started, which only happens on
+	// the leader.
+	started atomic.Bool
+}
+
+// newController creates the controller. When dynamicClient is set, the
+// OrphanCleanupPolicy objects of the namespaces are applied.
+func newController(clientset kubernetes.Interface, dynamicClient dynamic.Interface, namespace string, opts options, debounce, resync time.Duration) (*controller, error) {
+	c := &controller{
+		clientset: clientset,
+		opts:      opts,
+		namespace: namespace,
+		debounce:  debounce,
+		resync:    resync,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		factory:   metadatainformer.NewFilteredSharedInformerFactory(opts.metadata, 0, namespace, nil),
+	}
+
+	podInformer := c.factory.ForResource(v1.SchemeGroupVersion.WithResource("pods")).Informer()
+	if _, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: c.enqueueObject,
+	}); err != nil {
+		return nil, err
+	}
+	secretInformer := c.factory.ForResource(v1.SchemeGroupVersion.WithResource("secrets")).Informer()
+	if _, err := secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueObject,
+	}); err != nil {
+		return nil, err
+	}
+	c.hasSynced = append(c.hasSynced, podInformer.HasSynced, secretInformer.HasSynced)
+
+	// The annotation of an opted in namespace is checked even when the
+	// controller is restricted to it
+	if namespace == "" || opts.optIn {
+		c.namespaceFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			if namespace != "" {
+				o.FieldSelector = "metadata.name=" + namespace
+			} else if !opts.optIn {
+				o.LabelSelector = customerNamespaceSelector
+			}
+		}))
+		namespaces := c.namespaceFactory.Core().V1().Namespaces()
+		c.namespaceLister = namespaces.Lister()
+		c.hasSynced = append(c.hasSynced, namespaces.Informer().HasSynced)
+	}
+
+	if dynamicClient != nil {
+		c.policyFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, namespace, nil)
+		policies := c.policyFactory.ForResource(cleanupPolicyResource)
+		if _, err := policies.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.enqueueObject,
+			UpdateFunc: func(old, new interface{}) { c.enqueueObject(new) },
+			DeleteFunc: c.enqueueObject,
+		}); err != nil {
+			return nil, err
+		}
+		c.policyLister = policies.Lister()
+		c.hasSynced = append(c.hasSynced, policies.Informer().HasSynced)
+	}
+	return c, nil
+}
+
+// enqueueObject queues the namespace of an object. Events are debounced, so a
+// rollout deleting many pods results in a single reconciliation.
+func (c *controller) enqueueObject(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	meta, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+	c.queue.AddAfter(meta.GetNamespace(), c.debounce)
+}
+
+// enqueueAll queues every watched namespace.
+func (c *controller) enqueueAll() {
+	if c.namespaceLister == nil {
+		c.queue.Add(c.namespace)
+		return
+	}
+	namespaces, err := c.namespaceLister.List(labels.Everything())
+	if err != nil {
+		logger.Error("Error listing namespaces", "error", err)
+		return
+	}
+	for _, namespace := range namespaces {
+		if c.opts.optedIn(*namespace) {
+			c.queue.Add(namespace.Name)
+		}
+	}
+}
+
+// watched reports whether the controller is responsible for a namespace.
+func (c *controller) watched(namespace string) bool {
+	if !c.opts.selectsNamespace(namespace) {
+		return false
+	}
+	if c.namespaceLister == nil {
+		return namespace == c.namespace
+	}
+	ns, err := c.namespaceLister.Get(namespace)
+	return err == nil && c.opts.optedIn(*ns)
+}
+
+// run processes the queue with the given number of workers until ctx is
+// done, and returns once the workers finished their reconciles.
+func (c *controller) run(ctx context.Context, workers int) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer c.queue.ShutDown()
+
+	c.started.Store(true)
+	c.factory.Start(ctx.Done())
+	if c.namespaceFactory != nil {
+		c.namespaceFactory.Start(ctx.Done())
+	}
+	if c.policyFactory != nil {
+		c.policyFactory.Start(ctx.Done())
+	}
+	logger.Info("Waiting for the informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.hasSynced...) {
+		return fmt.Errorf("error waiting for the informer caches to sync")
+	}
+	logger.Info("Controller started", append([]any{"workers", workers, "resync", c.resync.String()}, buildVersion.logAttrs()...)...)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.processNextItem(ctx) {
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(c.resync)
+	defer ticker.Stop()
+	c.enqueueAll()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Controller stopping")
+			return nil
+		case <-ticker.C:
+			c.enqueueAll()
+		}
+	}
+}
+
+// synced is a readiness check failing while the informer caches of a started
+// controller are not synced yet. Standby replicas do not run informers.
+func (c *controller) synced() error {
+	if !c.started.Load() {
+		return nil
+	}
+	for _, hasSynced := range c.hasSynced {
+		if !hasSynced() {
+			return fmt.Errorf("informer caches not synced")
+		}
+	}
+	return nil
+}
+
+func (c *controller) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+	// The items left in a shut down queue are not reconciled any more
+	if ctx.Err() != nil {
+		return false
+	}
+
+	namespace := key.(string)
+	if !c.watched(namespace) {
+		c.queue.Forget(key)
+		return true
+	}
+	if err := c.reconcile(ctx, namespace); err != nil {
+		logger.Error("Error cleaning up namespace, retrying", "namespace", namespace, "error", err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// policy returns the options and scope of a namespace after applying its
+// annotations and then its OrphanCleanupPolicy.
+func (c *controller) policy(ctx context.Context, namespace string) (options, cleanupScope, error) {
+	scope := fullScope()
+	var ns *v1.Namespace
+	var err error
+	if c.namespaceLister != nil {
+		ns, err = c.namespaceLister.Get(namespace)
+	} else {
+		ns, err = c.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	}
+	if err != nil {
+		return c.opts, scope, err
+	}
+	opts, err := c.opts.withProtectConfigMap(ctx, c.clientset)
+	if err != nil {
+		return c.opts, scope, err
+	}
+	// Every reconciliation sees the storage objects as they are now
+	opts.storage = &storageReferences{}
+	opts, err = namespaceOptions(opts, *ns)
+	if err != nil {
+		return c.opts, scope, invalidPolicyError{err}
+	}
+	if c.policyLister == nil {
+		return opts, scope, nil
+	}
+	objects, err := c.policyLister.ByNamespace(namespace).List(labels.Everything())
+	if err != nil {
+		return c.opts, scope, err
+	}
+	policies := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, obj := range objects {
+		if policy, ok := obj.(*unstructured.Unstructured); ok {
+			policies = append(policies, policy)
+		}
+	}
+	name, spec, err := selectPolicy(policies)
+	if err != nil {
+		return c.opts, scope, invalidPolicyError{fmt.Errorf("invalid cleanup policy %s: %v", name, err)}
+	}
+	opts, scope, err = applyPolicy(opts, spec)
+	if err != nil {
+		return c.opts, scope, invalidPolicyError{fmt.Errorf("invalid cleanup policy %s: %v", name, err)}
+	}
+	return opts, scope, nil
+}
+
+// invalidPolicyError is a policy of a namespace that cannot be applied.
+type invalidPolicyError struct {
+	err error
+}
+
+func (e invalidPolicyError) Error() string {
+	return e.err.Error()
+}
+
+// reconcile cleans up a single namespace.
+func (c *controller) reconcile(ctx context.Context, namespace string) error {
+	opts, scope, err := c.policy(ctx, namespace)
+	if _, invalid := err.(invalidPolicyError); invalid {
+		// Retrying does not help until the policy is fixed, which queues the
+		// namespace again
+		logger.Error("Skipping namespace", "namespace", namespace, "error", err)
+		return nil
+	}
+	if errors.IsNotFound(err) {
+		// The namespace was deleted since it was queued
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	prefixes, err := gatherPrefixes(ctx, c.clientset, namespace, opts)
+	if err != nil {
+		opts.namespaceDone(namespace, time.Since(start), err)
+		return err
+	}
+	if skipWithoutPrefixes(prefixes, namespace, opts) {
+		opts.namespaceDone(namespace, time.Since(start), nil)
+		return nil
+	}
+	// Cluster scoped rules are left to the runs of clean --all
+	err = cleanupNamespace(ctx, c.clientset, prefixes, namespace, opts, scope.and(opts.resources))
+	opts.namespaceDone(namespace, time.Since(start), err)
+	return err
+}
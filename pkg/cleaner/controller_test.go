@@ -0,0 +1,42 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestControllerReconcilePolicyErrors(t *testing.T) {
+	t.Run("transient errors are retried", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		clientset.PrependReactor("get", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("connection refused")
+		})
+		c := &controller{clientset: clientset, namespace: "team-a"}
+		if err := c.reconcile(context.Background(), "team-a"); err == nil {
+			t.Error("reconcile succeeded although the namespace could not be read")
+		}
+	})
+	t.Run("invalid policies are skipped", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Annotations: map[string]string{dryRunAnnotation: "maybe"},
+		}})
+		c := &controller{clientset: clientset, namespace: "team-a"}
+		if err := c.reconcile(context.Background(), "team-a"); err != nil {
+			t.Errorf("reconcile = %v, want the namespace skipped", err)
+		}
+	})
+	t.Run("deleted namespaces are skipped", func(t *testing.T) {
+		c := &controller{clientset: fake.NewSimpleClientset(), namespace: "team-a"}
+		if err := c.reconcile(context.Background(), "team-a"); err != nil {
+			t.Errorf("reconcile = %v, want the namespace skipped", err)
+		}
+	})
+}
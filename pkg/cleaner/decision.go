@@ -0,0 +1,367 @@
+package cleaner
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Actions taken on the objects the cleaner looks at.
+const (
+	actionKeep   = "keep"
+	actionDelete = "delete"
+	// actionSkip is an orphan that was not deleted because of a safety check.
+	actionSkip  = "skip"
+	actionMark  = "mark"
+	actionError = "error"
+)
+
+// orphanedReason explains why an object is deleted.
+const orphanedReason = "not associated with any relevant pods"
+
+// changedReason explains why an orphan was not deleted after all, because the
+// delete preconditions failed.
+const changedReason = "changed since it was listed"
+
+// decision records what happened to one object and why.
+type decision struct {
+	Timestamp time.Time `json:"timestamp"`
+	Namespace string    `json:"namespace"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason"`
+	DryRun    bool      `json:"dryRun,omitempty"`
+	// Created and Size describe the object for audit reports. Size is only
+	// known for the secrets considered for deletion, as secrets are listed
+	// without their data.
+	Created         time.Time `json:"created"`
+	Size            int       `json:"size"`
+	UID             string    `json:"uid,omitempty"`
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	RunID           string    `json:"runId,omitempty"`
+}
+
+// decisionRecorder receives every decision taken during a run. It must be
+// safe for concurrent use.
+type decisionRecorder interface {
+	record(d decision)
+}
+
+// record passes a decision about the object to the configured recorders.
+func (o options) record(kind string, meta metav1.ObjectMeta, size int, action, reason string) {
+	if len(o.recorders) == 0 {
+		return
+	}
+	d := decision{
+		Timestamp:       time.Now().UTC(),
+		Namespace:       meta.Namespace,
+		Kind:            kind,
+		Name:            meta.Name,
+		Action:          action,
+		Reason:          reason,
+		DryRun:          action == actionDelete && (!o.mutates()),
+		Created:         meta.CreationTimestamp.Time,
+		Size:            size,
+		UID:             string(meta.UID),
+		ResourceVersion: meta.ResourceVersion,
+		RunID:           o.runID,
+	}
+	for _, r := range o.recorders {
+		r.record(d)
+	}
+}
+
+func (o options) recordSecret(secret v1.Secret, action, reason string) {
+	o.record("Secret", secret.ObjectMeta, secretSize(secret), action, reason)
+}
+
+// secretSize returns the number of bytes of data held by the secret.
+func secretSize(secret v1.Secret) int {
+	size := 0
+	for _, value := range secret.Data {
+		size += len(value)
+	}
+	return size
+}
+
+// closeRecorders flushes and closes the recorders writing to files.
+func (o options) closeRecorders() error {
+	var firstErr error
+	for _, r := range o.recorders {
+		if closer, ok := r.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// jsonRecorder writes every decision as a JSON object on its own line.
+type jsonRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONRecorder(w io.Writer) *jsonRecorder {
+	return &jsonRecorder{enc: json.NewEncoder(w)}
+}
+
+func (r *jsonRecorder) record(d decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(d)
+}
+
+// explainRecorder prints a line per decision naming the rule that decided
+// the fate of the object, to debug why something was or wasn't deleted.
+type explainRecorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newExplainRecorder(w io.Writer) *explainRecorder {
+	return &explainRecorder{w: w}
+}
+
+func (r *explainRecorder) record(d decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dryRun := ""
+	if d.DryRun {
+		dryRun = " (dry run)"
+	}
+	fmt.Fprintf(r.w, "%-6s %s %s/%s%s: %s\n", d.Action, strings.ToLower(d.Kind), d.Namespace, d.Name, dryRun, d.Reason)
+}
+
+// csvHeader lists the columns of the CSV audit report.
+var csvHeader = []string{"namespace", "kind", "name", "age", "size", "reason", "action"}
+
+// csvRecorder writes every decision as a row of a CSV audit report.
+type csvRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+}
+
+func newCSVRecorder(path string) (*csvRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := csv.NewWriter(file)
+	if err := w.Write(csvHeader); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &csvRecorder{file: file, w: w}, nil
+}
+
+func (r *csvRecorder) record(d decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	age := d.Timestamp.Sub(d.Created).Round(time.Second)
+	r.w.Write([]string{d.Namespace, d.Kind, d.Name, age.String(), strconv.Itoa(d.Size), d.Reason, d.Action})
+}
+
+// Close flushes the report to disk.
+func (r *csvRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// decideSecret decides whether a secret is orphaned, and explains why.
+func decideSecret(secret v1.Secret, podPrefixes []string, refs *secretReferences, opts options) (bool, string) {
+	if user, ok := refs.user(secret); ok {
+		return false, "referenced by " + user
+	}
+	if manager, ok := secretManager(secret); ok {
+		return false, manager
+	}
+	if opts.deleteIf != nil {
+		return evalDeleteIf(opts.deleteIf, "--delete-if", secretVariables(secret, podPrefixes))
+	}
+	if len(podPrefixes) > 0 && !strings.Contains(secret.Name, "-certificate") {
+		return false, "not a certificate secret"
+	}
+	for _, prefix := range podPrefixes {
+		if strings.Contains(secret.Name, prefix) {
+			return false, fmt.Sprintf("matches pod prefix %s", prefix)
+		}
+	}
+	return true, orphanedReason
+}
+
+// decideService decides whether a service is orphaned, and explains why.
+func decideService(service v1.Service, podPrefixes []string, backends *serviceBackends, opts options) (bool, string) {
+	if opts.deleteServiceIf != nil {
+		return evalDeleteIf(opts.deleteServiceIf, "--delete-service-if", serviceVariables(service, podPrefixes))
+	}
+	for _, prefix := range podPrefixes {
+		if strings.Contains(service.Name, prefix) {
+			return false, fmt.Sprintf("matches pod prefix %s", prefix)
+		}
+	}
+	return selectorOrphaned(service, backends, opts.serviceGrace)
+}
+
+// evalDeleteIf decides with a user defined expression. An expression that
+// fails to evaluate keeps the object.
+func evalDeleteIf(expr *expression, flag string, vars map[string]interface{}) (bool, string) {
+	orphaned, err := expr.evalBool(vars)
+	if err != nil {
+		return false, fmt.Sprintf("error evaluating %s: %v", flag, err)
+	}
+	if !orphaned {
+		return false, fmt.Sprintf("%s is false", flag)
+	}
+	return true, orphanedReason
+}
+
+// secretVariables are the variables of --delete-if: the secret, also named
+// object, and the prefixes of the live instances.
+func secretVariables(secret v1.Secret, podPrefixes []string) map[string]interface{} {
+	object := objectVariables(secret.ObjectMeta)
+	object["type"] = string(secret.Type)
+	return map[string]interface{}{"secret": object, "object": object, "prefixes": stringList(podPrefixes)}
+}
+
+// serviceVariables are the variables of --delete-service-if.
+func serviceVariables(service v1.Service, podPrefixes []string) map[string]interface{} {
+	object := objectVariables(service.ObjectMeta)
+	object["type"] = string(service.Spec.Type)
+	object["selector"] = stringMap(service.Spec.Selector)
+	return map[string]interface{}{"service": object, "object": object, "prefixes": stringList(podPrefixes)}
+}
+
+func objectVariables(meta metav1.ObjectMeta) map[string]interface{} {
+	owners := make([]interface{}, len(meta.OwnerReferences))
+	for i, owner := range meta.OwnerReferences {
+		owners[i] = map[string]interface{}{"kind": owner.Kind, "name": owner.Name, "apiVersion": owner.APIVersion}
+	}
+	return map[string]interface{}{
+		"name":            meta.Name,
+		"namespace":       meta.Namespace,
+		"labels":          stringMap(meta.Labels),
+		"annotations":     stringMap(meta.Annotations),
+		"created":         meta.CreationTimestamp.Time,
+		"age":             time.Since(meta.CreationTimestamp.Time),
+		"ownerReferences": owners,
+	}
+}
+
+func stringList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, value := range values {
+		list[i] = value
+	}
+	return list
+}
+
+func stringMap(values map[string]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		m[key] = value
+	}
+	return m
+}
+
+// Outcomes of a deletion attempt in the audit log.
+const (
+	outcomeDeleted  = "deleted"
+	outcomeDryRun   = "dry-run"
+	outcomeConflict = "conflict"
+	outcomeFailed   = "failed"
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Timestamp       time.Time `json:"timestamp"`
+	RunID           string    `json:"runId"`
+	Namespace       string    `json:"namespace"`
+	Kind            string    `json:"kind"`
+	Name            string    `json:"name"`
+	UID             string    `json:"uid"`
+	ResourceVersion string    `json:"resourceVersion"`
+	Reason          string    `json:"reason"`
+	DryRun          bool      `json:"dryRun"`
+	Outcome         string    `json:"outcome"`
+	// Version is the version of the cleaner that made the attempt.
+	Version string `json:"version"`
+}
+
+// auditRecorder appends a JSON line per deletion attempt to the audit log.
+// Existing entries are never rewritten.
+type auditRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newAuditRecorder(path string) (*auditRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditRecorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *auditRecorder) record(d decision) {
+	var outcome string
+	switch {
+	case d.Action == actionDelete && d.DryRun:
+		outcome = outcomeDryRun
+	case d.Action == actionDelete:
+		outcome = outcomeDeleted
+	case d.Action == actionSkip && d.Reason == changedReason:
+		outcome = outcomeConflict
+	case d.Action == actionError:
+		outcome = outcomeFailed
+	default:
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(auditEntry{
+		Timestamp:       d.Timestamp,
+		RunID:           d.RunID,
+		Namespace:       d.Namespace,
+		Kind:            d.Kind,
+		Name:            d.Name,
+		UID:             d.UID,
+		ResourceVersion: d.ResourceVersion,
+		Reason:          d.Reason,
+		DryRun:          d.DryRun,
+		Outcome:         outcome,
+		Version:         buildVersion.Version,
+	}); err != nil {
+		logger.Error("Error writing audit log", "error", err)
+	}
+}
+
+// Close syncs the audit log to disk.
+func (r *auditRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.file.Sync(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,226 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EndpointSlices and Endpoints are normally deleted with their service and
+// kept up to date by the control plane. Those left behind by a failed garbage
+// collection, a mirroring controller or a hand written manifest keep feeding
+// DNS and kube-proxy with addresses of pods that are gone. They are derived
+// state, so they are not backed up and the report does not count them.
+
+// leaderAnnotation marks the Endpoints used as leader election locks by older
+// controllers. They never belong to a service.
+const leaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+// podTarget is a pod referenced by an endpoint.
+type podTarget struct {
+	name string
+	uid  types.UID
+}
+
+// stalePods decides whether all the targets of an endpoints object are pods
+// that are gone. A pod recreated under the same name is a different pod. It
+// returns false, with the first target still around, if any.
+func stalePods(targets []podTarget, pods map[string]types.UID) (string, bool) {
+	for _, target := range targets {
+		if uid, ok := pods[target.name]; ok && (target.uid == "" || target.uid == uid) {
+			return target.name, false
+		}
+	}
+	return "", true
+}
+
+// lastChanged returns when the control plane last updated the endpoints of an
+// object, falling back to its creation.
+func lastChanged(meta metav1.ObjectMeta) time.Time {
+	if changed, err := time.Parse(time.RFC3339, meta.Annotations[v1.EndpointsLastChangeTriggerTime]); err == nil {
+		return changed
+	}
+	return meta.CreationTimestamp.Time
+}
+
+// decideEndpoints decides whether an EndpointSlice or Endpoints object of a
+// service is stale: either its service is gone, or all its endpoints have
+// pointed to pods that are gone for --service-grace. Endpoints not pointing to
+// pods are managed by someone else and are kept.
+func decideEndpoints(meta metav1.ObjectMeta, service string, targets []podTarget, endpoints int, services map[string]bool, pods map[string]types.UID, opts options) (bool, string) {
+	if service == "" {
+		return false, "not part of a service"
+	}
+	if !services[service] {
+		return true, fmt.Sprintf("left behind by the deleted service/%s", service)
+	}
+	if endpoints == 0 || len(targets) < endpoints {
+		return false, "has endpoints that are not pods"
+	}
+	if pod, stale := stalePods(targets, pods); !stale {
+		return false, "has endpoints of pod/" + pod
+	}
+	if time.Since(lastChanged(meta)) < opts.serviceGrace {
+		return false, fmt.Sprintf("points to pods that are gone for less than %s", opts.serviceGrace)
+	}
+	return true, "pointing only to pods that are gone"
+}
+
+// sliceTargets returns the pods targeted by the endpoints of a slice.
+func sliceTargets(slice discoveryv1.EndpointSlice) []podTarget {
+	var targets []podTarget
+	for _, endpoint := range slice.Endpoints {
+		if ref := endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+			targets = append(targets, podTarget{name: ref.Name, uid: ref.UID})
+		}
+	}
+	return targets
+}
+
+// endpointsTargets returns the pods targeted by the addresses of an Endpoints
+// object, and the number of addresses.
+func endpointsTargets(endpoints v1.Endpoints) ([]podTarget, int) {
+	var targets []podTarget
+	count := 0
+	for _, subset := range endpoints.Subsets {
+		addresses := append(append([]v1.EndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...)
+		for _, address := range addresses {
+			count++
+			if ref := address.TargetRef; ref != nil && ref.Kind == "Pod" {
+				targets = append(targets, podTarget{name: ref.Name, uid: ref.UID})
+			}
+		}
+	}
+	return targets, count
+}
+
+// endpointsCleaner cleans up the stale EndpointSlices and Endpoints of a
+// namespace. It runs after the services, so that the endpoints of the
+// services just deleted go with them. They are neither backed up nor
+// counted by the report.
+type endpointsCleaner struct {
+	clientset kubernetes.Interface
+	namespace string
+	opts      options
+	services  map[string]bool
+	pods      map[string]types.UID
+}
+
+func newEndpointsCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &endpointsCleaner{clientset: clientset, namespace: namespace, opts: opts}
+}
+
+func (c *endpointsCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	serviceList, err := listServices(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing services: %v", err)
+	}
+	c.services = map[string]bool{}
+	for _, service := range serviceList {
+		c.services[service.Name] = true
+	}
+	podList, err := listPods(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing pods: %v", err)
+	}
+	c.pods = map[string]types.UID{}
+	for _, pod := range podList {
+		c.pods[pod.Name] = pod.UID
+	}
+	slices, err := listEndpointSlices(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing endpointslices: %v", err)
+	}
+	endpointsList, err := c.clientset.CoreV1().Endpoints(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing endpoints: %v", err)
+	}
+
+	objects := make([]CleanupObject, 0, len(slices)+len(endpointsList.Items))
+	for _, slice := range slices {
+		slice := slice
+		objects = append(objects, CleanupObject{
+			Kind:   "EndpointSlice",
+			Meta:   slice.ObjectMeta,
+			Object: slice,
+			Export: func() interface{} { return exportableEndpointSlice(slice) },
+		})
+	}
+	for _, endpoints := range endpointsList.Items {
+		endpoints := endpoints
+		objects = append(objects, CleanupObject{
+			Kind:   "Endpoints",
+			Meta:   endpoints.ObjectMeta,
+			Object: endpoints,
+			Export: func() interface{} { return exportableEndpoints(endpoints) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *endpointsCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	var shouldDelete bool
+	var reason string
+	switch object := obj.Object.(type) {
+	case discoveryv1.EndpointSlice:
+		shouldDelete, reason = decideEndpoints(object.ObjectMeta, object.Labels[discoveryv1.LabelServiceName], sliceTargets(object), len(object.Endpoints), c.services, c.pods, c.opts)
+	case v1.Endpoints:
+		service := object.Name
+		if _, ok := object.Annotations[leaderAnnotation]; ok {
+			service = ""
+		}
+		targets, count := endpointsTargets(object)
+		shouldDelete, reason = decideEndpoints(object.ObjectMeta, service, targets, count, c.services, c.pods, c.opts)
+	}
+	return shouldDelete, reason, nil
+}
+
+// DecidesOwned is true as the EndpointSlices are owned by their service,
+// gone or not.
+func (c *endpointsCleaner) DecidesOwned() bool {
+	return true
+}
+
+func (c *endpointsCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	var err error
+	if obj.Kind == "EndpointSlice" {
+		err = c.clientset.DiscoveryV1().EndpointSlices(c.namespace).Delete(ctx, obj.Meta.Name, options)
+	} else {
+		err = c.clientset.CoreV1().Endpoints(c.namespace).Delete(ctx, obj.Meta.Name, options)
+	}
+	if errors.IsNotFound(err) {
+		// Deleted by the garbage collector along with its service
+		return nil
+	}
+	return err
+}
+
+// exportableEndpointSlice strips the server populated fields of a slice.
+func exportableEndpointSlice(slice discoveryv1.EndpointSlice) *discoveryv1.EndpointSlice {
+	exported := slice.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "discovery.k8s.io/v1", Kind: "EndpointSlice"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	return exported
+}
+
+// exportableEndpoints strips the server populated fields of an Endpoints
+// object.
+func exportableEndpoints(endpoints v1.Endpoints) *v1.Endpoints {
+	exported := endpoints.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Endpoints"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	return exported
+}
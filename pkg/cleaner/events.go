@@ -0,0 +1,48 @@
+package cleaner
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// eventComponent is the source of the events emitted by the cleaner.
+const eventComponent = "orphaned-secrets-deleter"
+
+// emitEvent creates an event in the namespace of the object, so deletions
+// show up in kubectl get events and in the cluster event pipeline. Failing to
+// emit an event never fails the run.
+func emitEvent(ctx context.Context, clientset kubernetes.Interface, opts options, kind string, meta metav1.ObjectMeta, eventType, reason, message string) {
+	if !opts.events {
+		return
+	}
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: meta.Name + ".",
+			Namespace:    meta.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            kind,
+			Namespace:       meta.Namespace,
+			Name:            meta.Name,
+			UID:             meta.UID,
+			ResourceVersion: meta.ResourceVersion,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              v1.EventSource{Component: eventComponent},
+		ReportingController: eventComponent,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+	}
+	if _, err := clientset.CoreV1().Events(meta.Namespace).Create(ctx, event, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		logger.Warn("Error emitting event", "namespace", meta.Namespace, "resource", kind+"/"+meta.Name, "reason", reason, "error", err)
+	}
+}
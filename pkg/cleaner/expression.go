@@ -0,0 +1,110 @@
+package cleaner
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// expression is a compiled rule written in the Common Expression Language
+// (CEL), with the string extensions (lowerAscii, upperAscii, replace, split,
+// ...) on top of the standard definitions.
+type expression struct {
+	source  string
+	ast     *cel.Ast
+	program cel.Program
+}
+
+// compileExpression parses and type-checks a CEL expression, which must
+// result in a bool. It sees object, the object decided on, and prefixes, the
+// prefixes of the live instances, plus the aliases of object given, such as
+// secret for --delete-if.
+func compileExpression(source string, aliases ...string) (*expression, error) {
+	vars := []cel.EnvOption{
+		ext.Strings(),
+		cel.CrossTypeNumericComparisons(true),
+		cel.Variable("object", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("prefixes", cel.ListType(cel.StringType)),
+	}
+	for _, alias := range aliases {
+		vars = append(vars, cel.Variable(alias, cel.MapType(cel.StringType, cel.DynType)))
+	}
+	env, err := cel.NewEnv(vars...)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if t := ast.OutputType(); !t.IsAssignableType(cel.BoolType) {
+		return nil, fmt.Errorf("expression result is a %s, not a bool", t)
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &expression{source: source, ast: ast, program: program}, nil
+}
+
+// evalBool evaluates the expression with the given variables, and requires it
+// to result in a bool.
+func (e *expression) evalBool(vars map[string]interface{}) (bool, error) {
+	out, _, err := e.program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression result is a %s, not a bool", out.Type().TypeName())
+	}
+	return b, nil
+}
+
+// references reports whether the expression may access a field of the given
+// name on any object: as a member, through an index or in a has() test. Any
+// string literal equal to the name counts, so fields looked up indirectly are
+// not missed.
+func (e *expression) references(field string) bool {
+	found := false
+	var walk func(*exprpb.Expr)
+	walk = func(expr *exprpb.Expr) {
+		if expr == nil || found {
+			return
+		}
+		switch kind := expr.ExprKind.(type) {
+		case *exprpb.Expr_ConstExpr:
+			found = kind.ConstExpr.GetStringValue() == field
+		case *exprpb.Expr_SelectExpr:
+			found = kind.SelectExpr.Field == field
+			walk(kind.SelectExpr.Operand)
+		case *exprpb.Expr_CallExpr:
+			walk(kind.CallExpr.Target)
+			for _, arg := range kind.CallExpr.Args {
+				walk(arg)
+			}
+		case *exprpb.Expr_ListExpr:
+			for _, elem := range kind.ListExpr.Elements {
+				walk(elem)
+			}
+		case *exprpb.Expr_StructExpr:
+			for _, entry := range kind.StructExpr.Entries {
+				walk(entry.GetMapKey())
+				walk(entry.Value)
+			}
+		case *exprpb.Expr_ComprehensionExpr:
+			c := kind.ComprehensionExpr
+			for _, sub := range []*exprpb.Expr{c.IterRange, c.AccuInit, c.LoopCondition, c.LoopStep, c.Result} {
+				walk(sub)
+			}
+		}
+	}
+	walk(e.ast.Expr())
+	return found
+}
+
+func (e *expression) String() string {
+	return e.source
+}
@@ -0,0 +1,114 @@
+package cleaner
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExpressionEvalBool(t *testing.T) {
+	secret := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "abcdefghij-certificate",
+			Namespace:         "team-a",
+			Labels:            map[string]string{"app": "db"},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-48 * time.Hour)),
+		},
+		Type: v1.SecretTypeTLS,
+	}
+	vars := secretVariables(secret, []string{"klmnopqrst"})
+
+	tests := []struct {
+		name    string
+		source  string
+		want    bool
+		wantErr bool
+	}{
+		{name: "member", source: `secret.name.endsWith("-certificate")`, want: true},
+		{name: "alias of object", source: `object.namespace == secret.namespace`, want: true},
+		{name: "and binds tighter than or", source: `true || false && false`, want: true},
+		{name: "parentheses", source: `(true || false) && false`, want: false},
+		{name: "arithmetic before comparison", source: `1 + 2 * 3 == 7`, want: true},
+		{name: "negation", source: `!(secret.type == "kubernetes.io/tls")`, want: false},
+		{name: "conditional", source: `secret.labels.app == "db" ? true : false`, want: true},
+		{name: "macro", source: `!prefixes.exists(p, secret.name.contains(p))`, want: true},
+		{name: "duration", source: `secret.age > duration("24h")`, want: true},
+		{name: "timestamp", source: `secret.created < timestamp("2000-01-01T00:00:00Z")`, want: false},
+		{name: "string extension", source: `secret.name.upperAscii().startsWith("ABC")`, want: true},
+		{name: "has on a missing label", source: `has(secret.labels.team)`, want: false},
+		{name: "missing label", source: `secret.labels.team == "a"`, wantErr: true},
+		{name: "and short-circuits", source: `false && secret.labels.team == "a"`, want: false},
+		{name: "or short-circuits", source: `true || secret.labels.team == "a"`, want: true},
+		{name: "values of different types are unequal", source: `secret.name == 1`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := compileExpression(tt.source, "secret")
+			if err != nil {
+				t.Fatalf("compileExpression(%q) = %v", tt.source, err)
+			}
+			got, err := expr.evalBool(vars)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("evalBool(%q) = %v, want an error", tt.source, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("evalBool(%q) = %v", tt.source, err)
+			}
+			if got != tt.want {
+				t.Errorf("evalBool(%q) = %v, want %v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	for _, source := range []string{
+		`size(secret.name)`,
+		`1 + `,
+		`"a" + 1 == "a1"`,
+		`service.name == "a"`,
+		`prefixes.size()`,
+	} {
+		if _, err := compileExpression(source, "secret"); err == nil {
+			t.Errorf("compileExpression(%q) succeeded, want an error", source)
+		}
+	}
+}
+
+func TestExpressionReferences(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{source: `secret.type == "Opaque"`, want: true},
+		{source: `secret["type"] == "Opaque"`, want: true},
+		{source: `has(secret.type)`, want: true},
+		{source: `prefixes.all(p, secret[p] != "type")`, want: true},
+		{source: `secret.name.startsWith("a")`, want: false},
+	}
+	for _, tt := range tests {
+		expr, err := compileExpression(tt.source, "secret")
+		if err != nil {
+			t.Fatalf("compileExpression(%q) = %v", tt.source, err)
+		}
+		if got := expr.references("type"); got != tt.want {
+			t.Errorf("references(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestEvalDeleteIfKeepsOnError(t *testing.T) {
+	expr, err := compileExpression(`secret.labels.team == "a"`, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphaned, _ := evalDeleteIf(expr, "--delete-if", secretVariables(v1.Secret{}, nil))
+	if orphaned {
+		t.Error("an expression failing to evaluate deleted the secret")
+	}
+}
@@ -0,0 +1,135 @@
+package cleaner
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Formats of the --fleet-report.
+const (
+	fleetReportJSON = "json"
+	fleetReportCSV  = "csv"
+)
+
+// fleetReport is the outcome of a run over several clusters.
+type fleetReport struct {
+	Clusters []clusterReport `json:"clusters"`
+	// Totals add up the totals of the clusters, except for the duration
+	// which is the one of the whole run.
+	Totals summaryTotals `json:"totals"`
+	Failed int           `json:"failed"`
+}
+
+// clusterReport is the outcome of a cluster. A cluster that failed before
+// processing any namespace has no totals but its error.
+type clusterReport struct {
+	Name string `json:"name"`
+	summaryTotals
+	Error string `json:"error,omitempty"`
+}
+
+func validateFleetReportFormat(format string) error {
+	switch format {
+	case fleetReportJSON, fleetReportCSV:
+		return nil
+	}
+	return fmt.Errorf("must be %s or %s", fleetReportJSON, fleetReportCSV)
+}
+
+// newFleetReport builds the report from the summaries and errors of the
+// clusters, in the order of the clusters.
+func newFleetReport(clusters []clusterTarget, summaries []*runSummary, errs []error, start time.Time) fleetReport {
+	report := fleetReport{Clusters: make([]clusterReport, 0, len(clusters))}
+	for i, cluster := range clusters {
+		r := clusterReport{Name: cluster.name}
+		if summaries[i] != nil {
+			r.summaryTotals = summaries[i].snapshot()
+		}
+		if errs[i] != nil {
+			r.Error = errs[i].Error()
+			report.Failed++
+		}
+		report.Totals.add(r.summaryTotals)
+		report.Clusters = append(report.Clusters, r)
+	}
+	report.Totals.Duration = time.Since(start).Round(time.Second).String()
+	return report
+}
+
+// add adds the counts of other to the totals.
+func (t *summaryTotals) add(other summaryTotals) {
+	t.Namespaces += other.Namespaces
+	t.SecretsDeleted += other.SecretsDeleted
+	t.ServicesDeleted += other.ServicesDeleted
+	t.ConfigMapsDeleted += other.ConfigMapsDeleted
+	t.PVCsDeleted += other.PVCsDeleted
+	t.ServiceAccountsDeleted += other.ServiceAccountsDeleted
+	t.NetworkPoliciesDeleted += other.NetworkPoliciesDeleted
+	t.JobsDeleted += other.JobsDeleted
+	t.HPAsDeleted += other.HPAsDeleted
+	t.Skipped += other.Skipped
+	t.Errors += other.Errors
+	t.Unprocessed += other.Unprocessed
+}
+
+// writeFile writes the report to path in the format.
+func (r fleetReport) writeFile(path, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if format == fleetReportCSV {
+		err = r.writeCSV(f)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var fleetCSVHeader = []string{"cluster", "namespaces", "secrets_deleted", "services_deleted", "configmaps_deleted", "pvcs_deleted", "serviceaccounts_deleted", "networkpolicies_deleted", "jobs_deleted", "hpas_deleted", "skipped", "errors", "unprocessed", "duration", "error"}
+
+// writeCSV writes a row per cluster followed by a row of the totals, whose
+// cluster column is empty.
+func (r fleetReport) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write(fleetCSVHeader)
+	row := func(name string, t summaryTotals, err string) {
+		w.Write([]string{name,
+			strconv.Itoa(t.Namespaces),
+			strconv.Itoa(t.SecretsDeleted),
+			strconv.Itoa(t.ServicesDeleted),
+			strconv.Itoa(t.ConfigMapsDeleted),
+			strconv.Itoa(t.PVCsDeleted),
+			strconv.Itoa(t.ServiceAccountsDeleted),
+			strconv.Itoa(t.NetworkPoliciesDeleted),
+			strconv.Itoa(t.JobsDeleted),
+			strconv.Itoa(t.HPAsDeleted),
+			strconv.Itoa(t.Skipped),
+			strconv.Itoa(t.Errors),
+			strconv.Itoa(t.Unprocessed),
+			t.Duration,
+			err,
+		})
+	}
+	for _, cluster := range r.Clusters {
+		row(cluster.Name, cluster.summaryTotals, cluster.Error)
+	}
+	failed := ""
+	if r.Failed > 0 {
+		failed = fmt.Sprintf("%d of %d clusters failed", r.Failed, len(r.Clusters))
+	}
+	row("", r.Totals, failed)
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,141 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// gatewayGroup is the API group of the Gateway API.
+const gatewayGroup = "gateway.networking.k8s.io"
+
+// Versions of the Gateway API resources, preferred first. Clusters that
+// installed an older release of the CRDs only serve v1beta1.
+var (
+	gatewayResources = []schema.GroupVersionResource{
+		{Group: gatewayGroup, Version: "v1", Resource: "gateways"},
+		{Group: gatewayGroup, Version: "v1beta1", Resource: "gateways"},
+	}
+	referenceGrantResources = []schema.GroupVersionResource{
+		{Group: gatewayGroup, Version: "v1beta1", Resource: "referencegrants"},
+		{Group: gatewayGroup, Version: "v1alpha2", Resource: "referencegrants"},
+	}
+)
+
+// listOptional lists a custom resource in the first of its versions served by
+// the cluster. It returns nothing if the CRD is not installed.
+func listOptional(ctx context.Context, client dynamic.Interface, versions []schema.GroupVersionResource, namespace string) ([]unstructured.Unstructured, error) {
+	for _, resource := range versions {
+		var items []unstructured.Unstructured
+		err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+			page, err := client.Resource(resource).Namespace(namespace).List(ctx, options)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, page.Items...)
+			return page.GetContinue(), nil
+		})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		return items, err
+	}
+	return nil, nil
+}
+
+// addGatewayReferences records the secrets referenced by the certificateRefs
+// of Gateway listeners. Gateways of other namespaces may only reference the
+// secrets of the namespace that a ReferenceGrant allows them to, so only
+// these namespaces are looked at besides the namespace itself.
+func addGatewayReferences(ctx context.Context, client dynamic.Interface, refs *secretReferences, namespace string) error {
+	grants, err := listOptional(ctx, client, referenceGrantResources, namespace)
+	if err != nil {
+		return fmt.Errorf("error listing referencegrants: %v", err)
+	}
+	namespaces := []string{namespace}
+	for _, grant := range grants {
+		namespaces = append(namespaces, grantedGatewayNamespaces(grant)...)
+	}
+
+	seen := map[string]bool{}
+	for _, gatewayNamespace := range namespaces {
+		if seen[gatewayNamespace] {
+			continue
+		}
+		seen[gatewayNamespace] = true
+		gateways, err := listOptional(ctx, client, gatewayResources, gatewayNamespace)
+		if err != nil {
+			return fmt.Errorf("error listing gateways: %v", err)
+		}
+		for _, gateway := range gateways {
+			addListenerReferences(refs, gateway, namespace)
+		}
+	}
+	return nil
+}
+
+// grantedGatewayNamespaces returns the namespaces whose Gateways a
+// ReferenceGrant allows to reference secrets.
+func grantedGatewayNamespaces(grant unstructured.Unstructured) []string {
+	to, _, _ := unstructured.NestedSlice(grant.Object, "spec", "to")
+	grantsSecrets := false
+	for _, target := range to {
+		target, _ := target.(map[string]interface{})
+		if target["group"] == "" && target["kind"] == "Secret" {
+			grantsSecrets = true
+		}
+	}
+	if !grantsSecrets {
+		return nil
+	}
+	var namespaces []string
+	from, _, _ := unstructured.NestedSlice(grant.Object, "spec", "from")
+	for _, source := range from {
+		source, _ := source.(map[string]interface{})
+		if source["group"] == gatewayGroup && source["kind"] == "Gateway" {
+			if ns, ok := source["namespace"].(string); ok {
+				namespaces = append(namespaces, ns)
+			}
+		}
+	}
+	return namespaces
+}
+
+// addListenerReferences records the secrets of namespace referenced by the
+// TLS listeners of a Gateway.
+func addListenerReferences(refs *secretReferences, gateway unstructured.Unstructured, namespace string) {
+	listeners, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	for _, listener := range listeners {
+		listener, _ := listener.(map[string]interface{})
+		certificateRefs, _, _ := unstructured.NestedSlice(listener, "tls", "certificateRefs")
+		for _, ref := range certificateRefs {
+			ref, _ := ref.(map[string]interface{})
+			// The group and kind default to core Secrets
+			if group, _ := ref["group"].(string); group != "" {
+				continue
+			}
+			if kind, _ := ref["kind"].(string); kind != "" && kind != "Secret" {
+				continue
+			}
+			refNamespace, _ := ref["namespace"].(string)
+			if refNamespace == "" {
+				refNamespace = gateway.GetNamespace()
+			}
+			if refNamespace != namespace {
+				continue
+			}
+			name, _ := ref["name"].(string)
+			listenerName, _ := listener["name"].(string)
+			user := fmt.Sprintf("gateway/%s listener %s", gateway.GetName(), listenerName)
+			if gateway.GetNamespace() != namespace {
+				user = fmt.Sprintf("gateway/%s/%s listener %s", gateway.GetNamespace(), gateway.GetName(), listenerName)
+			}
+			refs.add(name, user)
+		}
+	}
+}
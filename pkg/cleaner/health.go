@@ -0,0 +1,77 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// healthServer serves the liveness and readiness probes of the long running
+// modes. /healthz succeeds as long as the process serves requests, /readyz
+// only when all readiness checks pass.
+type healthServer struct {
+	mu     sync.Mutex
+	checks map[string]func() error
+}
+
+func newHealthServer() *healthServer {
+	return &healthServer{checks: map[string]func() error{}}
+}
+
+// addReadyCheck registers a readiness check. It should return quickly.
+func (h *healthServer) addReadyCheck(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+func (h *healthServer) ready() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var failures []string
+	for name, check := range h.checks {
+		if err := check(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	sort.Strings(failures)
+	return failures
+}
+
+// serve starts serving the probes on addr.
+func (h *healthServer) serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if failures := h.ready(); len(failures) > 0 {
+			http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	go serve(listener, mux, "health")
+	return nil
+}
+
+// apiServerCheck returns a readiness check verifying that the API server is
+// reachable.
+func apiServerCheck(clientset kubernetes.Interface) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return clientset.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+	}
+}
@@ -0,0 +1,89 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// serviceAccountNamespaceFile holds the namespace of the pod when running
+// in-cluster.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// ownNamespace returns the namespace the tool runs in, or default when it runs
+// outside of the cluster.
+func ownNamespace() string {
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// historyEntry is the compact record of a run kept in the history ConfigMap.
+type historyEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	summaryTotals
+	Error string `json:"error,omitempty"`
+}
+
+// historyConfigMap keeps the last runs in a ConfigMap, keyed by run ID.
+type historyConfigMap struct {
+	namespace string
+	name      string
+	limit     int
+}
+
+// add records a run and drops the oldest entries beyond the limit. The run
+// IDs are timestamps, so they sort chronologically.
+func (h historyConfigMap) add(ctx context.Context, clientset kubernetes.Interface, runID string, totals summaryTotals, runErr error) error {
+	entry := historyEntry{Timestamp: time.Now().UTC(), summaryTotals: totals}
+	if runErr != nil {
+		entry.Error = runErr.Error()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	configMaps := clientset.CoreV1().ConfigMaps(h.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, h.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: h.name, Namespace: h.namespace},
+				Data:       map[string]string{runID: string(data)},
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{FieldManager: fieldManager})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[runID] = string(data)
+		runs := make([]string, 0, len(configMap.Data))
+		for run := range configMap.Data {
+			runs = append(runs, run)
+		}
+		sort.Strings(runs)
+		for len(runs) > h.limit {
+			delete(configMap.Data, runs[0])
+			runs = runs[1:]
+		}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{FieldManager: fieldManager})
+		return err
+	})
+}
@@ -0,0 +1,120 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// scaleTargetExists reports whether the workload scaled by an HPA exists.
+// Only the built-in workloads are looked up; the HPAs of other kinds, such
+// as custom resources with a scale subresource, are never considered
+// orphaned.
+func scaleTargetExists(ctx context.Context, clientset kubernetes.Interface, namespace string, target autoscalingv2.CrossVersionObjectReference, opts options) (bool, error) {
+	group := target.APIVersion
+	if i := strings.Index(group, "/"); i >= 0 {
+		group = group[:i]
+	} else {
+		group = ""
+	}
+	var err error
+	switch {
+	case group == "apps" && target.Kind == "Deployment":
+		_, err = clientset.AppsV1().Deployments(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	case group == "apps" && target.Kind == "StatefulSet":
+		_, err = clientset.AppsV1().StatefulSets(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	case group == "apps" && target.Kind == "ReplicaSet":
+		_, err = clientset.AppsV1().ReplicaSets(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	case group == "" && target.Kind == "ReplicationController":
+		_, err = clientset.CoreV1().ReplicationControllers(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	default:
+		return true, nil
+	}
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// decideHPA decides whether a HorizontalPodAutoscaler is orphaned, and
+// explains why: it is once the workload it scales is gone.
+func decideHPA(ctx context.Context, clientset kubernetes.Interface, hpa autoscalingv2.HorizontalPodAutoscaler, opts options) (bool, string, error) {
+	target := hpa.Spec.ScaleTargetRef
+	exists, err := scaleTargetExists(ctx, clientset, hpa.Namespace, target, opts)
+	if err != nil {
+		return false, "", fmt.Errorf("error getting %s %s: %v", strings.ToLower(target.Kind), target.Name, err)
+	}
+	if exists {
+		return false, fmt.Sprintf("scales %s/%s", strings.ToLower(target.Kind), target.Name), nil
+	}
+	return true, fmt.Sprintf("scaling the deleted %s/%s", strings.ToLower(target.Kind), target.Name), nil
+}
+
+// hpaCleaner cleans up the HorizontalPodAutoscalers of a namespace whose
+// workload is gone.
+type hpaCleaner struct {
+	clientset kubernetes.Interface
+	namespace string
+	opts      options
+}
+
+func newHPACleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &hpaCleaner{clientset: clientset, namespace: namespace, opts: opts}
+}
+
+func (c *hpaCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	hpas, err := c.clientset.AutoscalingV2().HorizontalPodAutoscalers(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing horizontalpodautoscalers: %v", err)
+	}
+	objects := make([]CleanupObject, 0, len(hpas.Items))
+	for _, hpa := range hpas.Items {
+		hpa := hpa
+		objects = append(objects, CleanupObject{
+			Kind:   "HorizontalPodAutoscaler",
+			Meta:   hpa.ObjectMeta,
+			Object: hpa,
+			Export: func() interface{} { return exportableHPA(hpa) },
+			Backup: func() interface{} { return backupHPA(hpa) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *hpaCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	return decideHPA(ctx, c.clientset, obj.Object.(autoscalingv2.HorizontalPodAutoscaler), c.opts)
+}
+
+func (c *hpaCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	return c.clientset.AutoscalingV2().HorizontalPodAutoscalers(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *hpaCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "HPA", reason, err)
+}
+
+// backupHPA returns the HorizontalPodAutoscaler as stored in backups.
+func backupHPA(hpa autoscalingv2.HorizontalPodAutoscaler) *autoscalingv2.HorizontalPodAutoscaler {
+	backup := hpa.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// exportableHPA strips the server populated fields of a
+// HorizontalPodAutoscaler.
+func exportableHPA(hpa autoscalingv2.HorizontalPodAutoscaler) *autoscalingv2.HorizontalPodAutoscaler {
+	exported := hpa.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	exported.Status = autoscalingv2.HorizontalPodAutoscalerStatus{}
+	return exported
+}
@@ -0,0 +1,78 @@
+package cleaner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreRule is a line of an ignore file.
+type ignoreRule struct {
+	pattern string
+	// negate re-includes the objects excluded by an earlier rule.
+	negate bool
+}
+
+// match matches the pattern against the object name, or against
+// namespace/name when the pattern contains a slash.
+func (r ignoreRule) match(namespace, name string) bool {
+	if strings.Contains(r.pattern, "/") {
+		name = namespace + "/" + name
+	}
+	matched, _ := path.Match(r.pattern, name)
+	return matched
+}
+
+// ignoreList excludes secrets and services from the cleanup with the rules of
+// a .gitignore style file: one glob per line, "!" negates a pattern, "#"
+// starts a comment, and the last matching rule wins.
+type ignoreList struct {
+	path  string
+	rules []ignoreRule
+}
+
+func loadIgnoreFile(filename string) (*ignoreList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := &ignoreList{path: filename}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			// A literal leading ! or #
+			line = line[1:]
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q: %v", n, line, err)
+		}
+		rule.pattern = line
+		list.rules = append(list.rules, rule)
+	}
+	return list, scanner.Err()
+}
+
+// ignored reports whether the object is excluded, and by which pattern.
+func (l *ignoreList) ignored(namespace, name string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	pattern, ignored := "", false
+	for _, rule := range l.rules {
+		if rule.match(namespace, name) {
+			pattern, ignored = rule.pattern, !rule.negate
+		}
+	}
+	return pattern, ignored
+}
@@ -0,0 +1,79 @@
+package cleaner
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// clustersFile is the content of a --clusters-file, listing the clusters to
+// clean up in one run:
+//
+//	clusters:
+//	- name: eu-west-1
+//	  kubeconfig: /etc/clusters/eu-west-1.yaml
+//	- name: us-east-1
+//	  kubeconfig: /etc/clusters/fleet.yaml
+//	  context: admin@us-east-1
+//	  overrides:
+//	    minAge: 72h
+//	    protect: ["legacy-*"]
+//	    dryRun: true
+type clustersFile struct {
+	Clusters []clusterSpec `json:"clusters"`
+}
+
+// clusterSpec is a cluster of a clusters file. The kubeconfig defaults to
+// --kubeconfig and the context to the current context of the kubeconfig.
+type clusterSpec struct {
+	// Name names the cluster in logs, summaries and file names, the context
+	// by default.
+	Name       string `json:"name,omitempty"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	// Overrides adjust the flags for this cluster, the way an
+	// OrphanCleanupPolicy does for a namespace, except that resources
+	// replaces --resources.
+	Overrides *cleanupPolicySpec `json:"overrides,omitempty"`
+}
+
+func loadClustersFile(path string) ([]clusterTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file clustersFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Clusters) == 0 {
+		return nil, fmt.Errorf("no clusters")
+	}
+	names := map[string]bool{}
+	targets := make([]clusterTarget, 0, len(file.Clusters))
+	for i, spec := range file.Clusters {
+		if spec.Name == "" {
+			spec.Name = spec.Context
+		}
+		if spec.Name == "" {
+			return nil, fmt.Errorf("cluster %d has neither a name nor a context", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate cluster %s", spec.Name)
+		}
+		names[spec.Name] = true
+		if spec.Overrides != nil {
+			if _, _, err := applyPolicy(options{}, *spec.Overrides); err != nil {
+				return nil, fmt.Errorf("cluster %s: %v", spec.Name, err)
+			}
+		}
+		targets = append(targets, clusterTarget{
+			name:       spec.Name,
+			kubeconfig: spec.Kubeconfig,
+			context:    spec.Context,
+			overrides:  spec.Overrides,
+		})
+	}
+	return targets, nil
+}
@@ -0,0 +1,117 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Finished Jobs without ttlSecondsAfterFinished stay forever, along with
+// their pods. They are not backed up, as restoring a Job would run it again.
+
+// jobFinished returns when a Job completed or failed, if it did.
+func jobFinished(job batchv1.Job) (time.Time, string, bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != v1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			if job.Status.CompletionTime != nil {
+				return job.Status.CompletionTime.Time, "completed", true
+			}
+			return condition.LastTransitionTime.Time, "completed", true
+		case batchv1.JobFailed:
+			return condition.LastTransitionTime.Time, "failed", true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// decideJob decides whether a Job is to be deleted, and explains why. Jobs
+// are deleted once they finished more than --job-max-age ago, unless the TTL
+// controller or their CronJob already takes care of them.
+func decideJob(job batchv1.Job, opts options) (bool, string) {
+	if job.Spec.TTLSecondsAfterFinished != nil {
+		return false, "deleted by the TTL controller"
+	}
+	finished, outcome, ok := jobFinished(job)
+	if !ok {
+		return false, "not finished"
+	}
+	if time.Since(finished) < opts.jobMaxAge {
+		return false, fmt.Sprintf("%s less than %s ago", outcome, opts.jobMaxAge)
+	}
+	return true, fmt.Sprintf("%s more than %s ago", outcome, opts.jobMaxAge)
+}
+
+// jobCleaner deletes the finished Jobs of a namespace, and their pods.
+type jobCleaner struct {
+	clientset kubernetes.Interface
+	namespace string
+	opts      options
+}
+
+func newJobCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &jobCleaner{clientset: clientset, namespace: namespace, opts: opts}
+}
+
+func (c *jobCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	jobs, err := c.clientset.BatchV1().Jobs(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing jobs: %v", err)
+	}
+	objects := make([]CleanupObject, 0, len(jobs.Items))
+	for _, job := range jobs.Items {
+		job := job
+		objects = append(objects, CleanupObject{
+			Kind:   "Job",
+			Meta:   job.ObjectMeta,
+			Object: job,
+			Export: func() interface{} { return exportableJob(job) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *jobCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decideJob(obj.Object.(batchv1.Job), c.opts)
+	return shouldDelete, reason, nil
+}
+
+func (c *jobCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	// The pods of a Job are only deleted along with it when asked to
+	propagation := metav1.DeletePropagationBackground
+	options.PropagationPolicy = &propagation
+	return c.clientset.BatchV1().Jobs(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *jobCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	if err != nil {
+		return "FinishedJobDeleteFailed", "Failed to delete finished job: " + err.Error()
+	}
+	return "FinishedJobDeleted", "Deleted job as it " + reason
+}
+
+// exportableJob strips the server populated fields of a Job, including the
+// selector and labels generated for its pods, which the API server refuses
+// on creation.
+func exportableJob(job batchv1.Job) *batchv1.Job {
+	exported := job.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	exported.Status = batchv1.JobStatus{}
+	exported.Spec.Selector = nil
+	for _, label := range []string{"controller-uid", "batch.kubernetes.io/controller-uid"} {
+		delete(exported.Spec.Template.Labels, label)
+	}
+	return exported
+}
@@ -0,0 +1,284 @@
+package cleaner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/util/homedir"
+)
+
+// kubeFlags holds the flags selecting the cluster to talk to.
+type kubeFlags struct {
+	kubeconfig string
+	overrides  clientcmd.ConfigOverrides
+	qps        float32
+	burst      int
+	// impersonate is the user the requests are made as, with the groups.
+	impersonate       string
+	impersonateGroups []string
+	// contexts are the kubeconfig contexts to run against one after the
+	// other, instead of the one selected by --context.
+	contexts    []string
+	allContexts bool
+	// clustersFile lists the clusters to run against, with their overrides.
+	clustersFile   string
+	clusterWorkers int
+	// runID is the run the requests are made for, reported in the
+	// User-Agent.
+	runID string
+}
+
+func (k *kubeFlags) register(fs *pflag.FlagSet) {
+	fs.StringVar(&k.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file (defaults to $KUBECONFIG, then $HOME/.kube/config)")
+	fs.StringVar(&k.overrides.CurrentContext, "context", "", "The kubeconfig context to use instead of current-context")
+	fs.StringVar(&k.overrides.Context.Cluster, "cluster", "", "The kubeconfig cluster to use, overriding the one in the selected context")
+	fs.StringVar(&k.overrides.Context.AuthInfo, "user", "", "The kubeconfig user to use, overriding the one in the selected context")
+	fs.StringVar(&k.overrides.ClusterInfo.Server, "server", "", "Address of the API server. Without --kubeconfig and $KUBECONFIG, the connection is built from --server, --token and --certificate-authority alone and no kubeconfig file is needed")
+	fs.StringVar(&k.overrides.AuthInfo.Token, "token", "", "Bearer token to authenticate to the API server with. Prefer setting it through "+envName("token")+" over the command line")
+	fs.StringVar(&k.overrides.ClusterInfo.CertificateAuthority, "certificate-authority", "", "Path to a PEM bundle of the CA certificates the API server certificate is verified with, e.g. the private CA of a lab cluster. Replaces the CA of the kubeconfig or of the service account")
+	fs.BoolVar(&k.overrides.ClusterInfo.InsecureSkipTLSVerify, "insecure-skip-tls-verify", false, "Do not verify the certificate of the API server. The connection, credentials included, can then be intercepted: only use it for lab clusters, and prefer --certificate-authority")
+	fs.StringVar(&k.impersonate, "as", "", "Username to impersonate for the requests, so the API server audit logs attribute them to this identity")
+	fs.StringArrayVar(&k.impersonateGroups, "as-group", nil, "Group to impersonate for the requests along with --as. May be repeated")
+	fs.StringSliceVar(&k.contexts, "contexts", nil, "Run against the clusters of these kubeconfig contexts one after the other, with a summary per cluster")
+	fs.BoolVar(&k.allContexts, "all-contexts", false, "Run against the clusters of all the contexts of the kubeconfig one after the other, with a summary per cluster")
+	fs.StringVar(&k.clustersFile, "clusters-file", "", "YAML file listing the clusters to run against, by kubeconfig path and context, with overrides of the secret selector, protect patterns, min age, resources and dry-run mode per cluster")
+	fs.IntVar(&k.clusterWorkers, "cluster-workers", 1, "Number of clusters cleaned up in parallel with --contexts, --all-contexts or --clusters-file")
+	fs.Float32Var(&k.qps, "kube-api-qps", rest.DefaultQPS, "Maximum sustained rate of requests to the API server per second")
+	fs.IntVar(&k.burst, "kube-api-burst", rest.DefaultBurst, "Maximum burst of requests to the API server above --kube-api-qps")
+}
+
+// multiCluster reports whether several clusters were selected.
+func (k *kubeFlags) multiCluster() bool {
+	return len(k.contexts) > 0 || k.allContexts || k.clustersFile != ""
+}
+
+// clusters returns the clusters selected by --contexts, --all-contexts or
+// --clusters-file, in order.
+func (k *kubeFlags) clusters() ([]clusterTarget, error) {
+	if k.clustersFile != "" {
+		if len(k.contexts) > 0 || k.allContexts {
+			return nil, fmt.Errorf("--clusters-file cannot be combined with --contexts or --all-contexts")
+		}
+		if k.overrides.CurrentContext != "" {
+			return nil, fmt.Errorf("--context cannot be combined with --clusters-file")
+		}
+		clusters, err := loadClustersFile(k.clustersFile)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --clusters-file: %v", err)
+		}
+		return clusters, nil
+	}
+	names, err := k.contextNames()
+	if err != nil {
+		return nil, err
+	}
+	clusters := make([]clusterTarget, 0, len(names))
+	for _, name := range names {
+		clusters = append(clusters, clusterTarget{name: name, context: name})
+	}
+	return clusters, nil
+}
+
+// contextNames returns the kubeconfig contexts selected by --contexts or
+// --all-contexts, in order.
+func (k *kubeFlags) contextNames() ([]string, error) {
+	if k.overrides.CurrentContext != "" {
+		return nil, fmt.Errorf("--context cannot be combined with --contexts or --all-contexts")
+	}
+	if len(k.contexts) > 0 && k.allContexts {
+		return nil, fmt.Errorf("--contexts cannot be combined with --all-contexts")
+	}
+	if !k.allContexts {
+		return k.contexts, nil
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = k.kubeconfig
+	if k.kubeconfig == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		loadingRules.ExplicitPath = getDefaultKubeconfigPath()
+	}
+	config, err := loadingRules.Load()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading kubeconfig: %v", err)
+	}
+	names := make([]string, 0, len(config.Contexts))
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("The kubeconfig has no contexts")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// forCluster returns a copy of the flags selecting the cluster.
+func (k kubeFlags) forCluster(cluster clusterTarget) *kubeFlags {
+	if cluster.kubeconfig != "" {
+		k.kubeconfig = cluster.kubeconfig
+	}
+	k.overrides.CurrentContext = cluster.context
+	k.contexts = nil
+	k.allContexts = false
+	k.clustersFile = ""
+	return &k
+}
+
+// forRun returns a copy of the flags whose requests are made for the run.
+func (k kubeFlags) forRun(runID string) *kubeFlags {
+	k.runID = runID
+	return &k
+}
+
+// config builds the REST config from the flags.
+func (k *kubeFlags) config() (*rest.Config, error) {
+	config, err := buildConfig(k.kubeconfig, &k.overrides)
+	if err != nil {
+		return nil, fmt.Errorf("Error building kubeconfig: %v", err)
+	}
+	config.QPS = k.qps
+	config.Burst = k.burst
+	config.UserAgent = userAgent(k.runID)
+	// The in-cluster config ignores the overrides
+	if ca := k.overrides.ClusterInfo.CertificateAuthority; ca != "" {
+		if k.overrides.ClusterInfo.InsecureSkipTLSVerify {
+			return nil, fmt.Errorf("--certificate-authority cannot be combined with --insecure-skip-tls-verify")
+		}
+		config.TLSClientConfig.CAFile = ca
+		config.TLSClientConfig.CAData = nil
+	}
+	if k.overrides.ClusterInfo.InsecureSkipTLSVerify {
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.CAData = nil
+	}
+	if config.TLSClientConfig.Insecure {
+		warnInsecure(config.Host)
+	}
+	if len(k.impersonateGroups) > 0 && k.impersonate == "" {
+		return nil, fmt.Errorf("--as-group requires --as")
+	}
+	if k.impersonate != "" {
+		// Set on the config rather than the overrides, which the in-cluster
+		// config ignores
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: k.impersonate,
+			Groups:   k.impersonateGroups,
+		}
+	}
+	return config, nil
+}
+
+// insecureHosts are the API servers already warned about by warnInsecure.
+var insecureHosts sync.Map
+
+// warnInsecure warns, once per API server, that its certificate is not
+// verified.
+func warnInsecure(host string) {
+	if _, warned := insecureHosts.LoadOrStore(host, true); warned {
+		return
+	}
+	logger.Warn("TLS VERIFICATION DISABLED: the certificate of the API server is not verified, so the connection and the credentials sent over it can be intercepted. Use --certificate-authority with the CA of the cluster instead", "server", host)
+}
+
+// clientset builds a Kubernetes client from the flags.
+func (k *kubeFlags) clientset() (kubernetes.Interface, error) {
+	config, err := k.config()
+	if err != nil {
+		return nil, err
+	}
+	return newClientset(config)
+}
+
+// newClientset creates a Kubernetes client for the built-in types.
+func newClientset(config *rest.Config) (kubernetes.Interface, error) {
+	config = rest.CopyConfig(config)
+	// The built-in types support protobuf, which is much cheaper to decode
+	// than JSON. JSON stays acceptable for API servers lacking it.
+	config.AcceptContentTypes = runtime.ContentTypeProtobuf + "," + runtime.ContentTypeJSON
+	config.ContentType = runtime.ContentTypeProtobuf
+	// Use the config to create a Kubernetes client
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Kubernetes client: %v", err)
+	}
+	return clientset, nil
+}
+
+// dynamicClient builds a client for custom resources from the flags.
+func (k *kubeFlags) dynamicClient() (dynamic.Interface, error) {
+	config, err := k.config()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Kubernetes client: %v", err)
+	}
+	return client, nil
+}
+
+// metadataClient builds a client listing only the metadata of objects.
+func (k *kubeFlags) metadataClient() (metadata.Interface, error) {
+	config, err := k.config()
+	if err != nil {
+		return nil, err
+	}
+	client, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Kubernetes client: %v", err)
+	}
+	return client, nil
+}
+
+// buildConfig returns the REST config used to talk to the cluster. An explicit
+// kubeconfig path wins, followed by the KUBECONFIG environment variable (which
+// may list several colon-separated files to merge). When neither is set, a
+// server given on the command line is connected to without any kubeconfig
+// file; otherwise, when a service account token is mounted, the in-cluster
+// configuration is used, authenticated with --token instead of the service
+// account when given, else $HOME/.kube/config is loaded. Selecting a
+// context, cluster or user always implies loading a kubeconfig file.
+func buildConfig(kubeconfig string, overrides *clientcmd.ConfigOverrides) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+
+	if kubeconfig == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		selected := overrides.CurrentContext != "" || overrides.Context.Cluster != "" || overrides.Context.AuthInfo != ""
+		if overrides.ClusterInfo.Server != "" && !selected {
+			return clientcmd.NewDefaultClientConfig(*clientcmdapi.NewConfig(), overrides).ClientConfig()
+		}
+		// Check if running inside a Kubernetes cluster
+		if _, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount/token"); err == nil && !selected {
+			config, err := rest.InClusterConfig()
+			if err != nil {
+				return nil, fmt.Errorf("error building in-cluster kubeconfig: %v", err)
+			}
+			// The in-cluster config ignores the overrides, and its token
+			// file would win over the token
+			if token := overrides.AuthInfo.Token; token != "" {
+				config.BearerToken = token
+				config.BearerTokenFile = ""
+			}
+			return config, nil
+		}
+		loadingRules.ExplicitPath = getDefaultKubeconfigPath()
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
+
+func getDefaultKubeconfigPath() string {
+	home := homedir.HomeDir()
+	return filepath.Join(home, ".kube", "config")
+}
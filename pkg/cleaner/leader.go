@@ -0,0 +1,106 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElection holds the settings of the Lease based leader election that
+// lets several replicas of the controller run with only one of them active.
+type leaderElection struct {
+	enabled       bool
+	namespace     string
+	name          string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// run calls lead once this replica became the leader, and returns when ctx is
+// done or the leadership was lost. The context passed to lead is done in
+// either case, and the lease is only released after lead returned, so the
+// next leader never reconciles alongside the workers of this one. Losing the
+// leadership is an error, so the process exits and cannot race with the new
+// leader.
+func (l leaderElection) run(ctx context.Context, clientset kubernetes.Interface, lead func(ctx context.Context) error) error {
+	if !l.enabled {
+		return lead(ctx)
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error determining the leader election identity: %v", err)
+	}
+	namespace := l.namespace
+	if namespace == "" {
+		namespace = ownNamespace()
+	}
+
+	// The election outlives ctx while leading, as cancelling it releases
+	// the lease
+	var started atomic.Bool
+	election, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stopWaiting := context.AfterFunc(ctx, func() {
+		if !started.Load() {
+			cancel()
+		}
+	})
+	defer stopWaiting()
+	finished := make(chan error, 1)
+	lost := false
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: l.name},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   l.leaseDuration,
+		RenewDeadline:   l.renewDeadline,
+		RetryPeriod:     l.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leading context.Context) {
+				started.Store(true)
+				logger.Info("Acquired leadership", "lease", namespace+"/"+l.name, "identity", identity)
+				leading, stop := context.WithCancel(leading)
+				stopLeading := context.AfterFunc(ctx, stop)
+				finished <- lead(leading)
+				stopLeading()
+				stop()
+				cancel()
+			},
+			OnStoppedLeading: func() {
+				if election.Err() == nil {
+					lost = true
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logger.Info("Standing by", "leader", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error setting up leader election: %v", err)
+	}
+	logger.Info("Waiting for leadership", "lease", namespace+"/"+l.name, "identity", identity)
+	elector.Run(election)
+	var leadErr error
+	if started.Load() {
+		leadErr = <-finished
+	}
+	if lost {
+		return fmt.Errorf("lost leadership of lease %s/%s", namespace, l.name)
+	}
+	return leadErr
+}
@@ -0,0 +1,54 @@
+package cleaner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// When the process is stopping, lead gets a done context and the lease stays
+// held until lead returned.
+func TestLeaderElectionReleasesAfterLead(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	election := leaderElection{
+		enabled:       true,
+		namespace:     "cleaner",
+		name:          "orphan-cleaner",
+		leaseDuration: 15 * time.Second,
+		renewDeadline: 10 * time.Second,
+		retryPeriod:   2 * time.Second,
+	}
+	holder := func() string {
+		lease, err := clientset.CoordinationV1().Leases("cleaner").Get(context.Background(), "orphan-cleaner", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Spec.HolderIdentity == nil {
+			return ""
+		}
+		return *lease.Spec.HolderIdentity
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var heldWhileStopping string
+	err := election.run(ctx, clientset, func(ctx context.Context) error {
+		cancel()
+		<-ctx.Done()
+		// The workers still finish their reconciles
+		time.Sleep(100 * time.Millisecond)
+		heldWhileStopping = holder()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heldWhileStopping == "" {
+		t.Error("lease released before lead returned")
+	}
+	if got := holder(); got != "" {
+		t.Errorf("lease held by %q after the run, want it released", got)
+	}
+}
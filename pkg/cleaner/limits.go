@@ -0,0 +1,48 @@
+package cleaner
+
+import "sync"
+
+// deletionBudget caps the number of deletions across all namespace workers.
+// A limit of zero means unlimited.
+type deletionBudget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+func newDeletionBudget(limit int) *deletionBudget {
+	return &deletionBudget{limit: limit}
+}
+
+// take reserves one deletion and reports whether the budget allowed it.
+func (b *deletionBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used >= b.limit {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// giveBack returns a deletion reserved with take that did not happen.
+func (b *deletionBudget) giveBack() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used--
+}
+
+// exceedsDeletionRatio reports whether deleting candidates out of total
+// objects would go over maxPercent. 0 and 100 disable the check.
+func exceedsDeletionRatio(candidates, total, maxPercent int) bool {
+	if total == 0 || maxPercent <= 0 || maxPercent >= 100 {
+		return false
+	}
+	return candidates*100 > total*maxPercent
+}
@@ -0,0 +1,18 @@
+package cleaner
+
+import "testing"
+
+func TestDeletionBudgetGiveBack(t *testing.T) {
+	budget := newDeletionBudget(1)
+	if !budget.take() {
+		t.Fatal("take refused the first deletion")
+	}
+	// The deletion failed with a conflict
+	budget.giveBack()
+	if !budget.take() {
+		t.Fatal("take refused a deletion given back")
+	}
+	if budget.take() {
+		t.Error("take allowed a deletion over the limit")
+	}
+}
@@ -0,0 +1,198 @@
+package cleaner
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+)
+
+// listPageSize is the number of objects requested per list call, so that
+// namespaces with tens of thousands of objects are not returned in a single
+// huge response.
+const listPageSize = 500
+
+// listPages calls list with options for every page until the last one.
+func listPages(options metav1.ListOptions, list func(metav1.ListOptions) (string, error)) error {
+	options.Limit = listPageSize
+	for {
+		next, err := list(options)
+		if err != nil || next == "" {
+			return err
+		}
+		options.Continue = next
+	}
+}
+
+// listSecrets lists the metadata of the secrets only, so their possibly large
+// data never crosses the wire. The secrets returned have no type nor data,
+// completeSecret fetches them for the candidates.
+func listSecrets(ctx context.Context, client metadata.Interface, namespace string, options metav1.ListOptions) ([]v1.Secret, error) {
+	var secrets []v1.Secret
+	err := listPages(options, func(options metav1.ListOptions) (string, error) {
+		page, err := client.Resource(v1.SchemeGroupVersion.WithResource("secrets")).Namespace(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		for _, item := range page.Items {
+			secrets = append(secrets, v1.Secret{ObjectMeta: item.ObjectMeta})
+		}
+		return page.Continue, nil
+	})
+	return secrets, err
+}
+
+// listFullSecrets lists the secrets including their type and data, for the
+// decisions that need more than the metadata.
+func listFullSecrets(ctx context.Context, clientset kubernetes.Interface, namespace string, options metav1.ListOptions) ([]v1.Secret, error) {
+	var secrets []v1.Secret
+	err := listPages(options, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().Secrets(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		secrets = append(secrets, page.Items...)
+		return page.Continue, nil
+	})
+	return secrets, err
+}
+
+// completeSecret fetches the full secret listed by listSecrets. It returns nil
+// if the secret changed or disappeared since it was listed, as the decision
+// taken on the listed metadata may no longer hold.
+func completeSecret(ctx context.Context, clientset kubernetes.Interface, secret v1.Secret) (*v1.Secret, error) {
+	full, err := clientset.CoreV1().Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if full.UID != secret.UID || full.ResourceVersion != secret.ResourceVersion {
+		return nil, nil
+	}
+	return full, nil
+}
+
+func listPods(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]v1.Pod, error) {
+	var pods []v1.Pod
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().Pods(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		pods = append(pods, page.Items...)
+		return page.Continue, nil
+	})
+	return pods, err
+}
+
+func listServices(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]v1.Service, error) {
+	var services []v1.Service
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().Services(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		services = append(services, page.Items...)
+		return page.Continue, nil
+	})
+	return services, err
+}
+
+func listServiceAccounts(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]v1.ServiceAccount, error) {
+	var serviceAccounts []v1.ServiceAccount
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().ServiceAccounts(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		serviceAccounts = append(serviceAccounts, page.Items...)
+		return page.Continue, nil
+	})
+	return serviceAccounts, err
+}
+
+func listIngresses(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]networkingv1.Ingress, error) {
+	var ingresses []networkingv1.Ingress
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.NetworkingV1().Ingresses(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		ingresses = append(ingresses, page.Items...)
+		return page.Continue, nil
+	})
+	return ingresses, err
+}
+
+func listConfigMaps(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]v1.ConfigMap, error) {
+	var configMaps []v1.ConfigMap
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().ConfigMaps(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		configMaps = append(configMaps, page.Items...)
+		return page.Continue, nil
+	})
+	return configMaps, err
+}
+
+func listEndpointSlices(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]discoveryv1.EndpointSlice, error) {
+	var slices []discoveryv1.EndpointSlice
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		slices = append(slices, page.Items...)
+		return page.Continue, nil
+	})
+	return slices, err
+}
+
+func listPVCs(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]v1.PersistentVolumeClaim, error) {
+	var pvcs []v1.PersistentVolumeClaim
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		pvcs = append(pvcs, page.Items...)
+		return page.Continue, nil
+	})
+	return pvcs, err
+}
+
+func listPersistentVolumes(ctx context.Context, clientset kubernetes.Interface) ([]v1.PersistentVolume, error) {
+	var volumes []v1.PersistentVolume
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.CoreV1().PersistentVolumes().List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		volumes = append(volumes, page.Items...)
+		return page.Continue, nil
+	})
+	return volumes, err
+}
+
+func listStorageClasses(ctx context.Context, clientset kubernetes.Interface) ([]storagev1.StorageClass, error) {
+	var classes []storagev1.StorageClass
+	err := listPages(metav1.ListOptions{}, func(options metav1.ListOptions) (string, error) {
+		page, err := clientset.StorageV1().StorageClasses().List(ctx, options)
+		if err != nil {
+			return "", err
+		}
+		classes = append(classes, page.Items...)
+		return page.Continue, nil
+	})
+	return classes, err
+}
@@ -0,0 +1,147 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Secrets managed by a controller are recreated as soon as they are deleted,
+// so deleting them only causes churn. The controllers are optional: their
+// resources are read with the dynamic client and skipped when their CRDs are
+// not installed.
+
+// certificateResources are the cert-manager Certificates.
+var certificateResources = []schema.GroupVersionResource{
+	{Group: "cert-manager.io", Version: "v1", Resource: "certificates"},
+}
+
+// certificateNameAnnotation is set by cert-manager on the secrets it issued.
+const certificateNameAnnotation = "cert-manager.io/certificate-name"
+
+// externalSecretsPrefix starts the labels and annotations the External
+// Secrets Operator sets on the secrets it syncs.
+const externalSecretsPrefix = "reconcile.external-secrets.io/"
+
+// sealedSecretsPrefix starts the annotations of the secrets unsealed by the
+// SealedSecrets controller.
+const sealedSecretsPrefix = "sealedsecrets.bitnami.com/"
+
+// helmReleaseType is the type of the secrets Helm stores releases in.
+const helmReleaseType v1.SecretType = "helm.sh/release.v1"
+
+// Argo CD tracks the objects of an application with a label or an
+// annotation, depending on its resource tracking method.
+const (
+	argoCDInstanceLabel      = "argocd.argoproj.io/instance"
+	argoCDTrackingAnnotation = "argocd.argoproj.io/tracking-id"
+)
+
+// gitOpsTool recognizes the objects deployed by a GitOps tool from their
+// metadata, and names what deployed them.
+type gitOpsTool func(meta metav1.ObjectMeta) (string, bool)
+
+// gitOpsTools are checked in order, so an object carrying the markers of
+// several tools is always reported as deployed by the same one.
+var gitOpsTools = []gitOpsTool{
+	argoCDApplication,
+	fluxReconciler("kustomize.toolkit.fluxcd.io", "Kustomization"),
+	fluxReconciler("helm.toolkit.fluxcd.io", "HelmRelease"),
+}
+
+// argoCDApplication recognizes the objects of an Argo CD application.
+func argoCDApplication(meta metav1.ObjectMeta) (string, bool) {
+	if app, ok := meta.Labels[argoCDInstanceLabel]; ok {
+		return fmt.Sprintf("deployed by Argo CD application %s", app), true
+	}
+	if tracking, ok := meta.Annotations[argoCDTrackingAnnotation]; ok {
+		app, _, _ := strings.Cut(tracking, ":")
+		return fmt.Sprintf("deployed by Argo CD application %s", app), true
+	}
+	return "", false
+}
+
+// fluxReconciler recognizes the objects applied by the Flux reconciler of an
+// API group, which labels them with <group>/name and <group>/namespace.
+func fluxReconciler(group, kind string) gitOpsTool {
+	return func(meta metav1.ObjectMeta) (string, bool) {
+		name, hasName := meta.Labels[group+"/name"]
+		namespace, hasNamespace := meta.Labels[group+"/namespace"]
+		if hasName || hasNamespace {
+			return fmt.Sprintf("deployed by Flux %s %s/%s", kind, namespace, name), true
+		}
+		return "", false
+	}
+}
+
+// gitOpsManager returns the GitOps tool deploying an object, if any. Such
+// objects are declared in a repository, so deleting them only makes the tool
+// recreate them.
+func gitOpsManager(meta metav1.ObjectMeta) (string, bool) {
+	for _, tool := range gitOpsTools {
+		if manager, ok := tool(meta); ok {
+			return manager, true
+		}
+	}
+	return "", false
+}
+
+// secretManager returns the controller managing a secret according to its
+// metadata, if any.
+func secretManager(secret v1.Secret) (string, bool) {
+	// Deleting them corrupts the release history. Listed secrets have no
+	// type, Helm labels its storage secrets with owner=helm though.
+	if secret.Type == helmReleaseType || secret.Labels["owner"] == "helm" {
+		return fmt.Sprintf("Helm storage of release %s", secret.Labels["name"]), true
+	}
+	if name, ok := secret.Annotations[certificateNameAnnotation]; ok {
+		return fmt.Sprintf("issued by cert-manager certificate/%s", name), true
+	}
+	for _, owner := range secret.OwnerReferences {
+		if owner.Kind == "ExternalSecret" && strings.HasPrefix(owner.APIVersion, "external-secrets.io/") {
+			return fmt.Sprintf("synced by externalsecret/%s", owner.Name), true
+		}
+	}
+	if hasKeyPrefix(secret.Labels, externalSecretsPrefix) || hasKeyPrefix(secret.Annotations, externalSecretsPrefix) {
+		return "synced by the External Secrets Operator", true
+	}
+	for _, owner := range secret.OwnerReferences {
+		if owner.Kind == "SealedSecret" && strings.HasPrefix(owner.APIVersion, "bitnami.com/") {
+			return fmt.Sprintf("unsealed from sealedsecret/%s", owner.Name), true
+		}
+	}
+	if hasKeyPrefix(secret.Annotations, sealedSecretsPrefix) {
+		return "unsealed by the SealedSecrets controller", true
+	}
+	return "", false
+}
+
+// addCertificateReferences records the secrets cert-manager Certificates
+// store their certificate in, including the ones not issued yet.
+func addCertificateReferences(ctx context.Context, client dynamic.Interface, refs *secretReferences, namespace string) error {
+	certificates, err := listOptional(ctx, client, certificateResources, namespace)
+	if err != nil {
+		return fmt.Errorf("error listing certificates: %v", err)
+	}
+	for _, certificate := range certificates {
+		name, _, _ := unstructured.NestedString(certificate.Object, "spec", "secretName")
+		refs.add(name, fmt.Sprintf("cert-manager certificate/%s", certificate.GetName()))
+	}
+	return nil
+}
+
+// hasKeyPrefix reports whether any key of m starts with prefix.
+func hasKeyPrefix(m map[string]string, prefix string) bool {
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
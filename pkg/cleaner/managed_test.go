@@ -0,0 +1,53 @@
+package cleaner
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGitOpsManager(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "none", labels: map[string]string{"app": "web"}},
+		{name: "argo label", labels: map[string]string{argoCDInstanceLabel: "web"}, want: "deployed by Argo CD application web"},
+		{name: "argo annotation", annotations: map[string]string{argoCDTrackingAnnotation: "web:/Secret:team-a/db"}, want: "deployed by Argo CD application web"},
+		{name: "flux kustomization", labels: map[string]string{"kustomize.toolkit.fluxcd.io/name": "apps", "kustomize.toolkit.fluxcd.io/namespace": "flux-system"}, want: "deployed by Flux Kustomization flux-system/apps"},
+		{name: "flux helm release", labels: map[string]string{"helm.toolkit.fluxcd.io/name": "web", "helm.toolkit.fluxcd.io/namespace": "team-a"}, want: "deployed by Flux HelmRelease team-a/web"},
+		{
+			name: "argo and flux",
+			labels: map[string]string{
+				"helm.toolkit.fluxcd.io/name":      "web",
+				"kustomize.toolkit.fluxcd.io/name": "apps",
+				argoCDInstanceLabel:                "web",
+			},
+			want: "deployed by Argo CD application web",
+		},
+		{
+			name: "both flux reconcilers",
+			labels: map[string]string{
+				"helm.toolkit.fluxcd.io/name":           "web",
+				"helm.toolkit.fluxcd.io/namespace":      "team-a",
+				"kustomize.toolkit.fluxcd.io/name":      "apps",
+				"kustomize.toolkit.fluxcd.io/namespace": "flux-system",
+			},
+			want: "deployed by Flux Kustomization flux-system/apps",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := metav1.ObjectMeta{Labels: tt.labels, Annotations: tt.annotations}
+			// The same object must always be reported the same way
+			for i := 0; i < 20; i++ {
+				got, ok := gitOpsManager(meta)
+				if ok != (tt.want != "") || got != tt.want {
+					t.Fatalf("gitOpsManager = %q, %v, want %q", got, ok, tt.want)
+				}
+			}
+		})
+	}
+}
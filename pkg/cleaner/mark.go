@@ -0,0 +1,92 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// candidateSinceAnnotation records when a secret was first found orphaned by
+// the two-phase mark-then-sweep mode.
+const candidateSinceAnnotation = "orphan-cleaner/candidate-since"
+
+// candidateSince returns the time the object was marked as a candidate.
+func candidateSince(meta metav1.ObjectMeta) (time.Time, bool) {
+	value, ok := meta.Annotations[candidateSinceAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		// A garbled mark is treated as a fresh one
+		return time.Time{}, false
+	}
+	return since, true
+}
+
+// setCandidateMark adds the candidate annotation to the secret, or removes it
+// when mark is false.
+func setCandidateMark(ctx context.Context, clientset kubernetes.Interface, namespace, name string, mark bool) error {
+	var value interface{}
+	if mark {
+		value = time.Now().UTC().Format(time.RFC3339)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				candidateSinceAnnotation: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := clientset.CoreV1().Secrets(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("error patching secret %s: %v", name, err)
+	}
+	return nil
+}
+
+// readyToSweep decides whether a candidate secret may be deleted in
+// mark-then-sweep mode. Unmarked secrets are marked and kept, marked secrets
+// are kept until the grace period has passed.
+func readyToSweep(ctx context.Context, clientset kubernetes.Interface, namespace string, secret v1.Secret, opts options) (bool, error) {
+	meta := secret.ObjectMeta
+	if opts.markGrace <= 0 {
+		return true, nil
+	}
+	since, marked := candidateSince(meta)
+	if !marked {
+		logger.Info("Marking secret as an orphan candidate", "namespace", namespace, "resource", "secret/"+meta.Name, "action", actionMark)
+		opts.recordSecret(secret, actionMark, "orphan candidate, deleted after "+opts.markGrace.String())
+		if !opts.mutates() {
+			return false, nil
+		}
+		return false, setCandidateMark(ctx, clientset, namespace, meta.Name, true)
+	}
+	if remaining := opts.markGrace - time.Since(since); remaining > 0 {
+		logger.Info("Keeping marked secret until its grace period ends", "namespace", namespace, "resource", "secret/"+meta.Name, "action", actionKeep, "remaining", remaining.Round(time.Second).String())
+		opts.recordSecret(secret, actionKeep, "marked as orphan candidate, grace period remaining "+remaining.Round(time.Second).String())
+		return false, nil
+	}
+	return true, nil
+}
+
+// clearCandidateMark removes a stale candidate mark from a secret that is no
+// longer considered orphaned.
+func clearCandidateMark(ctx context.Context, clientset kubernetes.Interface, namespace string, meta metav1.ObjectMeta, opts options) error {
+	if _, marked := meta.Annotations[candidateSinceAnnotation]; !marked {
+		return nil
+	}
+	logger.Info("Unmarking secret as it is no longer orphaned", "namespace", namespace, "resource", "secret/"+meta.Name, "action", actionKeep)
+	if !opts.mutates() {
+		return nil
+	}
+	return setCandidateMark(ctx, clientset, namespace, meta.Name, false)
+}
@@ -0,0 +1,155 @@
+package cleaner
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the duration histograms.
+var durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+// cleanerMetrics holds the metrics of the cleaner, in a registry of their
+// own. It is safe for concurrent use.
+type cleanerMetrics struct {
+	registry          *prometheus.Registry
+	scanned           *prometheus.CounterVec
+	deleted           *prometheus.CounterVec
+	skipped           *prometheus.CounterVec
+	errors            *prometheus.CounterVec
+	namespaceDuration *prometheus.HistogramVec
+	runDuration       prometheus.Histogram
+	lastSuccess       prometheus.Gauge
+	buildInfo         *prometheus.GaugeVec
+}
+
+// metrics accumulates the metrics of all runs of the process.
+var metrics = newCleanerMetrics()
+
+func newCleanerMetrics() *cleanerMetrics {
+	m := &cleanerMetrics{
+		registry: prometheus.NewRegistry(),
+		scanned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "orphan_cleaner_objects_scanned_total",
+			Help: "Number of objects examined.",
+		}, []string{"kind", "namespace"}),
+		deleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "orphan_cleaner_objects_deleted_total",
+			Help: "Number of orphaned objects deleted.",
+		}, []string{"kind", "namespace", "dry_run"}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "orphan_cleaner_objects_skipped_total",
+			Help: "Number of orphaned objects not deleted because of a safety check.",
+		}, []string{"kind", "namespace"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "orphan_cleaner_errors_total",
+			Help: "Number of objects that could not be deleted.",
+		}, []string{"kind", "namespace"}),
+		namespaceDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "orphan_cleaner_namespace_duration_seconds",
+			Help:    "Time spent cleaning up a namespace.",
+			Buckets: durationBuckets,
+		}, []string{"namespace"}),
+		runDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "orphan_cleaner_run_duration_seconds",
+			Help:    "Duration of a cleanup run.",
+			Buckets: durationBuckets,
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "orphan_cleaner_last_success_timestamp_seconds",
+			Help: "Unix time of the end of the last successful run.",
+		}),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "orphan_cleaner_build_info",
+			Help: "Always 1, labeled with the version the cleaner was built from.",
+		}, []string{"version", "commit", "build_date", "client_go_version"}),
+	}
+	m.registry.MustRegister(m.scanned, m.deleted, m.skipped, m.errors, m.namespaceDuration, m.runDuration, m.lastSuccess, m.buildInfo)
+	m.buildInfo.WithLabelValues(buildVersion.Version, buildVersion.GitCommit, buildVersion.BuildDate, buildVersion.ClientGoVersion).Set(1)
+	return m
+}
+
+func (m *cleanerMetrics) record(d decision) {
+	m.scanned.WithLabelValues(d.Kind, d.Namespace).Inc()
+	switch d.Action {
+	case actionDelete:
+		m.deleted.WithLabelValues(d.Kind, d.Namespace, strconv.FormatBool(d.DryRun)).Inc()
+	case actionSkip:
+		m.skipped.WithLabelValues(d.Kind, d.Namespace).Inc()
+	case actionError:
+		m.errors.WithLabelValues(d.Kind, d.Namespace).Inc()
+	}
+}
+
+func (m *cleanerMetrics) namespaceDone(namespace string, duration time.Duration) {
+	m.namespaceDuration.WithLabelValues(namespace).Observe(duration.Seconds())
+}
+
+func (m *cleanerMetrics) runDone(duration time.Duration, err error) {
+	m.runDuration.Observe(duration.Seconds())
+	if err == nil {
+		m.lastSuccess.SetToCurrentTime()
+	}
+}
+
+// serveMetrics exposes the metrics on http://<addr>/metrics for as long as the
+// process runs.
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	go serve(listener, mux, "metrics")
+	return nil
+}
+
+// serveProfiling serves the net/http/pprof endpoints on addr, to profile the
+// CPU and memory usage of runs over thousands of namespaces.
+func serveProfiling(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go serve(listener, mux, "profiling")
+	return nil
+}
+
+// serve serves handler on listener until it fails, which is logged. Slow
+// clients get ten seconds to send their headers, so they cannot hold
+// connections open forever.
+func serve(listener net.Listener, handler http.Handler, name string) {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(listener); err != nil {
+		logger.Error("Error serving the "+name+" endpoints", "address", listener.Addr().String(), "error", err)
+	}
+}
+
+// push replaces the metrics of job on a Prometheus Pushgateway, for runs that
+// end before Prometheus gets to scrape them. They are grouped by instance and,
+// in multi-cluster runs, by cluster, so the runs against the clusters and the
+// replicas do not replace each other's metrics.
+func (m *cleanerMetrics) push(gatewayURL, job, cluster string) error {
+	pusher := push.New(gatewayURL, job).Gatherer(m.registry)
+	if instance, err := os.Hostname(); err == nil {
+		pusher = pusher.Grouping("instance", instance)
+	}
+	if cluster != "" {
+		pusher = pusher.Grouping("cluster", cluster)
+	}
+	return pusher.Push()
+}
@@ -0,0 +1,72 @@
+package cleaner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCleanerMetricsRecord(t *testing.T) {
+	m := newCleanerMetrics()
+	m.record(decision{Namespace: "team-a", Kind: "Secret", Action: actionDelete})
+	m.record(decision{Namespace: "team-a", Kind: "Secret", Action: actionDelete, DryRun: true})
+	m.record(decision{Namespace: "team-\"b\"", Kind: "Service", Action: actionSkip})
+
+	want := `
+# HELP orphan_cleaner_objects_deleted_total Number of orphaned objects deleted.
+# TYPE orphan_cleaner_objects_deleted_total counter
+orphan_cleaner_objects_deleted_total{dry_run="false",kind="Secret",namespace="team-a"} 1
+orphan_cleaner_objects_deleted_total{dry_run="true",kind="Secret",namespace="team-a"} 1
+# HELP orphan_cleaner_objects_scanned_total Number of objects examined.
+# TYPE orphan_cleaner_objects_scanned_total counter
+orphan_cleaner_objects_scanned_total{kind="Secret",namespace="team-a"} 2
+orphan_cleaner_objects_scanned_total{kind="Service",namespace="team-\"b\""} 1
+# HELP orphan_cleaner_objects_skipped_total Number of orphaned objects not deleted because of a safety check.
+# TYPE orphan_cleaner_objects_skipped_total counter
+orphan_cleaner_objects_skipped_total{kind="Service",namespace="team-\"b\""} 1
+`
+	err := testutil.GatherAndCompare(m.registry, strings.NewReader(want),
+		"orphan_cleaner_objects_deleted_total", "orphan_cleaner_objects_scanned_total", "orphan_cleaner_objects_skipped_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCleanerMetricsPushGroupsByCluster(t *testing.T) {
+	// The grouping labels come in no particular order
+	var groups []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/metrics/"), "/")
+		group := map[string]string{"method": r.Method}
+		for i := 0; i+1 < len(segments); i += 2 {
+			group[segments[i]] = segments[i+1]
+		}
+		groups = append(groups, group)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	instance, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, cluster := range []string{"prod", "staging"} {
+		m := newCleanerMetrics()
+		m.record(decision{Namespace: "team-a", Kind: "Secret", Action: actionDelete})
+		if err := m.push(server.URL, "cleaner", cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []map[string]string{
+		{"method": http.MethodPut, "job": "cleaner", "instance": instance, "cluster": "prod"},
+		{"method": http.MethodPut, "job": "cleaner", "instance": instance, "cluster": "staging"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("pushed to %v, want %v", groups, want)
+	}
+}
@@ -0,0 +1,142 @@
+package cleaner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// enabledAnnotation opts a namespace in to be cleaned up with --opt-in.
+const enabledAnnotation = "orphan-cleaner/enabled"
+
+// systemNamespaces are never cleaned up, whatever the flags say.
+var systemNamespaces = []string{
+	"kube-system",
+	"kube-public",
+}
+
+// compileExcludedNamespaces parses the system namespaces, the namespace the
+// tool runs in and the user supplied patterns.
+func compileExcludedNamespaces(extra []string) ([]namePattern, error) {
+	raw := append([]string{}, systemNamespaces...)
+	if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		raw = append(raw, strings.TrimSpace(string(data)))
+	}
+	var patterns []namePattern
+	for _, r := range append(raw, extra...) {
+		p, err := parseNamePattern(r)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// namespaceShard selects the share of the namespaces processed by one of
+// several runs executing in parallel.
+type namespaceShard struct {
+	index int
+	count int
+}
+
+// owns reports whether the namespace belongs to the shard. Namespaces are
+// assigned by the hash of their name, so every run computes the same split.
+func (s namespaceShard) owns(namespace string) bool {
+	if s.count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	return int(h.Sum32()%uint32(s.count)) == s.index
+}
+
+// selectsNamespace reports whether the run is responsible for a namespace.
+func (o options) selectsNamespace(namespace string) bool {
+	if _, excluded := matchProtected(o.excludedNamespaces, namespace); excluded {
+		return false
+	}
+	if o.namespaceRegexp != nil && !o.namespaceRegexp.MatchString(namespace) {
+		return false
+	}
+	return o.shard.owns(namespace)
+}
+
+// optedIn reports whether the namespace carries the annotation required with
+// --opt-in.
+func (o options) optedIn(namespace v1.Namespace) bool {
+	return !o.optIn || namespace.Annotations[enabledAnnotation] == "true"
+}
+
+// targetNamespaces returns the namespaces given with --namespaces-from, or the
+// labeled customer namespaces. With --opt-in the labels do not matter, all
+// namespaces are returned to be checked for the annotation.
+func targetNamespaces(ctx context.Context, clientset kubernetes.Interface, opts options) ([]v1.Namespace, error) {
+	if opts.namespaceList != nil {
+		namespaces := make([]v1.Namespace, len(opts.namespaceList))
+		for i, name := range opts.namespaceList {
+			// The annotations of the namespaces are needed
+			namespace, err := clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("error getting namespace %s: %v", name, err)
+			}
+			namespaces[i] = *namespace
+		}
+		return namespaces, nil
+	}
+	listOptions := metav1.ListOptions{LabelSelector: customerNamespaceSelector}
+	if opts.optIn {
+		listOptions.LabelSelector = ""
+	}
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing namespaces: %v", err)
+	}
+	return namespaces.Items, nil
+}
+
+// readNamespaceList reads one namespace per line from path, or from stdin if
+// path is "-". Empty lines and # comments are ignored.
+func readNamespaceList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	namespaces := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		namespaces = append(namespaces, line)
+	}
+	return namespaces, scanner.Err()
+}
+
+// selectNamespaces returns the namespaces the run is responsible for.
+func selectNamespaces(namespaces []v1.Namespace, opts options) []v1.Namespace {
+	var selected []v1.Namespace
+	for _, namespace := range namespaces {
+		if opts.selectsNamespace(namespace.Name) && opts.optedIn(namespace) {
+			selected = append(selected, namespace)
+		}
+	}
+	if len(selected) < len(namespaces) {
+		logger.Info("Selected namespaces", "selected", len(selected), "total", len(namespaces))
+	}
+	return selected
+}
@@ -0,0 +1,125 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// decideNetworkPolicy decides whether a NetworkPolicy is orphaned, and
+// explains why. A policy is only a candidate once its podSelector matches no
+// pod; policies selecting every pod of the namespace, like a default deny,
+// are always kept. The candidates are then decided by --delete-networkpolicy-if,
+// or by their name carrying the prefix of an instance that is gone.
+func decideNetworkPolicy(policy networkingv1.NetworkPolicy, podPrefixes []string, pods []v1.Pod, opts options) (bool, string) {
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil {
+		return false, fmt.Sprintf("invalid podSelector: %v", err)
+	}
+	if selector.Empty() {
+		return false, "applies to all pods of the namespace"
+	}
+	for _, pod := range pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return false, "selects pod/" + pod.Name
+		}
+	}
+	return orphanedNetworkPolicy(policy, podPrefixes, opts)
+}
+
+func orphanedNetworkPolicy(policy networkingv1.NetworkPolicy, podPrefixes []string, opts options) (bool, string) {
+	if opts.deleteNetworkPolicyIf != nil {
+		return evalDeleteIf(opts.deleteNetworkPolicyIf, "--delete-networkpolicy-if", networkPolicyVariables(policy, podPrefixes))
+	}
+	match := opts.podNamePattern.FindStringSubmatch(policy.Name)
+	if match == nil || match[1] == "" {
+		return false, "not named after an instance"
+	}
+	for _, prefix := range podPrefixes {
+		if prefix == match[1] {
+			return false, fmt.Sprintf("matches pod prefix %s", prefix)
+		}
+	}
+	return true, orphanedReason
+}
+
+// networkPolicyVariables are the variables of --delete-networkpolicy-if.
+func networkPolicyVariables(policy networkingv1.NetworkPolicy, podPrefixes []string) map[string]interface{} {
+	object := objectVariables(policy.ObjectMeta)
+	object["podSelector"] = stringMap(policy.Spec.PodSelector.MatchLabels)
+	return map[string]interface{}{"networkPolicy": object, "object": object, "prefixes": stringList(podPrefixes)}
+}
+
+// networkPolicyCleaner cleans up the orphaned NetworkPolicies of a
+// namespace.
+type networkPolicyCleaner struct {
+	clientset   kubernetes.Interface
+	podPrefixes []string
+	namespace   string
+	opts        options
+	pods        []v1.Pod
+}
+
+func newNetworkPolicyCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &networkPolicyCleaner{clientset: clientset, podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+func (c *networkPolicyCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	policies, err := c.clientset.NetworkingV1().NetworkPolicies(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing networkpolicies: %v", err)
+	}
+	if c.pods, err = listPods(ctx, c.clientset, c.namespace); err != nil {
+		return nil, fmt.Errorf("Error listing pods: %v", err)
+	}
+	objects := make([]CleanupObject, 0, len(policies.Items))
+	for _, policy := range policies.Items {
+		policy := policy
+		objects = append(objects, CleanupObject{
+			Kind:   "NetworkPolicy",
+			Meta:   policy.ObjectMeta,
+			Object: policy,
+			Export: func() interface{} { return exportableNetworkPolicy(policy) },
+			Backup: func() interface{} { return backupNetworkPolicy(policy) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *networkPolicyCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decideNetworkPolicy(obj.Object.(networkingv1.NetworkPolicy), c.podPrefixes, c.pods, c.opts)
+	return shouldDelete, reason, nil
+}
+
+func (c *networkPolicyCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	return c.clientset.NetworkingV1().NetworkPolicies(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *networkPolicyCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "NetworkPolicy", reason, err)
+}
+
+// backupNetworkPolicy returns the NetworkPolicy as stored in backups.
+func backupNetworkPolicy(policy networkingv1.NetworkPolicy) *networkingv1.NetworkPolicy {
+	backup := policy.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// exportableNetworkPolicy strips the server populated fields of a
+// NetworkPolicy.
+func exportableNetworkPolicy(policy networkingv1.NetworkPolicy) *networkingv1.NetworkPolicy {
+	exported := policy.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	return exported
+}
@@ -0,0 +1,175 @@
+package cleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Events notifications are sent for.
+const (
+	notifyRun      = "run"
+	notifyDeletion = "deletion"
+)
+
+// notification is the data passed to the notification sinks, and to the
+// templates of generic webhooks.
+type notification struct {
+	Event string `json:"event"`
+	RunID string `json:"runId"`
+	// Text is a human readable rendition of the notification.
+	Text     string         `json:"text"`
+	Decision *decision      `json:"decision,omitempty"`
+	Summary  *summaryTotals `json:"summary,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// notificationSink delivers notifications somewhere.
+type notificationSink interface {
+	notify(n notification) error
+}
+
+// notifyClient posts the notifications. A slow endpoint must not hold up the
+// cleanup for long.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// postWebhook posts body to url and checks the response status.
+func postWebhook(url, contentType string, body []byte) error {
+	resp, err := notifyClient.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		// The URL is left out as webhook URLs often embed their credentials
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Chat services notifications can be posted to.
+const (
+	chatSlack = "slack"
+	chatTeams = "teams"
+)
+
+// chatWebhook is an incoming webhook of a chat service.
+type chatWebhook struct {
+	service string
+	url     string
+}
+
+func (c chatWebhook) notify(n notification) error {
+	var payload interface{}
+	switch c.service {
+	case chatTeams:
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"text":     n.Text,
+		}
+	default:
+		payload = map[string]string{"text": n.Text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postWebhook(c.url, "application/json", body)
+}
+
+// defaultWebhookTemplate posts the notification as JSON.
+const defaultWebhookTemplate = "{{ json . }}"
+
+// templateWebhook posts the output of a Go template executed on the
+// notification, to integrate with arbitrary HTTP endpoints.
+type templateWebhook struct {
+	url         string
+	contentType string
+	tmpl        *template.Template
+}
+
+// parseWebhookTemplate parses the template in file, or the default template
+// when file is empty. Besides the standard functions, templates can use json
+// to encode a value.
+func parseWebhookTemplate(file string) (*template.Template, error) {
+	text := defaultWebhookTemplate
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+func (t templateWebhook) notify(n notification) error {
+	var body bytes.Buffer
+	if err := t.tmpl.Execute(&body, n); err != nil {
+		return fmt.Errorf("error executing webhook template: %v", err)
+	}
+	return postWebhook(t.url, t.contentType, body.Bytes())
+}
+
+// notifier notifies the sinks of the end of every run, and optionally of
+// every deletion. Failing to notify never fails the run.
+type notifier struct {
+	sinks     []notificationSink
+	deletions bool
+	runID     string
+}
+
+func (n *notifier) send(msg notification) {
+	msg.RunID = n.runID
+	for _, sink := range n.sinks {
+		if err := sink.notify(msg); err != nil {
+			logger.Warn("Error sending notification", "event", msg.Event, "error", err)
+		}
+	}
+}
+
+func (n *notifier) record(d decision) {
+	if !n.deletions || d.Action != actionDelete {
+		return
+	}
+	dryRun := ""
+	if d.DryRun {
+		dryRun = " (dry run)"
+	}
+	n.send(notification{
+		Event:    notifyDeletion,
+		Text:     fmt.Sprintf("Deleted %s %s/%s%s as it is %s", strings.ToLower(d.Kind), d.Namespace, d.Name, dryRun, d.Reason),
+		Decision: &d,
+	})
+}
+
+// runDone sends the summary of the run.
+func (n *notifier) runDone(summary *runSummary, err error) {
+	if n == nil {
+		return
+	}
+	totals := summary.snapshot()
+	msg := notification{
+		Event:   notifyRun,
+		Text:    "orphaned-secrets-deleter run " + n.runID + " finished: " + totals.headline(),
+		Summary: &totals,
+	}
+	if err != nil {
+		msg.Text += "\nThe run failed: " + err.Error()
+		msg.Error = err.Error()
+	}
+	n.send(msg)
+}
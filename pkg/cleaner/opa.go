@@ -0,0 +1,105 @@
+package cleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// opaPolicy asks an Open Policy Agent server whether the cleaner may delete a
+// candidate. The Rego policy bundle is loaded by the OPA server, typically a
+// sidecar started with --bundle, so security teams govern the cleanup
+// centrally without rebuilding the cleaner. The policy is queried through the
+// OPA Data API with the candidate and the context of the run as input, and
+// returns an object such as {"delete": false, "reason": "..."}.
+type opaPolicy struct {
+	// url is the Data API endpoint of the decision, e.g.
+	// http://localhost:8181/v1/data/orphancleaner/decision.
+	url    string
+	client *http.Client
+}
+
+func newOPAPolicy(url string, timeout time.Duration) *opaPolicy {
+	return &opaPolicy{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// opaObject describes the candidate to the policy. The data of secrets is
+// never sent.
+type opaObject struct {
+	Kind     string            `json:"kind"`
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Type     string            `json:"type,omitempty"`
+}
+
+// opaInput is the input document of the policy.
+type opaInput struct {
+	Object opaObject `json:"object"`
+	// Reason is why the cleaner considers the object orphaned.
+	Reason   string   `json:"reason"`
+	Prefixes []string `json:"prefixes"`
+	RunID    string   `json:"runId"`
+	DryRun   bool     `json:"dryRun"`
+}
+
+type opaResult struct {
+	Delete *bool `json:"delete"`
+	// Reason explains a denial.
+	Reason string `json:"reason"`
+}
+
+// allows queries the policy about a candidate. A policy that is undefined for
+// the input, or fails to answer, keeps the object.
+func (p *opaPolicy) allows(ctx context.Context, input opaInput) (bool, string) {
+	if p == nil {
+		return true, input.Reason
+	}
+	result, err := p.query(ctx, input)
+	if err != nil {
+		return false, fmt.Sprintf("error querying the OPA policy: %v", err)
+	}
+	if result == nil || result.Delete == nil {
+		return false, "OPA policy undefined"
+	}
+	if !*result.Delete {
+		if result.Reason == "" {
+			return false, "denied by the OPA policy"
+		}
+		return false, "denied by the OPA policy: " + result.Reason
+	}
+	return true, input.Reason
+}
+
+func (p *opaPolicy) query(ctx context.Context, input opaInput) (*opaResult, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("OPA returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var response struct {
+		Result *opaResult `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid OPA response: %v", err)
+	}
+	return response.Result, nil
+}
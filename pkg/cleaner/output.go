@@ -0,0 +1,170 @@
+package cleaner
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Supported values of the --output flag.
+const (
+	outputTable  = "table"
+	outputText   = "text"
+	outputScript = "script"
+	outputYAML   = "yaml"
+	outputJSON   = "json"
+)
+
+func validateOutput(output string) error {
+	switch output {
+	case outputTable, outputText, outputScript, outputYAML, outputJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, must be one of %s, %s, %s, %s or %s", output, outputTable, outputText, outputScript, outputYAML, outputJSON)
+}
+
+// Supported values of the --log-format flag.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// levelDeletion is the level of the messages announcing a deletion. It sits
+// between info and warn so that --quiet keeps reporting deletions.
+const levelDeletion = slog.LevelInfo + 2
+
+// logOutput receives the progress messages. It is switched to stderr when
+// stdout carries a machine-consumable output format.
+var logOutput io.Writer = os.Stdout
+
+// logger reports progress. Messages carry the namespace, resource and action
+// they refer to as separate fields.
+var logger = newLogger(slog.LevelInfo, logFormatText)
+
+// structuredLogs is set when the log messages are machine-readable, and must
+// not be interleaved with free-form text.
+var structuredLogs bool
+
+// logWriter forwards to logOutput, which commands may switch after the logger
+// has been set up.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return logOutput.Write(p)
+}
+
+func newLogger(level slog.Level, format string) *slog.Logger {
+	handlerOptions := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == levelDeletion {
+				a.Value = slog.StringValue("DELETE")
+			}
+			return a
+		},
+	}
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(logWriter{}, handlerOptions))
+	}
+	return slog.New(slog.NewTextHandler(logWriter{}, handlerOptions))
+}
+
+// setupLogger configures the logger from the --log-level and --log-format
+// flags. --verbose and --quiet are shorthands for the debug level and for
+// only reporting deletions, warnings and errors.
+func setupLogger(level, format string, verbose, quiet bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Invalid --log-level: %v", err)
+	}
+	switch {
+	case verbose && quiet:
+		return fmt.Errorf("--verbose and --quiet cannot be combined")
+	case verbose:
+		l = slog.LevelDebug
+	case quiet:
+		l = levelDeletion
+	}
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("Invalid --log-format: unknown format %q, must be %s or %s", format, logFormatText, logFormatJSON)
+	}
+	logger = newLogger(l, format)
+	structuredLogs = format == logFormatJSON
+	return nil
+}
+
+// scriptWriter emits a shell script with a kubectl command per candidate
+// deletion, for teams that cannot grant the tool delete permissions.
+type scriptWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newScriptWriter(w io.Writer) *scriptWriter {
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintln(w, "# Generated by orphaned-secrets-deleter")
+	fmt.Fprintln(w, "set -e")
+	return &scriptWriter{w: w}
+}
+
+func (s *scriptWriter) delete(kind, namespace, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if namespace == "" {
+		fmt.Fprintf(s.w, "kubectl delete %s %s\n", kind, shellQuote(name))
+		return
+	}
+	fmt.Fprintf(s.w, "kubectl delete %s %s --namespace %s\n", kind, shellQuote(name), shellQuote(namespace))
+}
+
+// reclaimVolume writes the command making the provisioner delete a volume.
+func (s *scriptWriter) reclaimVolume(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "kubectl patch persistentvolume %s --type merge --patch '{\"spec\":{\"persistentVolumeReclaimPolicy\":\"Delete\"}}'\n", shellQuote(name))
+}
+
+// manifestWriter exports the manifests of the orphans for out-of-band review,
+// either as a multi-document YAML stream or as one file per object.
+type manifestWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	dir string
+}
+
+func newManifestWriter(w io.Writer, dir string) *manifestWriter {
+	return &manifestWriter{w: w, dir: dir}
+}
+
+func (m *manifestWriter) add(kind, namespace, name string, obj interface{}) error {
+	if m.dir != "" {
+		return exportManifest(filepath.Join(m.dir, strings.ToLower(kind)), namespace, name, obj)
+	}
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding %s %s/%s: %v", kind, namespace, name, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = fmt.Fprintf(m.w, "---\n%s", data)
+	return err
+}
+
+// shellQuote quotes s for use as a single POSIX shell word.
+func shellQuote(s string) string {
+	quoted := "'"
+	for _, r := range s {
+		if r == '\'' {
+			quoted += `'\''`
+		} else {
+			quoted += string(r)
+		}
+	}
+	return quoted + "'"
+}
@@ -0,0 +1,135 @@
+package cleaner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// cleanupPolicyResource is the namespaced OrphanCleanupPolicy custom resource
+// defined in manifests/orphancleanuppolicy-crd.yaml.
+var cleanupPolicyResource = schema.GroupVersionResource{
+	Group:    "orphan-cleaner.cloud.timescale.com",
+	Version:  "v1alpha1",
+	Resource: "orphancleanuppolicies",
+}
+
+// cleanupPolicySpec lets a team adjust the cleanup of its namespace. Unset
+// fields keep the settings of the controller.
+type cleanupPolicySpec struct {
+	// SecretSelector replaces --secret-selector.
+	SecretSelector string `json:"secretSelector,omitempty"`
+	// Protect is added to the --protect patterns.
+	Protect []string `json:"protect,omitempty"`
+	// MinAge replaces --min-age.
+	MinAge string `json:"minAge,omitempty"`
+	// Resources lists the kinds to clean up, all of them by default.
+	Resources []string `json:"resources,omitempty"`
+	// DryRun only reports the orphans of the namespace. A policy cannot turn
+	// off the dry-run mode of the controller.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// Annotations a namespace overrides the settings of the cleaner with.
+const (
+	minAgeAnnotation  = "orphan-cleaner/min-age"
+	dryRunAnnotation  = "orphan-cleaner/dry-run"
+	protectAnnotation = "orphan-cleaner/protect"
+)
+
+// annotationPolicy returns the settings a namespace overrides with its
+// annotations, in the form of a policy. The protect annotation holds a comma
+// separated list of patterns.
+func annotationPolicy(annotations map[string]string) (cleanupPolicySpec, error) {
+	spec := cleanupPolicySpec{MinAge: annotations[minAgeAnnotation]}
+	if value, ok := annotations[dryRunAnnotation]; ok {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			return spec, fmt.Errorf("invalid %s annotation: %v", dryRunAnnotation, err)
+		}
+		spec.DryRun = dryRun
+	}
+	for _, pattern := range strings.Split(annotations[protectAnnotation], ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			spec.Protect = append(spec.Protect, pattern)
+		}
+	}
+	return spec, nil
+}
+
+// namespaceOptions returns the options for a namespace after applying the
+// overrides of its annotations.
+func namespaceOptions(opts options, namespace v1.Namespace) (options, error) {
+	spec, err := annotationPolicy(namespace.Annotations)
+	if err == nil {
+		opts, _, err = applyPolicy(opts, spec)
+	}
+	if err != nil {
+		return opts, fmt.Errorf("invalid annotations on namespace %s: %v", namespace.Name, err)
+	}
+	return opts, nil
+}
+
+// applyPolicy returns the options and scope for a namespace with the given
+// policy.
+func applyPolicy(opts options, spec cleanupPolicySpec) (options, cleanupScope, error) {
+	scope := fullScope()
+	if spec.SecretSelector != "" {
+		if _, err := labels.Parse(spec.SecretSelector); err != nil {
+			return opts, scope, fmt.Errorf("invalid secretSelector: %v", err)
+		}
+		opts.secretListOptions.LabelSelector = spec.SecretSelector
+	}
+	if len(spec.Protect) > 0 {
+		protected := make([]namePattern, 0, len(opts.protected)+len(spec.Protect))
+		protected = append(protected, opts.protected...)
+		for _, value := range spec.Protect {
+			pattern, err := parseNamePattern(value)
+			if err != nil {
+				return opts, scope, fmt.Errorf("invalid protect pattern %q: %v", value, err)
+			}
+			protected = append(protected, pattern)
+		}
+		opts.protected = protected
+	}
+	if spec.MinAge != "" {
+		minAge, err := time.ParseDuration(spec.MinAge)
+		if err != nil {
+			return opts, scope, fmt.Errorf("invalid minAge: %v", err)
+		}
+		opts.minAge = minAge
+	}
+	if len(spec.Resources) > 0 {
+		var err error
+		if scope, err = parseResources(spec.Resources); err != nil {
+			return opts, fullScope(), err
+		}
+	}
+	opts.dryRun = opts.dryRun || spec.DryRun
+	return opts, scope, nil
+}
+
+// selectPolicy picks the policy of a namespace among the OrphanCleanupPolicy
+// objects found in it. Only one is supposed to exist; when there are more,
+// the first by name wins.
+func selectPolicy(objects []*unstructured.Unstructured) (string, cleanupPolicySpec, error) {
+	var spec cleanupPolicySpec
+	if len(objects) == 0 {
+		return "", spec, nil
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].GetName() < objects[j].GetName() })
+	policy := objects[0]
+	if len(objects) > 1 {
+		logger.Warn("Several cleanup policies found, using the first one", "namespace", policy.GetNamespace(), "policy", policy.GetName())
+	}
+	raw, _, _ := unstructured.NestedMap(policy.Object, "spec")
+	err := fromUnstructuredMap(raw, &spec)
+	return policy.GetName(), spec, err
+}
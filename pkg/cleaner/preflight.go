@@ -0,0 +1,239 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// permission is an access to the API a run needs.
+type permission struct {
+	verb     string
+	resource schema.GroupResource
+	// clusterScoped permissions are checked once, outside of the namespaces.
+	clusterScoped bool
+	// namespace is set for the permissions needed in a single namespace,
+	// whatever the namespaces cleaned up.
+	namespace string
+	// modifies is set for the permissions read-only runs do without.
+	modifies bool
+}
+
+func (p permission) String() string {
+	return p.verb + " " + p.resource.String()
+}
+
+// resourcePermissions are the accesses of the cleaner of each kind: listing
+// and deleting the objects it cleans up, and reading the objects telling
+// what is still in use. The preflight checks them and generate rbac grants
+// them, so both follow what the cleaners do.
+var resourcePermissions = map[string][]permission{
+	resourceSecrets: {
+		{verb: "list", resource: schema.GroupResource{Resource: "secrets"}},
+		// completeSecret gets every candidate again before deleting it
+		{verb: "get", resource: schema.GroupResource{Resource: "secrets"}},
+		{verb: "delete", resource: schema.GroupResource{Resource: "secrets"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+		{verb: "list", resource: schema.GroupResource{Resource: "serviceaccounts"}},
+		{verb: "list", resource: schema.GroupResource{Group: "networking.k8s.io", Resource: "ingresses"}},
+		{verb: "list", resource: gatewayResources[0].GroupResource()},
+		{verb: "list", resource: referenceGrantResources[0].GroupResource()},
+		{verb: "list", resource: certificateResources[0].GroupResource()},
+		{verb: "list", resource: secretProviderClassResources[0].GroupResource()},
+		{verb: "list", resource: schema.GroupResource{Resource: "persistentvolumes"}, clusterScoped: true},
+		{verb: "list", resource: schema.GroupResource{Group: "storage.k8s.io", Resource: "storageclasses"}, clusterScoped: true},
+		// The secrets of the StorageClasses named after the claims
+		{verb: "list", resource: schema.GroupResource{Resource: "persistentvolumeclaims"}},
+	},
+	resourceServices: {
+		{verb: "list", resource: schema.GroupResource{Resource: "services"}},
+		{verb: "delete", resource: schema.GroupResource{Resource: "services"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+		{verb: "list", resource: schema.GroupResource{Group: "discovery.k8s.io", Resource: "endpointslices"}},
+	},
+	resourceEndpoints: {
+		{verb: "list", resource: schema.GroupResource{Group: "discovery.k8s.io", Resource: "endpointslices"}},
+		{verb: "delete", resource: schema.GroupResource{Group: "discovery.k8s.io", Resource: "endpointslices"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "endpoints"}},
+		{verb: "delete", resource: schema.GroupResource{Resource: "endpoints"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+		{verb: "list", resource: schema.GroupResource{Resource: "services"}},
+	},
+	resourceConfigMaps: {
+		{verb: "list", resource: schema.GroupResource{Resource: "configmaps"}},
+		{verb: "delete", resource: schema.GroupResource{Resource: "configmaps"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+	},
+	resourcePVCs: {
+		{verb: "list", resource: schema.GroupResource{Resource: "persistentvolumeclaims"}},
+		{verb: "delete", resource: schema.GroupResource{Resource: "persistentvolumeclaims"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+		{verb: "list", resource: schema.GroupResource{Group: "apps", Resource: "statefulsets"}},
+	},
+	resourceServiceAccounts: {
+		{verb: "list", resource: schema.GroupResource{Resource: "serviceaccounts"}},
+		{verb: "delete", resource: schema.GroupResource{Resource: "serviceaccounts"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+		{verb: "list", resource: schema.GroupResource{Group: "apps", Resource: "statefulsets"}},
+		{verb: "list", resource: schema.GroupResource{Group: "apps", Resource: "deployments"}},
+		// The bindings of all namespaces are searched for the accounts
+		{verb: "list", resource: schema.GroupResource{Group: rbacv1.GroupName, Resource: "rolebindings"}, clusterScoped: true},
+		{verb: "list", resource: schema.GroupResource{Group: rbacv1.GroupName, Resource: "clusterrolebindings"}, clusterScoped: true},
+	},
+	resourceNetworkPolicies: {
+		{verb: "list", resource: schema.GroupResource{Group: "networking.k8s.io", Resource: "networkpolicies"}},
+		{verb: "delete", resource: schema.GroupResource{Group: "networking.k8s.io", Resource: "networkpolicies"}, modifies: true},
+		{verb: "list", resource: schema.GroupResource{Resource: "pods"}},
+	},
+	resourceJobs: {
+		{verb: "list", resource: schema.GroupResource{Group: "batch", Resource: "jobs"}},
+		{verb: "delete", resource: schema.GroupResource{Group: "batch", Resource: "jobs"}, modifies: true},
+	},
+	resourceHPAs: {
+		{verb: "list", resource: schema.GroupResource{Group: "autoscaling", Resource: "horizontalpodautoscalers"}},
+		{verb: "delete", resource: schema.GroupResource{Group: "autoscaling", Resource: "horizontalpodautoscalers"}, modifies: true},
+		{verb: "get", resource: schema.GroupResource{Group: "apps", Resource: "deployments"}},
+		{verb: "get", resource: schema.GroupResource{Group: "apps", Resource: "statefulsets"}},
+		{verb: "get", resource: schema.GroupResource{Group: "apps", Resource: "replicasets"}},
+		{verb: "get", resource: schema.GroupResource{Resource: "replicationcontrollers"}},
+	},
+}
+
+// requiredPermissions returns the permissions a run with the options needs:
+// listing what the prefixes are gathered from, and the resourcePermissions
+// of the kinds cleaned up, those deleting only unless the run is read-only.
+func requiredPermissions(opts options, allNamespaces bool) []permission {
+	var perms []permission
+	seen := map[permission]bool{}
+	grant := func(p permission) {
+		// Several cleaners read the same objects
+		if !seen[p] {
+			seen[p] = true
+			perms = append(perms, p)
+		}
+	}
+	add := func(resource schema.GroupResource, clusterScoped bool, verbs ...string) {
+		for _, verb := range verbs {
+			grant(permission{verb: verb, resource: resource, clusterScoped: clusterScoped})
+		}
+	}
+	modify := []string{"list", "delete"}
+	if opts.readOnly() {
+		modify = []string{"list"}
+	}
+
+	if allNamespaces && opts.namespaceList == nil {
+		add(schema.GroupResource{Resource: "namespaces"}, true, "list")
+	} else {
+		add(schema.GroupResource{Resource: "namespaces"}, true, "get")
+	}
+	if opts.prefixSource == prefixSourcePods || opts.prefixSource == prefixSourceAll {
+		add(schema.GroupResource{Resource: "pods"}, false, "list")
+	}
+	if opts.prefixSource == prefixSourceWorkloads || opts.prefixSource == prefixSourceAll {
+		add(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, false, "list")
+		add(schema.GroupResource{Group: "apps", Resource: "deployments"}, false, "list")
+	}
+	for _, name := range resourceNames() {
+		if !opts.resources[name] {
+			continue
+		}
+		for _, p := range resourcePermissions[name] {
+			if !p.modifies || !opts.readOnly() {
+				grant(p)
+			}
+		}
+	}
+	if opts.resources[resourceRules] {
+		for _, rule := range opts.rules {
+			add(rule.gvr.GroupResource(), rule.Scope == ruleScopeCluster, modify...)
+			for _, ref := range rule.References {
+				add(schema.GroupResource{Group: ref.Group, Resource: ref.Resource}, rule.Scope == ruleScopeCluster, "list")
+			}
+		}
+	}
+	if opts.resources[resourceSecrets] && opts.mutates() && (opts.batchDelete || opts.markGrace > 0 || opts.quarantineDir != "") {
+		add(schema.GroupResource{Resource: "secrets"}, false, "patch")
+	}
+	if opts.resources[resourceSecrets] && opts.mutates() && opts.batchDelete {
+		add(schema.GroupResource{Resource: "secrets"}, false, "deletecollection")
+	}
+	if allNamespaces && opts.releasedVolumes != "" {
+		add(schema.GroupResource{Resource: "persistentvolumes"}, true, "list")
+		if !opts.readOnly() {
+			// The released volumes are annotated in both modes
+			add(schema.GroupResource{Resource: "persistentvolumes"}, true, "patch")
+			if opts.releasedVolumes == releasedVolumesDelete {
+				add(schema.GroupResource{Resource: "persistentvolumes"}, true, "delete")
+			}
+		}
+	}
+	return perms
+}
+
+// preflight checks with SelfSubjectAccessReviews that the run is granted
+// the permissions in the namespaces, all of them for "", so it fails right
+// away instead of halfway through.
+func preflight(ctx context.Context, clientset kubernetes.Interface, namespaces []string, perms []permission) error {
+	var missing []string
+	check := func(namespace string, p permission) error {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      p.verb,
+					Group:     p.resource.Group,
+					Resource:  p.resource.Resource,
+				},
+			},
+		}
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{FieldManager: fieldManager})
+		if err != nil {
+			return fmt.Errorf("Error checking the permission to %s: %v", p, err)
+		}
+		if !review.Status.Allowed {
+			switch {
+			case p.clusterScoped:
+				missing = append(missing, p.String())
+			case namespace == "":
+				missing = append(missing, p.String()+" in all namespaces")
+			default:
+				missing = append(missing, p.String()+" in namespace "+namespace)
+			}
+		}
+		return nil
+	}
+
+	for _, p := range perms {
+		if p.clusterScoped || p.namespace != "" {
+			if err := check(p.namespace, p); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, namespace := range namespaces {
+			if err := check(namespace, p); err != nil {
+				return err
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return missingPermissionsError{missing: missing}
+	}
+	return nil
+}
+
+// missingPermissionsError lists the permissions the run lacks.
+type missingPermissionsError struct {
+	missing []string
+}
+
+func (e missingPermissionsError) Error() string {
+	return fmt.Sprintf("Missing permissions, nothing was done (skip this check with --preflight=false):\n  %s", strings.Join(e.missing, "\n  "))
+}
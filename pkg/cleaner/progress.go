@@ -0,0 +1,121 @@
+package cleaner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported values of the --progress flag.
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressLog  = "log"
+	progressNone = "none"
+)
+
+// progressBarWidth is the number of characters of the progress bar.
+const progressBarWidth = 30
+
+// progressReporter reports how far a run over all namespaces has come, either
+// as a progress bar redrawn in place on a terminal, or as a log message every
+// interval otherwise. It is safe for concurrent use, and its methods do nothing
+// on a nil reporter.
+type progressReporter struct {
+	mu         sync.Mutex
+	bar        bool
+	w          io.Writer
+	interval   time.Duration
+	start      time.Time
+	lastLog    time.Time
+	total      int
+	done       int
+	candidates int
+}
+
+// newProgressReporter returns a reporter for the given mode, or nil when
+// progress should not be reported.
+func newProgressReporter(mode string, interval time.Duration) (*progressReporter, error) {
+	switch mode {
+	case progressNone:
+		return nil, nil
+	case progressBar:
+		return &progressReporter{bar: true, w: os.Stderr}, nil
+	case progressLog:
+		return &progressReporter{interval: interval}, nil
+	case progressAuto:
+		if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return &progressReporter{bar: true, w: os.Stderr}, nil
+		}
+		return &progressReporter{interval: interval}, nil
+	}
+	return nil, fmt.Errorf("unknown progress mode %q, must be one of %s, %s, %s or %s", mode, progressAuto, progressBar, progressLog, progressNone)
+}
+
+// begin starts reporting on a run over total namespaces.
+func (p *progressReporter) begin(total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+	p.start = time.Now()
+	p.lastLog = p.start
+}
+
+// record counts the orphans found so far.
+func (p *progressReporter) record(d decision) {
+	if d.Action == actionKeep || d.Action == actionError {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.candidates++
+}
+
+// namespaceDone advances the progress by one namespace.
+func (p *progressReporter) namespaceDone() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.bar {
+		p.draw()
+	} else if time.Since(p.lastLog) >= p.interval || p.done == p.total {
+		p.lastLog = time.Now()
+		logger.Info("Progress", "namespaces", p.done, "total", p.total, "candidates", p.candidates, "eta", p.eta().String())
+	}
+}
+
+// finish ends the progress bar line.
+func (p *progressReporter) finish() {
+	if p == nil || !p.bar {
+		return
+	}
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressReporter) draw() {
+	filled := progressBarWidth
+	if p.total > 0 {
+		filled = progressBarWidth * p.done / p.total
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(p.w, "\r[%s] %d/%d namespaces, %d candidates, ETA %s\x1b[K", bar, p.done, p.total, p.candidates, p.eta())
+}
+
+// eta extrapolates the remaining duration from the average time spent per
+// namespace so far.
+func (p *progressReporter) eta() time.Duration {
+	if p.done == 0 || p.done >= p.total {
+		return 0
+	}
+	perNamespace := time.Since(p.start) / time.Duration(p.done)
+	return (perNamespace * time.Duration(p.total-p.done)).Round(time.Second)
+}
@@ -0,0 +1,113 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultProtectPatterns are always applied in addition to any --protect flags.
+var defaultProtectPatterns = []string{
+	"*root*",
+}
+
+// namePattern matches object names either with a shell glob or, when the
+// pattern is prefixed with "regex:", with a regular expression.
+type namePattern struct {
+	raw  string
+	glob string
+	re   *regexp.Regexp
+}
+
+func parseNamePattern(raw string) (namePattern, error) {
+	if expr, ok := strings.CutPrefix(raw, "regex:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return namePattern{}, fmt.Errorf("invalid regex pattern %q: %v", raw, err)
+		}
+		return namePattern{raw: raw, re: re}, nil
+	}
+	if _, err := path.Match(raw, ""); err != nil {
+		return namePattern{}, fmt.Errorf("invalid glob pattern %q: %v", raw, err)
+	}
+	return namePattern{raw: raw, glob: raw}, nil
+}
+
+func (p namePattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+func (p namePattern) String() string {
+	return p.raw
+}
+
+// compileProtectPatterns parses the built-in defaults followed by the user
+// supplied patterns.
+func compileProtectPatterns(extra []string) ([]namePattern, error) {
+	var patterns []namePattern
+	for _, raw := range append(append([]string{}, defaultProtectPatterns...), extra...) {
+		p, err := parseNamePattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// matchProtected returns the first pattern matching name.
+func matchProtected(patterns []namePattern, name string) (namePattern, bool) {
+	for _, p := range patterns {
+		if p.Match(name) {
+			return p, true
+		}
+	}
+	return namePattern{}, false
+}
+
+// withProtectConfigMap returns the options with the patterns of the
+// --protect-from-configmap ConfigMap added to the protected ones. The
+// ConfigMap is read again on every call, so the list can be updated without
+// redeploying.
+func (o options) withProtectConfigMap(ctx context.Context, clientset kubernetes.Interface) (options, error) {
+	if o.protectConfigMap == "" {
+		return o, nil
+	}
+	namespace, name, _ := strings.Cut(o.protectConfigMap, "/")
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return o, fmt.Errorf("error reading protected patterns from ConfigMap %s: %v", o.protectConfigMap, err)
+	}
+	// Every value holds patterns, one per line
+	keys := make([]string, 0, len(configMap.Data))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	protected := append([]namePattern{}, o.protected...)
+	for _, key := range keys {
+		for _, line := range strings.Split(configMap.Data[key], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			p, err := parseNamePattern(line)
+			if err != nil {
+				return o, fmt.Errorf("invalid pattern in ConfigMap %s: %v", o.protectConfigMap, err)
+			}
+			protected = append(protected, p)
+		}
+	}
+	o.protected = protected
+	return o, nil
+}
@@ -0,0 +1,171 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PersistentVolumeClaims hold the data of an instance, so their cleanup is
+// off by default and waits much longer than the other kinds: a claim is only
+// deleted when no pod mounts it, no StatefulSet would reattach it on scale up,
+// its instance is gone and it is older than --pvc-min-age.
+
+// instancePrefix returns the prefix of the instance a name refers to. The pod
+// name pattern is tried at the start of the name and after each dash, as
+// StatefulSets name their claims "<template>-<pod name>".
+func instancePrefix(name string, podNamePattern *regexp.Regexp) (string, bool) {
+	for i := 0; i < len(name); i++ {
+		if i > 0 && name[i-1] != '-' {
+			continue
+		}
+		if match := podNamePattern.FindStringSubmatch(name[i:]); match != nil && match[1] != "" {
+			return match[1], true
+		}
+	}
+	return "", false
+}
+
+// statefulSetClaim returns the StatefulSet that would mount a claim named
+// "<template>-<statefulset>-<ordinal>", if any.
+func statefulSetClaim(name string, statefulSets []appsv1.StatefulSet) (string, bool) {
+	for _, sts := range statefulSets {
+		for _, template := range sts.Spec.VolumeClaimTemplates {
+			if strings.HasPrefix(name, template.Name+"-"+sts.Name+"-") {
+				return sts.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// decidePVC decides whether a PersistentVolumeClaim is orphaned, and explains
+// why. Owned claims are kept even with --include-owned.
+func decidePVC(pvc v1.PersistentVolumeClaim, podPrefixes []string, mounted map[string]string, statefulSets []appsv1.StatefulSet, opts options) (bool, string) {
+	if pod, ok := mounted[pvc.Name]; ok {
+		return false, "mounted by pod/" + pod
+	}
+	if sts, ok := statefulSetClaim(pvc.Name, statefulSets); ok {
+		return false, "claim of statefulset/" + sts
+	}
+	// The StatefulSet retention policy deletes the claims it owns
+	if len(pvc.OwnerReferences) > 0 {
+		return false, "has ownerReferences"
+	}
+	if age := time.Since(pvc.CreationTimestamp.Time); age < opts.pvcMinAge {
+		return false, fmt.Sprintf("younger than the minimum PVC age of %s", opts.pvcMinAge)
+	}
+	prefix, ok := instancePrefix(pvc.Name, opts.podNamePattern)
+	if !ok {
+		return false, "not named after an instance"
+	}
+	for _, podPrefix := range podPrefixes {
+		if podPrefix == prefix {
+			return false, fmt.Sprintf("matches pod prefix %s", prefix)
+		}
+	}
+	return true, orphanedReason
+}
+
+// pvcCleaner cleans up the orphaned PersistentVolumeClaims of a namespace.
+type pvcCleaner struct {
+	clientset    kubernetes.Interface
+	podPrefixes  []string
+	namespace    string
+	opts         options
+	mounted      map[string]string
+	statefulSets []appsv1.StatefulSet
+}
+
+func newPVCCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &pvcCleaner{clientset: clientset, podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+func (c *pvcCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	pvcs, err := c.clientset.CoreV1().PersistentVolumeClaims(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing persistentvolumeclaims: %v", err)
+	}
+	pods, err := listPods(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing pods: %v", err)
+	}
+	c.mounted = map[string]string{}
+	for _, pod := range pods {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				c.mounted[volume.PersistentVolumeClaim.ClaimName] = pod.Name
+			}
+		}
+	}
+	statefulSets, err := c.clientset.AppsV1().StatefulSets(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing statefulsets: %v", err)
+	}
+	c.statefulSets = statefulSets.Items
+
+	objects := make([]CleanupObject, 0, len(pvcs.Items))
+	for _, pvc := range pvcs.Items {
+		pvc := pvc
+		// The requested storage of the claim is recorded as its size
+		size := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+		objects = append(objects, CleanupObject{
+			Kind:   "PersistentVolumeClaim",
+			Meta:   pvc.ObjectMeta,
+			Size:   int(size.Value()),
+			Object: pvc,
+			Export: func() interface{} { return exportablePVC(pvc) },
+			Backup: func() interface{} { return backupPVC(pvc) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *pvcCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decidePVC(obj.Object.(v1.PersistentVolumeClaim), c.podPrefixes, c.mounted, c.statefulSets, c.opts)
+	return shouldDelete, reason, nil
+}
+
+// DecidesOwned is true as decidePVC keeps the owned claims whatever
+// --include-owned says.
+func (c *pvcCleaner) DecidesOwned() bool {
+	return true
+}
+
+func (c *pvcCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	return c.clientset.CoreV1().PersistentVolumeClaims(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *pvcCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "PVC", reason, err)
+}
+
+// backupPVC returns the claim as stored in backups. Only the manifest is
+// saved, not the data of the volume.
+func backupPVC(pvc v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
+	backup := pvc.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// exportablePVC strips the server populated fields of a claim. The volume
+// name is kept, so that a restored claim binds the retained volume again once
+// its claimRef is cleared.
+func exportablePVC(pvc v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
+	exported := pvc.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	exported.Status = v1.PersistentVolumeClaimStatus{}
+	return exported
+}
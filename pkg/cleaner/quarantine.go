@@ -0,0 +1,81 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Annotations added to a secret right before it is deleted in quarantine mode.
+const (
+	quarantinedAtAnnotation = "orphan-cleaner/quarantined-at"
+	reasonAnnotation        = "orphan-cleaner/reason"
+)
+
+// quarantineSecret annotates the secret with detection metadata and exports
+// the annotated manifest to <dir>/<namespace>/<name>.yaml, so the deletion that
+// follows can be undone with kubectl apply. The patched secret is returned as
+// its resourceVersion is needed for the delete preconditions. The patch itself
+// is conditional on the resourceVersion seen at list time.
+func quarantineSecret(ctx context.Context, clientset kubernetes.Interface, dir string, secret v1.Secret, reason string) (*v1.Secret, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": secret.ResourceVersion,
+			"annotations": map[string]string{
+				quarantinedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+				reasonAnnotation:        reason,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	patched, err := clientset.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := exportManifest(dir, patched.Namespace, patched.Name, exportableSecret(*patched)); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+// exportableSecret strips the server populated fields that would prevent the
+// manifest from being applied again.
+func exportableSecret(secret v1.Secret) *v1.Secret {
+	exported := secret.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	return exported
+}
+
+// exportManifest writes obj as YAML to <dir>/<namespace>/<name>.yaml. The files
+// can contain secret data, so they are only readable by the owner.
+func exportManifest(dir, namespace, name string, obj interface{}) error {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding %s/%s: %v", namespace, name, err)
+	}
+	nsDir := filepath.Join(dir, namespace)
+	if err := os.MkdirAll(nsDir, 0o700); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", nsDir, err)
+	}
+	path := filepath.Join(nsDir, name+".yaml")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package cleaner
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// rbacPermissions returns all the permissions a run with the options needs:
+// those checked by the preflight, and what the reporting settings read and
+// write.
+func rbacPermissions(opts options, allNamespaces bool) []permission {
+	perms := requiredPermissions(opts, allNamespaces)
+	if opts.protectConfigMap != "" {
+		namespace, _, _ := strings.Cut(opts.protectConfigMap, "/")
+		perms = append(perms, permission{verb: "get", resource: schema.GroupResource{Resource: "configmaps"}, namespace: namespace})
+	}
+	if opts.events && !opts.readOnly() {
+		perms = append(perms, permission{verb: "create", resource: schema.GroupResource{Resource: "events"}})
+	}
+	if opts.history != nil && !opts.dryRun {
+		for _, verb := range []string{"get", "create", "update"} {
+			perms = append(perms, permission{verb: verb, resource: schema.GroupResource{Resource: "configmaps"}, namespace: opts.history.namespace})
+		}
+	}
+	if opts.cleanupRun != nil {
+		perms = append(perms,
+			permission{verb: "create", resource: cleanupRunResource.GroupResource(), clusterScoped: true},
+			permission{verb: "update", resource: schema.GroupResource{Group: cleanupRunResource.Group, Resource: cleanupRunResource.Resource + "/status"}, clusterScoped: true},
+		)
+	}
+	return perms
+}
+
+// rbacSubject is the service account the manifests grant the permissions to.
+type rbacSubject struct {
+	name      string
+	namespace string
+}
+
+// rbacManifests returns the roles granting the permissions in the namespaces,
+// "" standing for all of them, and their bindings to the subject. Namespaced
+// permissions go to a Role per namespace, the others to a ClusterRole.
+func rbacManifests(name string, subject rbacSubject, namespaces []string, perms []permission) []interface{} {
+	cluster := map[schema.GroupResource]map[string]bool{}
+	namespaced := map[string]map[schema.GroupResource]map[string]bool{}
+	grant := func(rules map[schema.GroupResource]map[string]bool, p permission) {
+		if rules[p.resource] == nil {
+			rules[p.resource] = map[string]bool{}
+		}
+		rules[p.resource][p.verb] = true
+	}
+	grantIn := func(namespace string, p permission) {
+		if namespaced[namespace] == nil {
+			namespaced[namespace] = map[schema.GroupResource]map[string]bool{}
+		}
+		grant(namespaced[namespace], p)
+	}
+	for _, p := range perms {
+		switch {
+		case p.namespace != "":
+			grantIn(p.namespace, p)
+		case p.clusterScoped:
+			grant(cluster, p)
+		default:
+			for _, namespace := range namespaces {
+				if namespace == "" {
+					grant(cluster, p)
+				} else {
+					grantIn(namespace, p)
+				}
+			}
+		}
+	}
+
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: subject.name, Namespace: subject.namespace}}
+	var manifests []interface{}
+	if len(cluster) > 0 {
+		manifests = append(manifests,
+			&rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Rules:      policyRules(cluster),
+			},
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Subjects:   subjects,
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name},
+			},
+		)
+	}
+	sorted := make([]string, 0, len(namespaced))
+	for namespace := range namespaced {
+		sorted = append(sorted, namespace)
+	}
+	sort.Strings(sorted)
+	for _, namespace := range sorted {
+		manifests = append(manifests,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Rules:      policyRules(namespaced[namespace]),
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Subjects:   subjects,
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+			},
+		)
+	}
+	return manifests
+}
+
+// policyRules turns the verbs per resource into rules, one per API group and
+// set of verbs, sorted so the output is stable.
+func policyRules(verbs map[schema.GroupResource]map[string]bool) []rbacv1.PolicyRule {
+	type ruleKey struct{ group, verbs string }
+	byKey := map[ruleKey]*rbacv1.PolicyRule{}
+	var keys []ruleKey
+	for resource, set := range verbs {
+		list := make([]string, 0, len(set))
+		for verb := range set {
+			list = append(list, verb)
+		}
+		sort.Strings(list)
+		key := ruleKey{group: resource.Group, verbs: strings.Join(list, ",")}
+		rule, ok := byKey[key]
+		if !ok {
+			rule = &rbacv1.PolicyRule{APIGroups: []string{resource.Group}, Verbs: list}
+			byKey[key] = rule
+			keys = append(keys, key)
+		}
+		rule.Resources = append(rule.Resources, resource.Resource)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].verbs < keys[j].verbs
+	})
+	rules := make([]rbacv1.PolicyRule, 0, len(keys))
+	for _, key := range keys {
+		rule := byKey[key]
+		sort.Strings(rule.Resources)
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// writeManifests writes the objects as a multi-document YAML stream.
+func writeManifests(w io.Writer, manifests []interface{}) error {
+	for _, manifest := range manifests {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(manifest)
+		if err != nil {
+			return err
+		}
+		// Left unset, it would be written as null
+		unstructured.RemoveNestedField(obj, "metadata", "creationTimestamp")
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newGenerateCommand groups the commands generating manifests.
+func newGenerateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate manifests for deploying the cleaner",
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(newGenerateRBACCommand())
+	return cmd
+}
+
+// newGenerateRBACCommand prints the least privileged RBAC manifests for the
+// cleanup selected by the flags.
+func newGenerateRBACCommand() *cobra.Command {
+	var detect detectFlags
+	var clean cleanFlags
+	var name string
+	var subject rbacSubject
+	cmd := &cobra.Command{
+		Use:   "rbac",
+		Short: "Print the Roles, ClusterRole and bindings granting exactly what a cleanup with the same flags needs",
+		Long: `Print the Roles, ClusterRole and bindings granting exactly what a cleanup with
+the same flags needs, e.g.
+
+  orphaned-secrets-deleter generate rbac --namespace team-a --resources secrets,configmaps
+
+Namespaced permissions are granted by a Role in every namespace cleaned up, or
+by the ClusterRole with --all. The ClusterRole also holds the permissions on
+cluster scoped resources.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logOutput = detect.logDestination()
+			opts, err := detect.options()
+			if err != nil {
+				return err
+			}
+			if err := clean.apply(&opts); err != nil {
+				return err
+			}
+			if subject.namespace == "" {
+				subject.namespace = ownNamespace()
+			}
+			perms := rbacPermissions(opts, detect.allNamespaces)
+			manifests := rbacManifests(name, subject, detect.preflightNamespaces(opts), perms)
+			return writeManifests(cmd.OutOrStdout(), manifests)
+		},
+	}
+	detect.register(cmd.Flags())
+	clean.register(cmd.Flags())
+	cmd.Flags().StringVar(&name, "name", "orphaned-secrets-deleter", "Name of the roles and bindings")
+	cmd.Flags().StringVar(&subject.name, "service-account", "orphaned-secrets-deleter", "Name of the service account the cleaner runs as")
+	cmd.Flags().StringVar(&subject.namespace, "service-account-namespace", "", "Namespace of the service account. Defaults to the namespace the tool runs in")
+	return cmd
+}
@@ -0,0 +1,86 @@
+package cleaner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// TestRBACPermissionsCoverSecretsRun runs the secrets cleaner against fake
+// clients and checks that generate rbac grants every call it makes.
+func TestRBACPermissionsCoverSecretsRun(t *testing.T) {
+	tests := []struct {
+		name string
+		opts options
+	}{
+		{name: "delete", opts: options{}},
+		{name: "dry run", opts: options{dryRun: true}},
+		{name: "batch delete", opts: options{batchDelete: true, quarantineDir: "quarantine"}},
+		{name: "mark then sweep", opts: options{markGrace: time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+			meta := metav1.ObjectMeta{Name: "abcdefghij-certificate", Namespace: "team-a", UID: "1", ResourceVersion: "1", CreationTimestamp: created}
+			clientset := fake.NewSimpleClientset(&v1.Secret{ObjectMeta: meta})
+
+			scheme := metadatafake.NewTestScheme()
+			if err := metav1.AddMetaToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			metadata := metadatafake.NewSimpleMetadataClient(scheme, &metav1.PartialObjectMetadata{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: meta,
+			})
+			listKinds := map[schema.GroupVersionResource]string{}
+			for _, resources := range [][]schema.GroupVersionResource{gatewayResources, referenceGrantResources, certificateResources, secretProviderClassResources} {
+				for _, resource := range resources {
+					listKinds[resource] = "List"
+				}
+			}
+			dynamic := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+
+			opts := tt.opts
+			if opts.quarantineDir != "" {
+				opts.quarantineDir = t.TempDir()
+			}
+			opts.metadata = metadata
+			opts.dynamic = dynamic
+			opts.resources = cleanupScope{resourceSecrets: true}
+			opts.prefixSource = prefixSourcePods
+			opts.maxDeletionPercent = 100
+			opts.runID = "run"
+			if err := cleanupNamespace(context.Background(), clientset, []string{"klmnopqrst"}, "team-a", opts, opts.resources); err != nil {
+				t.Fatal(err)
+			}
+
+			granted := map[permission]bool{}
+			for _, p := range rbacPermissions(opts, false) {
+				granted[permission{verb: p.verb, resource: p.resource}] = true
+			}
+			var actions []k8stesting.Action
+			actions = append(actions, clientset.Actions()...)
+			actions = append(actions, metadata.Actions()...)
+			actions = append(actions, dynamic.Actions()...)
+			for _, action := range actions {
+				verb := action.GetVerb()
+				if verb == "delete-collection" {
+					verb = "deletecollection"
+				}
+				p := permission{verb: verb, resource: action.GetResource().GroupResource()}
+				if !granted[p] {
+					t.Errorf("the run calls %s, which generate rbac does not grant", p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// secretReferences knows the secrets in use in a namespace. Referenced
+// secrets are never deleted, whatever their name.
+type secretReferences struct {
+	// users maps the names of the referenced secrets to what uses them.
+	users map[string]string
+	// serviceAccounts maps the names of the service accounts to their UID.
+	serviceAccounts map[string]types.UID
+	// secretProviderClasses maps the names of the SecretProviderClasses
+	// mounted by pods to the first pod volume mounting them.
+	secretProviderClasses map[string]string
+}
+
+func newSecretReferences() *secretReferences {
+	return &secretReferences{
+		users:                 map[string]string{},
+		serviceAccounts:       map[string]types.UID{},
+		secretProviderClasses: map[string]string{},
+	}
+}
+
+// add records that user references the secret, keeping the first user found.
+func (r *secretReferences) add(secret, user string) {
+	if _, found := r.users[secret]; secret != "" && !found {
+		r.users[secret] = user
+	}
+}
+
+// user returns what references the secret, if anything.
+func (r *secretReferences) user(secret v1.Secret) (string, bool) {
+	if user, ok := r.users[secret.Name]; ok {
+		return user, true
+	}
+	// The token of an existing service account. Listed secrets have no type,
+	// the annotation is only set on tokens by the token controller though.
+	if secret.Type != "" && secret.Type != v1.SecretTypeServiceAccountToken {
+		return "", false
+	}
+	name := secret.Annotations[v1.ServiceAccountNameKey]
+	uid, exists := r.serviceAccounts[name]
+	if !exists {
+		return "", false
+	}
+	if want := secret.Annotations[v1.ServiceAccountUIDKey]; want != "" && types.UID(want) != uid {
+		return "", false
+	}
+	return fmt.Sprintf("serviceaccount/%s as its token", name), true
+}
+
+// gatherSecretReferences finds the secrets referenced by the objects of a
+// namespace. storage is shared by the namespaces of a run, a nil one is only
+// used for this namespace.
+func gatherSecretReferences(ctx context.Context, clientset kubernetes.Interface, client dynamic.Interface, storage *storageReferences, namespace string) (*secretReferences, error) {
+	refs := newSecretReferences()
+	pods, err := listPods(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %v", err)
+	}
+	for _, pod := range pods {
+		addPodReferences(refs, pod)
+	}
+	serviceAccounts, err := listServiceAccounts(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing serviceaccounts: %v", err)
+	}
+	for _, sa := range serviceAccounts {
+		addServiceAccountReferences(refs, sa)
+	}
+	// TLS secrets terminated by an ingress controller have no pod of the
+	// namespace related to them
+	ingresses, err := listIngresses(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing ingresses: %v", err)
+	}
+	for _, ingress := range ingresses {
+		for _, tls := range ingress.Spec.TLS {
+			refs.add(tls.SecretName, fmt.Sprintf("ingress/%s tls", ingress.Name))
+		}
+	}
+	if err := addGatewayReferences(ctx, client, refs, namespace); err != nil {
+		return nil, err
+	}
+	if err := addCertificateReferences(ctx, client, refs, namespace); err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		storage = &storageReferences{}
+	}
+	if err := addStorageReferences(ctx, clientset, client, storage, refs, namespace); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// addPodReferences records the secrets mounted by the volumes of a pod,
+// including projected and CSI volumes, and its image pull secrets.
+func addPodReferences(refs *secretReferences, pod v1.Pod) {
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		refs.add(secret.Name, fmt.Sprintf("pod/%s imagePullSecrets", pod.Name))
+	}
+	for _, volume := range pod.Spec.Volumes {
+		user := fmt.Sprintf("pod/%s volume %s", pod.Name, volume.Name)
+		if volume.Secret != nil {
+			refs.add(volume.Secret.SecretName, user)
+		}
+		if volume.CSI != nil {
+			addCSIVolumeReferences(refs, volume.CSI, user)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					refs.add(source.Secret.Name, user)
+				}
+			}
+		}
+	}
+}
+
+// addServiceAccountReferences records the secrets linked to a service
+// account. A deleted pull secret only shows when the next pod fails to pull
+// its image, so they are kept even when no pod uses them right now.
+func addServiceAccountReferences(refs *secretReferences, sa v1.ServiceAccount) {
+	refs.serviceAccounts[sa.Name] = sa.UID
+	for _, secret := range sa.Secrets {
+		refs.add(secret.Name, fmt.Sprintf("serviceaccount/%s secrets", sa.Name))
+	}
+	for _, secret := range sa.ImagePullSecrets {
+		refs.add(secret.Name, fmt.Sprintf("serviceaccount/%s imagePullSecrets", sa.Name))
+	}
+}
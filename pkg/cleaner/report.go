@@ -0,0 +1,127 @@
+package cleaner
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// candidateReport counts the orphans found per namespace for the report
+// subcommand. It is safe for concurrent use.
+type candidateReport struct {
+	mu              sync.Mutex
+	secrets         map[string]int
+	services        map[string]int
+	configMaps      map[string]int
+	pvcs            map[string]int
+	serviceAccounts map[string]int
+	networkPolicies map[string]int
+	jobs            map[string]int
+	hpas            map[string]int
+	// others counts the objects of the rules of --rules-file and of the
+	// registered cleaners.
+	others map[string]int
+}
+
+func newCandidateReport() *candidateReport {
+	return &candidateReport{
+		secrets:         map[string]int{},
+		services:        map[string]int{},
+		configMaps:      map[string]int{},
+		pvcs:            map[string]int{},
+		serviceAccounts: map[string]int{},
+		networkPolicies: map[string]int{},
+		jobs:            map[string]int{},
+		hpas:            map[string]int{},
+		others:          map[string]int{},
+	}
+}
+
+// add counts the orphans of a kind, the kinds without a column of their own
+// going to others.
+func (r *candidateReport) add(kind, namespace string, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch kind {
+	case "Secret":
+		r.secrets[namespace] += count
+	case "Service":
+		r.services[namespace] += count
+	case "ConfigMap":
+		r.configMaps[namespace] += count
+	case "PersistentVolumeClaim":
+		r.pvcs[namespace] += count
+	case "ServiceAccount":
+		r.serviceAccounts[namespace] += count
+	case "NetworkPolicy":
+		r.networkPolicies[namespace] += count
+	case "Job":
+		r.jobs[namespace] += count
+	case "HorizontalPodAutoscaler":
+		r.hpas[namespace] += count
+	case "EndpointSlice", "Endpoints":
+		// Not counted, the control plane recreates them for live services
+	default:
+		r.others[namespace] += count
+	}
+}
+
+// write prints a table of the namespaces holding orphans.
+func (r *candidateReport) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	namespaces := map[string]bool{}
+	for namespace := range r.secrets {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.services {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.configMaps {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.pvcs {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.serviceAccounts {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.networkPolicies {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.jobs {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.hpas {
+		namespaces[namespace] = true
+	}
+	for namespace := range r.others {
+		namespaces[namespace] = true
+	}
+	sorted := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		sorted = append(sorted, namespace)
+	}
+	sort.Strings(sorted)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tSECRETS\tSERVICES\tCONFIGMAPS\tPVCS\tSERVICEACCOUNTS\tNETWORKPOLICIES\tJOBS\tHPAS\tOTHER")
+	totalSecrets, totalServices, totalConfigMaps, totalPVCs, totalServiceAccounts, totalNetworkPolicies, totalJobs, totalHPAs, totalOthers := 0, 0, 0, 0, 0, 0, 0, 0, 0
+	for _, namespace := range sorted {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", namespace, r.secrets[namespace], r.services[namespace], r.configMaps[namespace], r.pvcs[namespace], r.serviceAccounts[namespace], r.networkPolicies[namespace], r.jobs[namespace], r.hpas[namespace], r.others[namespace])
+		totalSecrets += r.secrets[namespace]
+		totalServices += r.services[namespace]
+		totalConfigMaps += r.configMaps[namespace]
+		totalPVCs += r.pvcs[namespace]
+		totalServiceAccounts += r.serviceAccounts[namespace]
+		totalNetworkPolicies += r.networkPolicies[namespace]
+		totalJobs += r.jobs[namespace]
+		totalHPAs += r.hpas[namespace]
+		totalOthers += r.others[namespace]
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", totalSecrets, totalServices, totalConfigMaps, totalPVCs, totalServiceAccounts, totalNetworkPolicies, totalJobs, totalHPAs, totalOthers)
+	return tw.Flush()
+}
@@ -0,0 +1,364 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResourceCleaner cleans up one kind of objects in a namespace. One is made
+// for every namespace, so it keeps what Discover gathered for Decide.
+// runCleaner takes care of everything else: the protected, ignored, annotated,
+// GitOps managed and owned objects, the minimum age, the OPA policy, the
+// deletion ratio and limits, the report, the deletion script, the export, the
+// dry run, the backup and the decisions.
+type ResourceCleaner interface {
+	// Discover lists the objects of the namespace to consider, and gathers
+	// what is needed to decide about them.
+	Discover(ctx context.Context) ([]CleanupObject, error)
+	// Decide tells whether an object is to be deleted, and explains why it
+	// is deleted or kept. It is only asked about the objects that passed the
+	// checks shared by all resources.
+	Decide(ctx context.Context, obj CleanupObject) (bool, string, error)
+	// Delete deletes an object with the given options, which carry the
+	// preconditions and the server-side dry run.
+	Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error
+}
+
+// eventCleaner is implemented by the cleaners emitting an event for every
+// object they delete, or fail to delete.
+type eventCleaner interface {
+	// Event returns the reason and message of the event about deleting an
+	// object, which failed when err is not nil.
+	Event(obj CleanupObject, reason string, err error) (string, string)
+}
+
+// keepingCleaner is implemented by the cleaners with more to do about the
+// objects kept by the checks shared by all resources.
+type keepingCleaner interface {
+	// Keep is called in place of Decide for such objects.
+	Keep(ctx context.Context, obj CleanupObject) error
+}
+
+// ownerCleaner is implemented by the cleaners deciding themselves about the
+// objects with ownerReferences, which are otherwise kept unless
+// --include-owned is set.
+type ownerCleaner interface {
+	// DecidesOwned reports whether Decide is asked about owned objects.
+	DecidesOwned() bool
+}
+
+// preparingCleaner is implemented by the cleaners with more to do before
+// deleting an object, once the deletion ratio allows it.
+type preparingCleaner interface {
+	// Prepare returns the object to delete, or false when it is kept after
+	// all, which Prepare records.
+	Prepare(ctx context.Context, obj CleanupObject) (CleanupObject, bool, error)
+}
+
+// batchCleaner is implemented by the cleaners deleting objects in batches.
+type batchCleaner interface {
+	// Queue takes an object to delete in place of Delete, unless it returns
+	// false.
+	Queue(ctx context.Context, obj CleanupObject) (bool, error)
+	// Flush deletes the queued objects and records the outcome.
+	Flush(ctx context.Context) error
+	// Abort undoes what Queue did to the objects left when the run stops
+	// with an error, Flush included.
+	Abort(ctx context.Context)
+}
+
+// CleanupObject is an object discovered by a ResourceCleaner.
+type CleanupObject struct {
+	// Kind is the kind of the object, like Service.
+	Kind string
+	Meta metav1.ObjectMeta
+	// Size is recorded in the decisions.
+	Size int
+	// Type is the type of Secrets and Services, for the OPA policy.
+	Type string
+	// Resource names the objects in the deletion script, the lower case
+	// kind when empty.
+	Resource string
+	// MinAge replaces --min-age for the object when set.
+	MinAge *time.Duration
+	// Object is the object as listed, for the ResourceCleaner.
+	Object interface{}
+	// Export returns the object as written by --output=yaml.
+	Export func() interface{}
+	// Backup returns the object as written to the backups, nil when it is
+	// not backed up.
+	Backup func() interface{}
+}
+
+// CleanerConfig is what a CleanerFactory gets to make the ResourceCleaner of
+// a namespace.
+type CleanerConfig struct {
+	Clientset kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Namespace string
+	// PodPrefixes are the prefixes of the pods of the namespace, as matched
+	// by --pod-name-pattern.
+	PodPrefixes []string
+}
+
+// CleanerFactory makes the ResourceCleaner of a namespace.
+type CleanerFactory func(config CleanerConfig) ResourceCleaner
+
+// cleanerFactory makes the ResourceCleaner of a namespace for the built-in
+// cleaners, which see all the options.
+type cleanerFactory func(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner
+
+// RegisterCleaner adds a ResourceCleaner to the ones --resources can enable.
+// It is meant to be called from the init function of the file defining the
+// ResourceCleaner, and runs after the built-in cleaners.
+func RegisterCleaner(resource string, newCleaner CleanerFactory) {
+	registerResource(resource, func(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+		return newCleaner(CleanerConfig{Clientset: clientset, Dynamic: opts.dynamic, Namespace: namespace, PodPrefixes: podPrefixes})
+	})
+}
+
+// orphanEvent returns the event about deleting an orphaned object. name
+// makes the reasons, as in OrphanedServiceDeleted.
+func orphanEvent(obj CleanupObject, name, reason string, err error) (string, string) {
+	if err != nil {
+		return "Orphaned" + name + "DeleteFailed", "Failed to delete orphaned " + strings.ToLower(obj.Kind) + ": " + err.Error()
+	}
+	return "Orphaned" + name + "Deleted", "Deleted orphaned " + strings.ToLower(obj.Kind) + " as it is " + reason
+}
+
+// candidate is an object the ResourceCleaner decided to delete.
+type candidate struct {
+	obj    CleanupObject
+	reason string
+}
+
+// guard returns why an object is kept whatever its ResourceCleaner would
+// decide: its name is protected or ignored, it carries the keep annotation,
+// it is managed by a GitOps tool, or it has ownerReferences and is garbage
+// collected together with its owner, unless decidesOwned.
+func (o options) guard(obj CleanupObject, decidesOwned bool) (string, bool) {
+	meta := obj.Meta
+	if pattern, ok := matchProtected(o.protected, meta.Name); ok {
+		return fmt.Sprintf("name matches protected pattern %s", pattern), true
+	}
+	if pattern, ok := o.ignore.ignored(meta.Namespace, meta.Name); ok {
+		return fmt.Sprintf("ignored by pattern %s of %s", pattern, o.ignore.path), true
+	}
+	if o.keepAnnotation != "" && meta.Annotations[o.keepAnnotation] == "true" {
+		return fmt.Sprintf("annotated with %s=true", o.keepAnnotation), true
+	}
+	if manager, ok := gitOpsManager(meta); ok && !o.includeGitOps {
+		return manager, true
+	}
+	if !decidesOwned && !o.includeOwned && len(meta.OwnerReferences) > 0 {
+		return "has ownerReferences", true
+	}
+	return "", false
+}
+
+// runCleaner deletes the objects of a namespace the ResourceCleaner decides
+// to delete, as long as they pass the checks shared by all resources, they
+// are old enough, the OPA policy allows it, they are not too large a share of
+// the resource, and the deletion limits allow it.
+func runCleaner(ctx context.Context, clientset kubernetes.Interface, resource string, cleaner ResourceCleaner, namespace string, podPrefixes []string, opts options) (err error) {
+	objects, err := cleaner.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	events, _ := cleaner.(eventCleaner)
+	keeping, _ := cleaner.(keepingCleaner)
+	owners, _ := cleaner.(ownerCleaner)
+	decidesOwned := owners != nil && owners.DecidesOwned()
+
+	var candidates []candidate
+	for _, obj := range objects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		shouldDelete := false
+		reason, kept := opts.guard(obj, decidesOwned)
+		if kept && keeping != nil {
+			if err := keeping.Keep(ctx, obj); err != nil {
+				return err
+			}
+		}
+		if !kept {
+			if shouldDelete, reason, err = cleaner.Decide(ctx, obj); err != nil {
+				return err
+			}
+		}
+		minAge := opts.minAge
+		if obj.MinAge != nil {
+			minAge = *obj.MinAge
+		}
+		if shouldDelete && time.Since(obj.Meta.CreationTimestamp.Time) < minAge {
+			shouldDelete, reason = false, fmt.Sprintf("younger than the minimum age of %s", minAge)
+		}
+		// The policy has the last word on the orphans
+		if shouldDelete {
+			shouldDelete, reason = opts.opa.allows(ctx, opaInput{
+				Object:   opaObject{Kind: obj.Kind, Metadata: obj.Meta, Type: obj.Type},
+				Reason:   reason,
+				Prefixes: podPrefixes,
+				RunID:    opts.runID,
+				DryRun:   !opts.mutates(),
+			})
+		}
+		if shouldDelete {
+			candidates = append(candidates, candidate{obj, reason})
+			continue
+		}
+		kind := strings.ToLower(obj.Kind)
+		logger.Debug("Keeping "+kind, "namespace", namespace, "resource", kind+"/"+obj.Meta.Name, "action", actionKeep, "reason", reason)
+		opts.record(obj.Kind, obj.Meta, obj.Size, actionKeep, reason)
+	}
+
+	// A partial pod listing makes almost everything look orphaned, so refuse
+	// to delete an unusually large share of the namespace
+	if exceedsDeletionRatio(len(candidates), len(objects), opts.maxDeletionPercent) {
+		logger.Warn("Anomaly: skipping namespace as too many "+resource+" would be deleted", "namespace", namespace, "action", actionSkip, "candidates", len(candidates), "total", len(objects), "maxPercent", opts.maxDeletionPercent)
+		for _, c := range candidates {
+			opts.record(c.obj.Kind, c.obj.Meta, c.obj.Size, actionSkip, fmt.Sprintf("deletion ratio exceeds %d%% of the namespace", opts.maxDeletionPercent))
+		}
+		return nil
+	}
+	if opts.report != nil {
+		for _, c := range candidates {
+			opts.report.add(c.obj.Kind, namespace, 1)
+		}
+		return nil
+	}
+
+	preparing, _ := cleaner.(preparingCleaner)
+	batch, _ := cleaner.(batchCleaner)
+	if batch != nil {
+		defer func() {
+			if err != nil {
+				// Possibly interrupted, which must not stop the cleanup
+				batch.Abort(context.WithoutCancel(ctx))
+			}
+		}()
+	}
+	// The objects are backed up first and the archive synced to the backup
+	// store before any of them is deleted
+	deleted := 0
+	var backedUp []candidate
+	for _, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		obj, reason := c.obj, c.reason
+		if preparing != nil {
+			var ready bool
+			if obj, ready, err = preparing.Prepare(ctx, obj); err != nil {
+				return err
+			} else if !ready {
+				continue
+			}
+		}
+
+		kind := strings.ToLower(obj.Kind)
+		ref := kind + "/" + obj.Meta.Name
+		if opts.maxPerNamespace > 0 && deleted >= opts.maxPerNamespace {
+			logger.Warn("Not deleting "+kind+": per-namespace deletion limit reached", "namespace", namespace, "resource", ref, "action", actionSkip, "limit", opts.maxPerNamespace)
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionSkip, fmt.Sprintf("per-namespace deletion limit of %d reached", opts.maxPerNamespace))
+			continue
+		}
+		if !opts.budget.take() {
+			logger.Warn("Not deleting "+kind+": deletion limit reached", "namespace", namespace, "resource", ref, "action", actionSkip, "limit", opts.budget.limit)
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionSkip, fmt.Sprintf("deletion limit of %d reached", opts.budget.limit))
+			continue
+		}
+		deleted++
+
+		if opts.script != nil {
+			scriptResource := obj.Resource
+			if scriptResource == "" {
+				scriptResource = kind
+			}
+			opts.script.delete(scriptResource, namespace, obj.Meta.Name)
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionDelete, reason)
+			continue
+		}
+		if opts.export != nil {
+			if err := opts.export.add(obj.Kind, namespace, obj.Meta.Name, obj.Export()); err != nil {
+				return err
+			}
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionDelete, reason)
+			continue
+		}
+		if opts.dryRun {
+			logger.Log(ctx, levelDeletion, "Deleting "+kind, "namespace", namespace, "resource", ref, "action", actionDelete, "reason", reason, "dryRun", opts.dryRun)
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionDelete, reason)
+			continue
+		}
+		if opts.backup != nil && obj.Backup != nil {
+			if err := opts.backup.add(obj.Kind, obj.Resource, namespace, obj.Meta.Name, obj.Backup()); err != nil {
+				opts.budget.giveBack()
+				opts.record(obj.Kind, obj.Meta, obj.Size, actionError, err.Error())
+				return err
+			}
+		}
+		backedUp = append(backedUp, candidate{obj, reason})
+	}
+	if opts.backup != nil {
+		if err := opts.backup.sync(ctx); err != nil {
+			for _, c := range backedUp {
+				opts.budget.giveBack()
+				opts.record(c.obj.Kind, c.obj.Meta, c.obj.Size, actionError, err.Error())
+			}
+			return err
+		}
+	}
+
+	for _, c := range backedUp {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		obj, reason := c.obj, c.reason
+		kind := strings.ToLower(obj.Kind)
+		ref := kind + "/" + obj.Meta.Name
+		logger.Log(ctx, levelDeletion, "Deleting "+kind, "namespace", namespace, "resource", ref, "action", actionDelete, "reason", reason, "dryRun", opts.dryRun)
+		var err error
+		queued := false
+		if batch != nil {
+			queued, err = batch.Queue(ctx, obj)
+		}
+		if err == nil && !queued {
+			err = cleaner.Delete(ctx, obj, opts.deleteOptions(obj.Meta))
+		}
+		if err != nil {
+			// Only the deletions that happened count towards the limits
+			opts.budget.giveBack()
+		}
+		if errors.IsConflict(err) {
+			logger.Warn("Not deleting "+kind+" as it changed since it was listed", "namespace", namespace, "resource", ref, "action", actionSkip)
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionSkip, changedReason)
+		} else if err != nil {
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionError, err.Error())
+			if events != nil {
+				eventReason, message := events.Event(obj, reason, err)
+				emitEvent(ctx, clientset, opts, obj.Kind, obj.Meta, v1.EventTypeWarning, eventReason, message)
+			}
+			return fmt.Errorf("Error deleting %s %s: %v", kind, obj.Meta.Name, err)
+		} else if !queued {
+			opts.record(obj.Kind, obj.Meta, obj.Size, actionDelete, reason)
+			if events != nil {
+				eventReason, message := events.Event(obj, reason, nil)
+				emitEvent(ctx, clientset, opts, obj.Kind, obj.Meta, v1.EventTypeNormal, eventReason, message)
+			}
+		}
+	}
+	if batch != nil {
+		return batch.Flush(ctx)
+	}
+	return nil
+}
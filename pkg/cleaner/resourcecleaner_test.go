@@ -0,0 +1,150 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// widgetCleaner deletes every widget, as a ResourceCleaner registered by
+// another team would.
+type widgetCleaner struct {
+	widgets []CleanupObject
+	deleted []string
+}
+
+func (c *widgetCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	return c.widgets, nil
+}
+
+func (c *widgetCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	return true, "a widget", nil
+}
+
+func (c *widgetCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	c.deleted = append(c.deleted, obj.Meta.Name)
+	return nil
+}
+
+func newWidgets(count int, age time.Duration) []CleanupObject {
+	var widgets []CleanupObject
+	for i := 0; i < count; i++ {
+		widgets = append(widgets, CleanupObject{
+			Kind: "Widget",
+			Meta: metav1.ObjectMeta{
+				Name:              fmt.Sprintf("widget-%d", i),
+				Namespace:         "team-a",
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+			},
+		})
+	}
+	return widgets
+}
+
+func withMinAge(widgets []CleanupObject, minAge time.Duration) []CleanupObject {
+	for i := range widgets {
+		widgets[i].MinAge = &minAge
+	}
+	return widgets
+}
+
+func withMeta(widgets []CleanupObject, mutate func(meta *metav1.ObjectMeta)) []CleanupObject {
+	for i := range widgets {
+		mutate(&widgets[i].Meta)
+	}
+	return widgets
+}
+
+func TestRunCleanerSafetyChecks(t *testing.T) {
+	protected, err := compileProtectPatterns([]string{"widget-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := func(meta *metav1.ObjectMeta) {
+		meta.OwnerReferences = []metav1.OwnerReference{{Kind: "Gadget", Name: "gadget"}}
+	}
+	// Denies the widgets named widget-0
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input opaInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprintf(w, `{"result": {"delete": %t}}`, body.Input.Object.Metadata.Name != "widget-0")
+	}))
+	defer opa.Close()
+	tests := []struct {
+		name    string
+		widgets []CleanupObject
+		opts    options
+		want    int
+	}{
+		{name: "unlimited", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 100}, want: 3},
+		{name: "min age", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 100, minAge: 2 * time.Hour}, want: 0},
+		{name: "min age of the object", widgets: withMinAge(newWidgets(3, time.Hour), 30*time.Minute), opts: options{maxDeletionPercent: 100, minAge: 2 * time.Hour}, want: 3},
+		{name: "deletion ratio", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 50}, want: 0},
+		{name: "deletion ratio disabled", widgets: newWidgets(3, time.Hour), opts: options{}, want: 3},
+		{name: "budget", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 100, budget: newDeletionBudget(2)}, want: 2},
+		{name: "per-namespace limit", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 100, maxPerNamespace: 1}, want: 1},
+		{name: "protected", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 100, protected: protected}, want: 0},
+		{name: "keep annotation", widgets: withMeta(newWidgets(3, time.Hour), func(meta *metav1.ObjectMeta) {
+			meta.Annotations = map[string]string{defaultKeepAnnotation: "true"}
+		}), opts: options{maxDeletionPercent: 100, keepAnnotation: defaultKeepAnnotation}, want: 0},
+		{name: "owned", widgets: withMeta(newWidgets(3, time.Hour), owned), opts: options{maxDeletionPercent: 100}, want: 0},
+		{name: "owned included", widgets: withMeta(newWidgets(3, time.Hour), owned), opts: options{maxDeletionPercent: 100, includeOwned: true}, want: 3},
+		{name: "OPA policy", widgets: newWidgets(3, time.Hour), opts: options{maxDeletionPercent: 100, opa: newOPAPolicy(opa.URL, time.Second)}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := &widgetCleaner{widgets: tt.widgets}
+			if err := runCleaner(context.Background(), fake.NewSimpleClientset(), "widgets", cleaner, "team-a", nil, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(cleaner.deleted) != tt.want {
+				t.Errorf("deleted %v, want %d widgets", cleaner.deleted, tt.want)
+			}
+		})
+	}
+}
+
+// The min age is only enforced by runCleaner, so that the overrides of the
+// objects and namespaces apply to every resource.
+func TestDecideLeavesMinAgeToRunCleaner(t *testing.T) {
+	created := metav1.NewTime(time.Now().Add(-time.Hour))
+	opts := options{minAge: 2 * time.Hour}
+	rule, err := compileRule(ruleSpec{Name: "stale", Version: "v1", Resource: "widgets", Match: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		decide func() (bool, string)
+	}{
+		{name: "secret", decide: func() (bool, string) {
+			secret := v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "abcdefghij-certificate", Namespace: "team-a", CreationTimestamp: created}}
+			return decideSecret(secret, []string{"klmnopqrst"}, newSecretReferences(), opts)
+		}},
+		{name: "rule", decide: func() (bool, string) {
+			obj := unstructured.Unstructured{}
+			obj.SetName("widget")
+			obj.SetNamespace("team-a")
+			obj.SetCreationTimestamp(created)
+			return decideRuleObject(rule, obj, nil, nil, opts)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if shouldDelete, reason := tt.decide(); !shouldDelete {
+				t.Errorf("kept an orphan younger than --min-age: %s", reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Kinds of objects the cleaners handle, as named by --resources and by the
+// resources of an OrphanCleanupPolicy.
+const (
+	resourceSecrets         = "secrets"
+	resourceServices        = "services"
+	resourceEndpoints       = "endpoints"
+	resourceConfigMaps      = "configmaps"
+	resourcePVCs            = "persistentvolumeclaims"
+	resourceServiceAccounts = "serviceaccounts"
+	resourceNetworkPolicies = "networkpolicies"
+	resourceJobs            = "jobs"
+	resourceHPAs            = "horizontalpodautoscalers"
+	// resourceRules enables the rules of --rules-file.
+	resourceRules = "rules"
+)
+
+// resourceCleanup is a resource --resources can enable.
+type resourceCleanup struct {
+	name       string
+	newCleaner cleanerFactory
+}
+
+// resources lists the resources in the order their cleaners run.
+// EndpointSlices and Endpoints come right after the services, so that those
+// of the services just deleted go with them.
+var resources = []resourceCleanup{
+	{resourceSecrets, newSecretCleaner},
+	{resourceServices, newServiceCleaner},
+	{resourceEndpoints, newEndpointsCleaner},
+	{resourceConfigMaps, newConfigMapCleaner},
+	{resourcePVCs, newPVCCleaner},
+	{resourceServiceAccounts, newServiceAccountCleaner},
+	{resourceNetworkPolicies, newNetworkPolicyCleaner},
+	{resourceJobs, newJobCleaner},
+	{resourceHPAs, newHPACleaner},
+	{resourceRules, newRuleCleaner},
+}
+
+// registerResource adds a resource after the others.
+func registerResource(name string, newCleaner cleanerFactory) {
+	for _, resource := range resources {
+		if resource.name == name {
+			panic(fmt.Sprintf("resource %q registered twice", name))
+		}
+	}
+	resources = append(resources, resourceCleanup{name, newCleaner})
+}
+
+// resourceNames returns the names of the resources, in the order their
+// cleaners run.
+func resourceNames() []string {
+	names := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		names = append(names, resource.name)
+	}
+	return names
+}
+
+// defaultResources are cleaned up when --resources is not given.
+var defaultResources = []string{resourceSecrets, resourceServices}
+
+// cleanupScope tells which kinds of objects to clean up in a namespace.
+type cleanupScope map[string]bool
+
+// parseResources returns the scope made of the given resources.
+func parseResources(names []string) (cleanupScope, error) {
+	scope := cleanupScope{}
+	for _, resource := range names {
+		known := false
+		for _, name := range resourceNames() {
+			known = known || name == resource
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown resource %q, must be one of %s", resource, strings.Join(resourceNames(), ", "))
+		}
+		scope[resource] = true
+	}
+	return scope, nil
+}
+
+// fullScope enables every resource.
+func fullScope() cleanupScope {
+	scope := cleanupScope{}
+	for _, resource := range resources {
+		scope[resource.name] = true
+	}
+	return scope
+}
+
+// and returns the resources enabled in both scopes.
+func (s cleanupScope) and(other cleanupScope) cleanupScope {
+	scope := cleanupScope{}
+	for resource, enabled := range s {
+		scope[resource] = enabled && other[resource]
+	}
+	return scope
+}
+
+// cleanupNamespace runs the cleaners of the resources of the scope in a
+// namespace. A failing cleaner does not stop the others, the first error is
+// returned.
+func cleanupNamespace(ctx context.Context, clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options, scope cleanupScope) error {
+	var err error
+	for _, resource := range resources {
+		if !scope[resource.name] {
+			continue
+		}
+		cleaner := resource.newCleaner(clientset, podPrefixes, namespace, opts)
+		if cleanupErr := runCleaner(ctx, clientset, resource.name, cleaner, namespace, podPrefixes, opts); err == nil {
+			err = cleanupErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,365 @@
+package cleaner
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// restoreFilter selects the objects to restore from an archive. Empty fields
+// match everything, so an empty filter restores the full run.
+type restoreFilter struct {
+	namespace string
+	kind      string
+	name      string
+}
+
+func (f restoreFilter) match(namespace, kind, name string) bool {
+	return (f.namespace == "" || f.namespace == namespace) &&
+		(f.kind == "" || strings.EqualFold(f.kind, kind)) &&
+		(f.name == "" || f.name == name)
+}
+
+// restoreFlags holds the flags of the restore subcommand.
+type restoreFlags struct {
+	filter           restoreFilter
+	archive          string
+	backupURL        string
+	backupS3Endpoint string
+	runID            string
+	// cluster is the cluster the run backed up, in a run against several
+	// clusters.
+	cluster       string
+	identityFiles []string
+	dryRun        bool
+}
+
+// newRestoreCommand recreates the secrets and services stored in a backup
+// archive written by --backup-dir or --backup-url.
+func newRestoreCommand(kube *kubeFlags) *cobra.Command {
+	var r restoreFlags
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Recreate deleted secrets and services from a backup archive",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if kube.multiCluster() {
+				return fmt.Errorf("--contexts and --all-contexts are not supported by restore, select the cluster with --context and its backup with --backup-cluster")
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			return runRestore(ctx, kube, r)
+		},
+	}
+	fs := cmd.Flags()
+	fs.StringVar(&r.archive, "archive", "", "Path of the backup archive to restore from")
+	fs.StringVar(&r.backupURL, "backup-url", "", "Object storage location the backups were uploaded to, as passed to --backup-url when cleaning up")
+	fs.StringVar(&r.backupS3Endpoint, "backup-s3-endpoint", "", "Endpoint of an S3 compatible object store to use instead of AWS")
+	fs.StringVar(&r.runID, "run", "", "ID of the run to restore from --backup-url")
+	fs.StringVar(&r.cluster, "backup-cluster", "", "Cluster whose backup to restore from a run against several clusters, as named by --contexts or --clusters-file. Defaults to the --context name, falling back to the backup of a single cluster run")
+	fs.StringArrayVar(&r.identityFiles, "identity", nil, "File with the age identities to decrypt the archive with. May be repeated")
+	fs.StringVar(&r.filter.namespace, "namespace", "", "Only restore objects from this namespace")
+	fs.StringVar(&r.filter.kind, "kind", "", "Only restore objects of this kind (secret, service, configmap, serviceaccount, networkpolicy, horizontalpodautoscaler, persistentvolumeclaim, persistentvolume or the lower case kind of a --rules-file rule). Volumes are stored under the namespace of their claim")
+	fs.StringVar(&r.filter.name, "name", "", "Only restore the object with this name")
+	fs.BoolVar(&r.dryRun, "dry-run", false, "Print the objects that would be restored without creating them")
+	return cmd
+}
+
+func runRestore(ctx context.Context, kube *kubeFlags, r restoreFlags) error {
+	archive := r.archive
+	if (archive == "") == (r.backupURL == "") {
+		return fmt.Errorf("Please specify either --archive or --backup-url")
+	}
+	if r.backupURL != "" && r.runID == "" {
+		return fmt.Errorf("Please specify the run to restore with --run")
+	}
+	identities, err := parseIdentities(r.identityFiles)
+	if err != nil {
+		return fmt.Errorf("Invalid --identity: %v", err)
+	}
+
+	if r.backupURL != "" {
+		store, err := newBackupStore(r.backupURL, r.backupS3Endpoint, "")
+		if err != nil {
+			return fmt.Errorf("Invalid --backup-url: %v", err)
+		}
+		// The backup of a run against a single cluster is not stored under
+		// the name of its context
+		cluster, fallback := r.cluster, r.cluster == ""
+		if fallback {
+			cluster = kube.overrides.CurrentContext
+		}
+		archive, err = downloadArchive(ctx, store, r.runID, cluster)
+		if _, notFound := err.(objectNotFoundError); notFound && fallback && cluster != "" {
+			archive, err = downloadArchive(ctx, store, r.runID, "")
+		}
+		if err != nil {
+			return fmt.Errorf("Error downloading backup: %v", err)
+		}
+		defer os.Remove(archive)
+	}
+
+	clientset, err := kube.clientset()
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := kube.dynamicClient()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	restored, err := restoreArchive(ctx, clientset, dynamicClient, f, identities, r.filter, r.dryRun)
+	logger.Info("Restore finished", "restored", restored)
+	return err
+}
+
+func parseIdentities(files []string) ([]age.Identity, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("at least one identity file is required")
+	}
+	var identities []age.Identity
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	return identities, nil
+}
+
+// downloadArchive fetches the archive the run backed up the cluster to into a
+// temporary file.
+func downloadArchive(ctx context.Context, store backupStore, runID, cluster string) (string, error) {
+	f, err := os.CreateTemp("", "orphaned-secrets-restore")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := store.Download(ctx, backupKey(runID, cluster, backupArchiveName(runID)), f); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// restoreArchive decrypts the objects of the archive and recreates those
+// matching the filter. Objects that already exist are left untouched, as are
+// those of a resource restore does not know. The archive of a run that died
+// before closing it lacks the end of archive marker, and is restored all the
+// same.
+func restoreArchive(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, r io.Reader, identities []age.Identity, filter restoreFilter, dryRun bool) (int, error) {
+	tr := tar.NewReader(r)
+
+	restored := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return restored, nil
+		}
+		if err != nil {
+			return restored, fmt.Errorf("error reading backup archive: %v", err)
+		}
+
+		// Entries are stored as <namespace>/<kind>/<name>.yaml.age
+		parts := strings.Split(strings.TrimSuffix(header.Name, ".yaml.age"), "/")
+		if len(parts) != 3 {
+			logger.Warn("Skipping unexpected backup entry", "entry", header.Name)
+			continue
+		}
+		namespace, kind, name := parts[0], parts[1], parts[2]
+		if !filter.match(namespace, kind, name) {
+			continue
+		}
+		decrypted, err := age.Decrypt(tr, identities...)
+		if err != nil {
+			return restored, fmt.Errorf("error decrypting backup of %s %s/%s: %v", kind, namespace, name, err)
+		}
+		data, err := io.ReadAll(decrypted)
+		if err != nil {
+			return restored, fmt.Errorf("error reading backup of %s %s/%s: %v", kind, namespace, name, err)
+		}
+
+		if dryRun {
+			logger.Info("Would restore object", "namespace", namespace, "resource", kind+"/"+name, "action", "restore", "dryRun", true)
+			continue
+		}
+		err = restoreObject(ctx, clientset, dynamicClient, kind, header.PAXRecords[backupResourceRecord], data)
+		if _, unsupported := err.(unsupportedKindError); unsupported {
+			logger.Warn("Not restoring object of an unknown resource", "namespace", namespace, "resource", kind+"/"+name, "action", actionSkip)
+			continue
+		}
+		if errors.IsAlreadyExists(err) {
+			logger.Info("Not restoring object as it already exists", "namespace", namespace, "resource", kind+"/"+name, "action", actionSkip)
+			continue
+		}
+		if err != nil {
+			return restored, fmt.Errorf("error restoring %s %s in namespace %s: %v", kind, name, namespace, err)
+		}
+		logger.Info("Restored object", "namespace", namespace, "resource", kind+"/"+name, "action", "restore")
+		restored++
+	}
+}
+
+// unsupportedKindError is returned by restoreObject for the objects of a kind
+// it does not know, backed up without their resource.
+type unsupportedKindError struct{ kind string }
+
+func (e unsupportedKindError) Error() string {
+	return fmt.Sprintf("unsupported kind %q", e.kind)
+}
+
+// restoreObject recreates an object of the archive. The objects of the
+// built-in cleaners are known by their kind, the others are created through
+// the dynamic client in the resource recorded along with them, at the version
+// they were backed up at.
+func restoreObject(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, kind, resource string, data []byte) error {
+	switch kind {
+	case "secret":
+		var secret v1.Secret
+		if err := yaml.Unmarshal(data, &secret); err != nil {
+			return err
+		}
+		restorable := exportableSecret(secret)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.CoreV1().Secrets(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "service":
+		var service v1.Service
+		if err := yaml.Unmarshal(data, &service); err != nil {
+			return err
+		}
+		restorable := exportableService(service)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.CoreV1().Services(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "configmap":
+		var configMap v1.ConfigMap
+		if err := yaml.Unmarshal(data, &configMap); err != nil {
+			return err
+		}
+		restorable := exportableConfigMap(configMap)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.CoreV1().ConfigMaps(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "persistentvolume":
+		var pv v1.PersistentVolume
+		if err := yaml.Unmarshal(data, &pv); err != nil {
+			return err
+		}
+		restorable := exportableVolume(pv)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.CoreV1().PersistentVolumes().Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "persistentvolumeclaim":
+		var pvc v1.PersistentVolumeClaim
+		if err := yaml.Unmarshal(data, &pvc); err != nil {
+			return err
+		}
+		restorable := exportablePVC(pvc)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.CoreV1().PersistentVolumeClaims(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "serviceaccount":
+		var sa v1.ServiceAccount
+		if err := yaml.Unmarshal(data, &sa); err != nil {
+			return err
+		}
+		restorable := exportableServiceAccount(sa)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.CoreV1().ServiceAccounts(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "networkpolicy":
+		var policy networkingv1.NetworkPolicy
+		if err := yaml.Unmarshal(data, &policy); err != nil {
+			return err
+		}
+		restorable := exportableNetworkPolicy(policy)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.NetworkingV1().NetworkPolicies(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	case "horizontalpodautoscaler":
+		var hpa autoscalingv2.HorizontalPodAutoscaler
+		if err := yaml.Unmarshal(data, &hpa); err != nil {
+			return err
+		}
+		restorable := exportableHPA(hpa)
+		removeCleanerAnnotations(&restorable.ObjectMeta)
+		_, err := clientset.AutoscalingV2().HorizontalPodAutoscalers(restorable.Namespace).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+		return err
+	}
+	if resource == "" {
+		return unsupportedKindError{kind: kind}
+	}
+	var obj unstructured.Unstructured
+	if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+		return err
+	}
+	gv, err := schema.ParseGroupVersion(obj.GetAPIVersion())
+	if err != nil {
+		return err
+	}
+	gvr := schema.ParseGroupResource(resource).WithVersion(gv.Version)
+	restorable := exportableUnstructured(obj)
+	annotations := restorable.GetAnnotations()
+	for _, annotation := range cleanerAnnotations {
+		delete(annotations, annotation)
+	}
+	restorable.SetAnnotations(annotations)
+	_, err = dynamicClient.Resource(gvr).Namespace(restorable.GetNamespace()).Create(ctx, restorable, metav1.CreateOptions{FieldManager: fieldManager})
+	return err
+}
+
+// exportableService strips the server populated fields of a service, including
+// its cluster IPs which may have been handed out to another service since.
+func exportableService(service v1.Service) *v1.Service {
+	exported := service.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	exported.Status = v1.ServiceStatus{}
+	if exported.Spec.ClusterIP != v1.ClusterIPNone {
+		exported.Spec.ClusterIP = ""
+		exported.Spec.ClusterIPs = nil
+	}
+	return exported
+}
+
+// cleanerAnnotations are the annotations added by this tool.
+var cleanerAnnotations = []string{candidateSinceAnnotation, quarantinedAtAnnotation, reasonAnnotation}
+
+// removeCleanerAnnotations drops the annotations added by this tool, so that
+// a restored object does not look like a pending candidate again.
+func removeCleanerAnnotations(meta *metav1.ObjectMeta) {
+	for _, annotation := range cleanerAnnotations {
+		delete(meta.Annotations, annotation)
+	}
+}
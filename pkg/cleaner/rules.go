@@ -0,0 +1,359 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Scopes of the resources a rule cleans up.
+const (
+	ruleScopeNamespaced = "Namespaced"
+	ruleScopeCluster    = "Cluster"
+)
+
+// rulesFile is the content of a --rules-file, cleaning up resources the
+// cleaner has no built-in support for:
+//
+//	rules:
+//	- name: stale-backups
+//	  group: backups.example.com
+//	  version: v1
+//	  resource: backupjobs
+//	  kind: BackupJob
+//	  match: 'object.status.phase == "Done"'
+//	  keep:
+//	  - 'has(object.labels.pinned)'
+//	  references:
+//	  - version: v1
+//	    resource: pods
+//	    path: spec.volumes[].persistentVolumeClaim.claimName
+//	  prefix: true
+type rulesFile struct {
+	Rules []ruleSpec `json:"rules"`
+}
+
+// ruleSpec is a rule of a rules file. An object of the resource is deleted
+// when it passes the usual safety checks (ignore file, keep annotation,
+// GitOps, ownerReferences, min age), match is true, no keep expression is,
+// no object of the references names it and, with prefix, its name carries the
+// prefix of an instance that is gone.
+type ruleSpec struct {
+	Name     string `json:"name"`
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// Kind names the objects in logs and reports, the resource by default.
+	Kind string `json:"kind,omitempty"`
+	// Scope is Namespaced, the default, or Cluster. Cluster scoped objects
+	// are only cleaned up with --all, once all namespaces are done.
+	Scope string `json:"scope,omitempty"`
+	// Match and Keep are CEL expressions seeing object (name, namespace,
+	// labels, annotations, created, age, ownerReferences, spec, status) and
+	// prefixes.
+	Match      string          `json:"match,omitempty"`
+	Keep       []string        `json:"keep,omitempty"`
+	References []referenceSpec `json:"references,omitempty"`
+	Prefix     bool            `json:"prefix,omitempty"`
+	// MinAge overrides --min-age.
+	MinAge *metav1.Duration `json:"minAge,omitempty"`
+}
+
+// referenceSpec names the objects that keep an object of a rule alive while
+// the value at their path is its name. The path is made of field names
+// separated by dots, "[]" going through all the items of a list. The objects
+// are looked up in the namespace of the object, or in all namespaces for
+// cluster scoped rules.
+type referenceSpec struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Path     string `json:"path"`
+}
+
+// cleanupRule is a compiled ruleSpec.
+type cleanupRule struct {
+	ruleSpec
+	gvr   schema.GroupVersionResource
+	match *expression
+	keep  []*expression
+}
+
+func loadRulesFile(path string) ([]cleanupRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rulesFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	rules := make([]cleanupRule, 0, len(file.Rules))
+	for i, spec := range file.Rules {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", spec.Name)
+		}
+		names[spec.Name] = true
+		rule, err := compileRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", spec.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func compileRule(spec ruleSpec) (cleanupRule, error) {
+	rule := cleanupRule{ruleSpec: spec}
+	if spec.Version == "" || spec.Resource == "" {
+		return rule, fmt.Errorf("version and resource are required")
+	}
+	rule.gvr = schema.GroupVersionResource{Group: spec.Group, Version: spec.Version, Resource: spec.Resource}
+	if rule.Kind == "" {
+		rule.Kind = spec.Resource
+	}
+	switch spec.Scope {
+	case "":
+		rule.Scope = ruleScopeNamespaced
+	case ruleScopeNamespaced, ruleScopeCluster:
+	default:
+		return rule, fmt.Errorf("unknown scope %q, must be %s or %s", spec.Scope, ruleScopeNamespaced, ruleScopeCluster)
+	}
+	// Without these, every object of the resource would be deleted
+	if spec.Match == "" && !spec.Prefix {
+		return rule, fmt.Errorf("match or prefix is required")
+	}
+	if spec.Prefix && rule.Scope == ruleScopeCluster {
+		return rule, fmt.Errorf("prefix requires the %s scope", ruleScopeNamespaced)
+	}
+	var err error
+	if spec.Match != "" {
+		if rule.match, err = compileExpression(spec.Match); err != nil {
+			return rule, fmt.Errorf("invalid match: %v", err)
+		}
+	}
+	for _, source := range spec.Keep {
+		keep, err := compileExpression(source)
+		if err != nil {
+			return rule, fmt.Errorf("invalid keep %q: %v", source, err)
+		}
+		rule.keep = append(rule.keep, keep)
+	}
+	for _, reference := range spec.References {
+		if reference.Version == "" || reference.Resource == "" || reference.Path == "" {
+			return rule, fmt.Errorf("version, resource and path are required in references")
+		}
+	}
+	return rule, nil
+}
+
+// objectMeta returns the metadata of an unstructured object.
+func objectMeta(obj unstructured.Unstructured) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:              obj.GetName(),
+		Namespace:         obj.GetNamespace(),
+		UID:               obj.GetUID(),
+		ResourceVersion:   obj.GetResourceVersion(),
+		CreationTimestamp: obj.GetCreationTimestamp(),
+		Labels:            obj.GetLabels(),
+		Annotations:       obj.GetAnnotations(),
+		OwnerReferences:   obj.GetOwnerReferences(),
+	}
+}
+
+// ruleVariables are the variables of the expressions of a rule.
+func ruleVariables(obj unstructured.Unstructured, podPrefixes []string) map[string]interface{} {
+	object := objectVariables(objectMeta(obj))
+	for _, field := range []string{"spec", "status"} {
+		if value, ok := obj.Object[field]; ok {
+			object[field] = value
+		} else {
+			object[field] = map[string]interface{}{}
+		}
+	}
+	return map[string]interface{}{"object": object, "prefixes": stringList(podPrefixes)}
+}
+
+// pathValues returns the strings found at a path of a referencing object.
+func pathValues(value interface{}, path []string) []string {
+	if len(path) == 0 {
+		if s, ok := value.(string); ok {
+			return []string{s}
+		}
+		return nil
+	}
+	field, iterate := strings.CutSuffix(path[0], "[]")
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	value = fields[field]
+	if !iterate {
+		return pathValues(value, path[1:])
+	}
+	items, _ := value.([]interface{})
+	var values []string
+	for _, item := range items {
+		values = append(values, pathValues(item, path[1:])...)
+	}
+	return values
+}
+
+// gatherRuleReferences maps the names referenced by the references of a rule
+// to the first object referencing them.
+func gatherRuleReferences(ctx context.Context, rule cleanupRule, namespace string, opts options) (map[string]string, error) {
+	refs := map[string]string{}
+	for _, reference := range rule.References {
+		resource := schema.GroupVersionResource{Group: reference.Group, Version: reference.Version, Resource: reference.Resource}
+		objects, err := listOptional(ctx, opts.dynamic, []schema.GroupVersionResource{resource}, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %v", reference.Resource, err)
+		}
+		path := strings.Split(reference.Path, ".")
+		for _, obj := range objects {
+			for _, name := range pathValues(obj.Object, path) {
+				if _, found := refs[name]; !found {
+					refs[name] = fmt.Sprintf("%s %s/%s", reference.Resource, obj.GetNamespace(), obj.GetName())
+				}
+			}
+		}
+	}
+	return refs, nil
+}
+
+// decideRuleObject decides whether an object is orphaned according to its
+// rule, and explains why.
+func decideRuleObject(rule cleanupRule, obj unstructured.Unstructured, podPrefixes []string, refs map[string]string, opts options) (bool, string) {
+	meta := objectMeta(obj)
+	vars := ruleVariables(obj, podPrefixes)
+	if rule.match != nil {
+		matched, err := rule.match.evalBool(vars)
+		if err != nil {
+			return false, fmt.Sprintf("error evaluating the match of rule %s: %v", rule.Name, err)
+		}
+		if !matched {
+			return false, fmt.Sprintf("not matched by rule %s", rule.Name)
+		}
+	}
+	for i, keep := range rule.keep {
+		// An expression that fails to evaluate keeps the object, too
+		kept, err := keep.evalBool(vars)
+		if err != nil {
+			return false, fmt.Sprintf("error evaluating keep %q of rule %s: %v", rule.Keep[i], rule.Name, err)
+		}
+		if kept {
+			return false, fmt.Sprintf("kept by %q of rule %s", rule.Keep[i], rule.Name)
+		}
+	}
+	if user, ok := refs[meta.Name]; ok {
+		return false, "referenced by " + user
+	}
+	if rule.Prefix {
+		prefix, ok := instancePrefix(meta.Name, opts.podNamePattern)
+		if !ok {
+			return false, "not named after an instance"
+		}
+		for _, podPrefix := range podPrefixes {
+			if podPrefix == prefix {
+				return false, fmt.Sprintf("matches pod prefix %s", prefix)
+			}
+		}
+	}
+	return true, "matched by rule " + rule.Name
+}
+
+// ruleCleaner applies the rules of the given scope to a namespace, or to the
+// cluster scoped resources when namespace is empty. No events are emitted
+// for these objects, as their kind is not known to the API server under the
+// name given in the rules.
+type ruleCleaner struct {
+	podPrefixes []string
+	namespace   string
+	opts        options
+}
+
+func newRuleCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &ruleCleaner{podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+// ruleObject is an object a rule applies to, with the references gathered
+// for the rule.
+type ruleObject struct {
+	rule cleanupRule
+	obj  unstructured.Unstructured
+	refs map[string]string
+}
+
+func (c *ruleCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	var objects []CleanupObject
+	for _, rule := range c.opts.rules {
+		if (rule.Scope == ruleScopeCluster) != (c.namespace == "") {
+			continue
+		}
+		listed, err := listOptional(ctx, c.opts.dynamic, []schema.GroupVersionResource{rule.gvr}, c.namespace)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing %s: %v", rule.Resource, err)
+		}
+		if len(listed) == 0 {
+			continue
+		}
+		refs, err := gatherRuleReferences(ctx, rule, c.namespace, c.opts)
+		if err != nil {
+			return nil, err
+		}
+		var minAge *time.Duration
+		if rule.MinAge != nil {
+			minAge = &rule.MinAge.Duration
+		}
+		for _, obj := range listed {
+			obj := obj
+			objects = append(objects, CleanupObject{
+				Kind:     rule.Kind,
+				Meta:     objectMeta(obj),
+				Resource: rule.gvr.GroupResource().String(),
+				MinAge:   minAge,
+				Object:   ruleObject{rule: rule, obj: obj, refs: refs},
+				Export:   func() interface{} { return exportableUnstructured(obj) },
+				Backup: func() interface{} {
+					backup := obj.DeepCopy()
+					unstructured.RemoveNestedField(backup.Object, "metadata", "managedFields")
+					return backup
+				},
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (c *ruleCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	o := obj.Object.(ruleObject)
+	shouldDelete, reason := decideRuleObject(o.rule, o.obj, c.podPrefixes, o.refs, c.opts)
+	return shouldDelete, reason, nil
+}
+
+func (c *ruleCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	o := obj.Object.(ruleObject)
+	return c.opts.dynamic.Resource(o.rule.gvr).Namespace(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+// exportableUnstructured strips the server populated fields of an object.
+func exportableUnstructured(obj unstructured.Unstructured) *unstructured.Unstructured {
+	exported := obj.DeepCopy()
+	for _, field := range []string{"resourceVersion", "uid", "creationTimestamp", "managedFields", "generation"} {
+		unstructured.RemoveNestedField(exported.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(exported.Object, "status")
+	return exported
+}
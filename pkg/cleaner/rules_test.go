@@ -0,0 +1,248 @@
+package cleaner
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestCompileRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    ruleSpec
+		wantErr bool
+	}{
+		{name: "match", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Match: `object.status.phase == "Done"`}},
+		{name: "prefix", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Prefix: true}},
+		{name: "no resource", spec: ruleSpec{Version: "v1", Match: "true"}, wantErr: true},
+		{name: "neither match nor prefix", spec: ruleSpec{Version: "v1", Resource: "backupjobs"}, wantErr: true},
+		{name: "unknown scope", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Match: "true", Scope: "Global"}, wantErr: true},
+		{name: "prefix of cluster scoped objects", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Prefix: true, Scope: ruleScopeCluster}, wantErr: true},
+		{name: "invalid match", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Match: "object.("}, wantErr: true},
+		{name: "invalid keep", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Match: "true", Keep: []string{"object.("}}, wantErr: true},
+		{name: "reference without a path", spec: ruleSpec{Version: "v1", Resource: "backupjobs", Match: "true", References: []referenceSpec{{Version: "v1", Resource: "pods"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := compileRule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (rule.Kind != tt.spec.Resource || rule.Scope != ruleScopeNamespaced) {
+				t.Errorf("kind %s and scope %s, want the defaults", rule.Kind, rule.Scope)
+			}
+		})
+	}
+}
+
+func TestPathValues(t *testing.T) {
+	pod := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"serviceAccountName": "runner",
+			"volumes": []interface{}{
+				map[string]interface{}{"persistentVolumeClaim": map[string]interface{}{"claimName": "data"}},
+				map[string]interface{}{"emptyDir": map[string]interface{}{}},
+				map[string]interface{}{"persistentVolumeClaim": map[string]interface{}{"claimName": "cache"}},
+			},
+		},
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "spec.serviceAccountName", want: []string{"runner"}},
+		{path: "spec.volumes[].persistentVolumeClaim.claimName", want: []string{"data", "cache"}},
+		{path: "spec.volumes", want: nil},
+		{path: "spec.containers[].name", want: nil},
+		{path: "status.phase", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := pathValues(pod, strings.Split(tt.path, ".")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pathValues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newBackupJob(name, phase string, mutate func(*unstructured.Unstructured)) unstructured.Unstructured {
+	obj := unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "backups.example.com/v1",
+		"kind":       "BackupJob",
+		"status":     map[string]interface{}{"phase": phase},
+	}}
+	obj.SetName(name)
+	obj.SetNamespace("team-a")
+	obj.SetCreationTimestamp(metav1.NewTime(time.Now().Add(-48 * time.Hour)))
+	if mutate != nil {
+		mutate(&obj)
+	}
+	return obj
+}
+
+func TestDecideRuleObject(t *testing.T) {
+	rule, err := compileRule(ruleSpec{
+		Name:     "stale-backups",
+		Group:    "backups.example.com",
+		Version:  "v1",
+		Resource: "backupjobs",
+		Match:    `object.status.phase == "Done"`,
+		Keep:     []string{"has(object.labels.pinned)"},
+		Prefix:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	podNamePattern, err := compilePodNamePattern(defaultPodNamePattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{podNamePattern: podNamePattern, keepAnnotation: "cleaner/keep"}
+	podPrefixes := []string{"klmnopqrst"}
+	refs := map[string]string{"abcdefghij-an-referenced": "pods team-a/runner"}
+	tests := []struct {
+		name       string
+		obj        unstructured.Unstructured
+		wantDelete bool
+		wantReason string
+	}{
+		{name: "orphaned", obj: newBackupJob("abcdefghij-an-nightly", "Done", nil), wantDelete: true},
+		{name: "not matched", obj: newBackupJob("abcdefghij-an-nightly", "Running", nil), wantReason: "not matched by rule stale-backups"},
+		{
+			name: "kept by an expression",
+			obj: newBackupJob("abcdefghij-an-nightly", "Done", func(obj *unstructured.Unstructured) {
+				obj.SetLabels(map[string]string{"pinned": "true"})
+			}),
+			wantReason: `kept by "has(object.labels.pinned)" of rule stale-backups`,
+		},
+		{
+			name: "keep annotation",
+			obj: newBackupJob("abcdefghij-an-nightly", "Done", func(obj *unstructured.Unstructured) {
+				obj.SetAnnotations(map[string]string{"cleaner/keep": "true"})
+			}),
+			wantReason: "annotated with cleaner/keep=true",
+		},
+		{
+			name: "owned",
+			obj: newBackupJob("abcdefghij-an-nightly", "Done", func(obj *unstructured.Unstructured) {
+				obj.SetOwnerReferences([]metav1.OwnerReference{{Kind: "BackupSchedule", Name: "nightly"}})
+			}),
+			wantReason: "has ownerReferences",
+		},
+		{name: "referenced", obj: newBackupJob("abcdefghij-an-referenced", "Done", nil), wantReason: "referenced by pods team-a/runner"},
+		{name: "not named after an instance", obj: newBackupJob("nightly", "Done", nil), wantReason: "not named after an instance"},
+		{name: "instance still running", obj: newBackupJob("klmnopqrst-an-nightly", "Done", nil), wantReason: "matches pod prefix klmnopqrst"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The shared checks run before the rule
+			reason, kept := opts.guard(CleanupObject{Meta: objectMeta(tt.obj)}, false)
+			shouldDelete := false
+			if !kept {
+				shouldDelete, reason = decideRuleObject(rule, tt.obj, podPrefixes, refs, opts)
+			}
+			if shouldDelete != tt.wantDelete {
+				t.Fatalf("delete = %v (%s), want %v", shouldDelete, reason, tt.wantDelete)
+			}
+			if !tt.wantDelete && reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+// The rule cleaner lists the objects of the rules of its scope, keeps the
+// referenced ones, backs them up without their managed fields and deletes
+// them through the dynamic client.
+func TestRuleCleaner(t *testing.T) {
+	backupJobs := schema.GroupVersionResource{Group: "backups.example.com", Version: "v1", Resource: "backupjobs"}
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	referenced := newBackupJob("referenced", "Done", nil)
+	stale := newBackupJob("stale", "Done", func(obj *unstructured.Unstructured) {
+		obj.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "backup-operator"}})
+	})
+	pod := unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "restore", "namespace": "team-a"},
+		"spec":       map[string]interface{}{"restoreFrom": "referenced"},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		backupJobs: "BackupJobList",
+		pods:       "PodList",
+	}, &referenced, &stale, &pod)
+	var rules []cleanupRule
+	for _, spec := range []ruleSpec{
+		{
+			Name:       "stale-backups",
+			Group:      "backups.example.com",
+			Version:    "v1",
+			Resource:   "backupjobs",
+			Kind:       "BackupJob",
+			Match:      `object.status.phase == "Done"`,
+			References: []referenceSpec{{Version: "v1", Resource: "pods", Path: "spec.restoreFrom"}},
+		},
+		{Name: "cluster-wide", Version: "v1", Resource: "pods", Match: "true", Scope: ruleScopeCluster},
+	} {
+		rule, err := compileRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	cleaner := newRuleCleaner(nil, nil, "team-a", options{dynamic: dynamicClient, rules: rules})
+
+	objects, err := cleaner.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions := map[string]bool{}
+	for _, obj := range objects {
+		if obj.Kind != "BackupJob" || obj.Resource != "backupjobs.backups.example.com" {
+			t.Errorf("discovered %s %s of resource %s, want only BackupJobs", obj.Kind, obj.Meta.Name, obj.Resource)
+		}
+		shouldDelete, reason, err := cleaner.Decide(context.Background(), obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decisions[obj.Meta.Name] = shouldDelete
+		if !shouldDelete {
+			if want := "referenced by pods team-a/restore"; reason != want {
+				t.Errorf("%s kept because %q, want %q", obj.Meta.Name, reason, want)
+			}
+			continue
+		}
+		backup := obj.Backup().(*unstructured.Unstructured)
+		if len(backup.GetManagedFields()) > 0 {
+			t.Errorf("backup of %s has managed fields", obj.Meta.Name)
+		}
+		if err := cleaner.Delete(context.Background(), obj, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := map[string]bool{"referenced": false, "stale": true}; !reflect.DeepEqual(decisions, want) {
+		t.Errorf("decisions = %v, want %v", decisions, want)
+	}
+
+	left, err := dynamicClient.Resource(backupJobs).Namespace("team-a").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, obj := range left.Items {
+		names = append(names, obj.GetName())
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"referenced"}) {
+		t.Errorf("left %v, want [referenced]", names)
+	}
+}
@@ -0,0 +1,601 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+)
+
+// Main runs the orphaned-secrets-deleter command with the arguments of the
+// process, and returns its exit code.
+func Main() int {
+	if err := newRootCommand().Execute(); err != nil {
+		fmt.Println(err)
+		switch err.(type) {
+		case timeoutError:
+			return exitTimeout
+		case interruptedError:
+			return exitInterrupted
+		case namespaceErrors, clusterErrors:
+			return exitPartialFailure
+		}
+		return 1
+	}
+	return 0
+}
+
+// Exit codes of runs that failed or were stopped in some namespaces only.
+const (
+	exitPartialFailure = 2
+	exitTimeout        = 3
+	exitInterrupted    = 130
+)
+
+// timeoutError reports that --timeout expired before all namespaces were
+// processed.
+type timeoutError struct {
+	timeout     time.Duration
+	unprocessed int
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %s with %d namespaces unprocessed", e.timeout, e.unprocessed)
+}
+
+// interruptedError reports that the run was stopped by SIGINT or SIGTERM.
+type interruptedError struct {
+	unprocessed int
+}
+
+func (e interruptedError) Error() string {
+	return fmt.Sprintf("Interrupted with %d namespaces unprocessed", e.unprocessed)
+}
+
+func run(ctx context.Context, clientset kubernetes.Interface, allNamespaces bool, namespace string, opts options) error {
+	if allNamespaces {
+		err := cleanupAllNamespaces(ctx, clientset, opts)
+		if opts.releasedVolumes != "" && opts.deadline.Err() == nil {
+			if volumesErr := cleanupReleasedVolumes(ctx, clientset, opts); volumesErr != nil {
+				if err != nil {
+					logger.Error("Error cleaning up released persistent volumes", "error", volumesErr)
+				} else {
+					return fmt.Errorf("Error cleaning up released persistent volumes: %v", volumesErr)
+				}
+			}
+		}
+		// Cluster scoped rules
+		if opts.resources[resourceRules] && opts.deadline.Err() == nil {
+			if rulesErr := runCleaner(ctx, clientset, resourceRules, newRuleCleaner(clientset, nil, "", opts), "", nil, opts); rulesErr != nil {
+				if err != nil {
+					logger.Error("Error cleaning up cluster scoped resources", "error", rulesErr)
+				} else {
+					return fmt.Errorf("Error cleaning up cluster scoped resources: %v", rulesErr)
+				}
+			}
+		}
+		if _, partial := err.(namespaceErrors); err != nil && !partial {
+			return fmt.Errorf("Error cleaning up all namespaces: %v", err)
+		}
+		return err
+	}
+
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Error getting namespace %s: %v", namespace, err)
+	}
+	if !opts.optedIn(*ns) {
+		logger.Info("Skipping namespace as it is not annotated with "+enabledAnnotation+"=true", "namespace", namespace, "action", actionSkip)
+		return nil
+	}
+	if opts, err = namespaceOptions(opts, *ns); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	pods, err := gatherPrefixes(ctx, clientset, namespace, opts)
+	if err != nil {
+		opts.namespaceDone(namespace, time.Since(start), err)
+		return fmt.Errorf("Error retrieving pods from namespace %s: %v", namespace, err)
+	}
+	if skipWithoutPrefixes(pods, namespace, opts) {
+		opts.namespaceDone(namespace, time.Since(start), nil)
+		return nil
+	}
+	err = cleanupNamespace(ctx, clientset, pods, namespace, opts, opts.resources)
+	opts.namespaceDone(namespace, time.Since(start), err)
+	if err != nil {
+		return fmt.Errorf("Error cleaning up namespace %s: %v", namespace, err)
+	}
+	return nil
+}
+
+// options holds the settings shared by the cleanup functions.
+type options struct {
+	// metadata lists the secrets without their data.
+	metadata metadata.Interface
+	// dynamic reads the custom resources referencing secrets.
+	dynamic dynamic.Interface
+	// deadline bounds the run: no namespace is started once it is done, as
+	// the context of the run was canceled or --timeout expired.
+	deadline       context.Context
+	dryRun         bool
+	podNamePattern *regexp.Regexp
+	protected      []namePattern
+	// ignore excludes the objects listed in an ignore file.
+	ignore *ignoreList
+	// deleteIf and deleteServiceIf replace the built-in name heuristics
+	// deciding whether a secret or a service is orphaned.
+	deleteIf        *expression
+	deleteServiceIf *expression
+	// deleteNetworkPolicyIf does the same for the NetworkPolicies that select
+	// no pod.
+	deleteNetworkPolicyIf *expression
+	// opa has the last word on the orphans when set.
+	opa *opaPolicy
+	// protectConfigMap is the namespace/name of a ConfigMap holding more
+	// protected patterns.
+	protectConfigMap string
+	// keepAnnotation pins the objects annotated with it set to "true".
+	keepAnnotation string
+	includeOwned   bool
+	// includeGitOps also considers the objects deployed by a GitOps tool.
+	includeGitOps bool
+	// resources are the kinds of objects cleaned up, see --resources.
+	resources cleanupScope
+	// pvcMinAge is the minimum age of the PersistentVolumeClaims deleted.
+	pvcMinAge time.Duration
+	// jobMaxAge is how long finished Jobs are kept.
+	jobMaxAge time.Duration
+	// rules are the rules of --rules-file.
+	rules []cleanupRule
+	// serviceGrace is how long a service selects no pods before it is
+	// considered orphaned.
+	serviceGrace time.Duration
+	// releasedVolumes is what to do with the volumes released by deleted
+	// namespaces, nothing if empty.
+	releasedVolumes string
+	minAge          time.Duration
+	// budget is shared by all workers to enforce --max-deletions.
+	budget          *deletionBudget
+	maxPerNamespace int
+	// maxDeletionPercent is the largest share of the objects of a resource
+	// in a namespace that may be deleted in one run, 0 and 100 for any.
+	maxDeletionPercent int
+	// secretListOptions narrows down the secrets considered for deletion.
+	secretListOptions metav1.ListOptions
+	forceEmpty        bool
+	prefixSource      string
+	serverDryRun      bool
+	// batchDelete labels the secrets to delete and deletes them with a single
+	// DeleteCollection per namespace.
+	batchDelete bool
+	// script collects the deletions instead of performing them.
+	script    *scriptWriter
+	markGrace time.Duration
+	// quarantineDir receives a manifest of every secret before it is deleted.
+	quarantineDir string
+	// backup receives every secret before it is deleted.
+	backup *backupWriter
+	// report counts the orphans instead of deleting them.
+	report *candidateReport
+	// optIn restricts the run to the namespaces annotated with
+	// enabledAnnotation, whatever their labels.
+	optIn bool
+	// namespaceList replaces the labeled namespaces with --namespaces-from.
+	namespaceList []string
+	// namespaceRegexp restricts the namespaces processed with --all.
+	namespaceRegexp *regexp.Regexp
+	// excludedNamespaces are never cleaned up.
+	excludedNamespaces []namePattern
+	// shard selects the namespaces processed when running in parallel.
+	shard namespaceShard
+	// workers is the number of namespaces processed in parallel.
+	workers int
+	// recorders receive a structured record of every decision.
+	recorders []decisionRecorder
+	// export collects the manifests of the orphans instead of deleting them.
+	export *manifestWriter
+	// runID identifies the run in backups and audit records.
+	runID string
+	// summary collects the outcome of the run.
+	summary *runSummary
+	// runMetrics holds the metrics of this run alone, pushed to the
+	// Pushgateway once it is over.
+	runMetrics *cleanerMetrics
+	// table renders the decisions once the run is over.
+	table *tableRecorder
+	// progress reports how far a run over all namespaces has come.
+	progress *progressReporter
+	// events enables emitting an event for every deletion.
+	events bool
+	// notifier posts the results of the run to chat webhooks.
+	notifier *notifier
+	// history records a summary of the run in a ConfigMap.
+	history *historyConfigMap
+	// cleanupRun publishes the results of the run as a CleanupRun.
+	cleanupRun *cleanupRunRecorder
+	// storage holds the secrets used by the cluster scoped storage objects,
+	// listed once per run.
+	storage *storageReferences
+}
+
+// deleteOptions returns the options used to delete the object. The UID and
+// resourceVersion seen at list time are passed as preconditions, so an object
+// that was recreated or modified in the meantime is never deleted.
+func (o options) deleteOptions(meta metav1.ObjectMeta) metav1.DeleteOptions {
+	deleteOptions := metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &meta.UID,
+			ResourceVersion: &meta.ResourceVersion,
+		},
+	}
+	if o.serverDryRun {
+		deleteOptions.DryRun = []string{metav1.DryRunAll}
+	}
+	return deleteOptions
+}
+
+// namespaceDone reports that processing a namespace finished.
+func (o options) namespaceDone(namespace string, duration time.Duration, err error) {
+	o.summary.namespaceDone(namespace, duration, err)
+	o.progress.namespaceDone()
+	metrics.namespaceDone(namespace, duration)
+	if o.runMetrics != nil {
+		o.runMetrics.namespaceDone(namespace, duration)
+	}
+}
+
+// readOnly reports whether the run must not modify the cluster.
+func (o options) readOnly() bool {
+	return o.dryRun || o.script != nil || o.export != nil
+}
+
+// mutates reports whether the run persists changes. With --server-dry-run the
+// deletions are sent but not persisted, so the marks, quarantine annotations
+// and backups that go with them are left out as well.
+func (o options) mutates() bool {
+	return !o.readOnly() && !o.serverDryRun
+}
+
+func cleanupAllNamespaces(ctx context.Context, clientset kubernetes.Interface, opts options) error {
+
+	// Use a channel to communicate between goroutines
+	namespaceChan := make(chan v1.Namespace)
+	failureChan := make(chan namespaceError)
+
+	// Use a WaitGroup to wait for all goroutines to finish
+	var wg sync.WaitGroup
+
+	namespaces, err := targetNamespaces(ctx, clientset, opts)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for namespace := range namespaceChan {
+				start := time.Now()
+				opts, err := namespaceOptions(opts, namespace)
+				if err != nil {
+					opts.namespaceDone(namespace.Name, time.Since(start), err)
+					failureChan <- namespaceError{namespace.Name, err}
+					continue
+				}
+				pods, err := gatherPrefixes(ctx, clientset, namespace.Name, opts)
+				if err != nil {
+					opts.namespaceDone(namespace.Name, time.Since(start), err)
+					failureChan <- namespaceError{namespace.Name, err}
+					continue
+				}
+				if skipWithoutPrefixes(pods, namespace.Name, opts) {
+					opts.namespaceDone(namespace.Name, time.Since(start), nil)
+					continue
+				}
+				err = cleanupNamespace(ctx, clientset, pods, namespace.Name, opts, opts.resources)
+				opts.namespaceDone(namespace.Name, time.Since(start), err)
+				if err != nil {
+					failureChan <- namespaceError{namespace.Name, err}
+				}
+			}
+		}()
+	}
+
+	selected := selectNamespaces(namespaces, opts)
+	opts.progress.begin(len(selected))
+	defer opts.progress.finish()
+
+	go func() {
+		defer close(namespaceChan)
+		for i, namespace := range selected {
+			if opts.deadline.Err() == nil {
+				select {
+				case namespaceChan <- namespace:
+					logger.Info("Cleaning up namespace", "namespace", namespace.Name)
+					continue
+				case <-opts.deadline.Done():
+				}
+			}
+			// The run was stopped, the namespaces in progress are finished
+			for _, namespace := range selected[i:] {
+				opts.summary.notStarted(namespace.Name)
+			}
+			return
+		}
+	}()
+
+	// Wait for all goroutines to finish
+	go func() {
+		wg.Wait()
+		close(failureChan)
+	}()
+
+	// A failing namespace does not stop the others from being cleaned up
+	failures := namespaceErrors{total: len(selected)}
+	for failure := range failureChan {
+		logger.Error("Error cleaning up namespace", "namespace", failure.namespace, "error", failure.err)
+		failures.failed = append(failures.failed, failure)
+	}
+	if len(failures.failed) > 0 {
+		sort.Slice(failures.failed, func(i, j int) bool { return failures.failed[i].namespace < failures.failed[j].namespace })
+		return failures
+	}
+	return nil
+}
+
+// namespaceError is the failure of cleaning up a namespace.
+type namespaceError struct {
+	namespace string
+	err       error
+}
+
+// namespaceErrors collects the failures of a run over several namespaces.
+type namespaceErrors struct {
+	failed []namespaceError
+	total  int
+}
+
+func (e namespaceErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Error cleaning up %d of %d namespaces:", len(e.failed), e.total)
+	for _, failure := range e.failed {
+		fmt.Fprintf(&b, "\n  %s: %s", failure.namespace, strings.TrimSpace(failure.err.Error()))
+	}
+	return b.String()
+}
+
+// secretCleaner cleans up the secrets not associated with any relevant pods.
+type secretCleaner struct {
+	clientset   kubernetes.Interface
+	podPrefixes []string
+	namespace   string
+	opts        options
+	refs        *secretReferences
+	// batch holds the secrets labeled for deletion with --batch-delete
+	batch []v1.Secret
+}
+
+func newSecretCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &secretCleaner{clientset: clientset, podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+func (c *secretCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	var secrets []v1.Secret
+	var err error
+	// The metadata of the secrets lacks their type
+	if c.opts.opa != nil || c.opts.deleteIf != nil && c.opts.deleteIf.references("type") {
+		secrets, err = listFullSecrets(ctx, c.clientset, c.namespace, c.opts.secretListOptions)
+	} else {
+		secrets, err = listSecrets(ctx, c.opts.metadata, c.namespace, c.opts.secretListOptions)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets: %v", err)
+	}
+	if c.refs, err = gatherSecretReferences(ctx, c.clientset, c.opts.dynamic, c.opts.storage, c.namespace); err != nil {
+		return nil, err
+	}
+	objects := make([]CleanupObject, 0, len(secrets))
+	for _, secret := range secrets {
+		objects = append(objects, secretObject(secret))
+	}
+	return objects, nil
+}
+
+// secretObject returns the CleanupObject of a secret.
+func secretObject(secret v1.Secret) CleanupObject {
+	return CleanupObject{
+		Kind:   "Secret",
+		Meta:   secret.ObjectMeta,
+		Size:   secretSize(secret),
+		Type:   string(secret.Type),
+		Object: secret,
+		Export: func() interface{} { return exportableSecret(secret) },
+		Backup: func() interface{} { return backupSecret(secret) },
+	}
+}
+
+func (c *secretCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decideSecret(obj.Object.(v1.Secret), c.podPrefixes, c.refs, c.opts)
+	if !shouldDelete {
+		if err := c.Keep(ctx, obj); err != nil {
+			return false, reason, err
+		}
+	}
+	return shouldDelete, reason, nil
+}
+
+// Keep clears the candidate mark of a secret that is no longer orphaned.
+func (c *secretCleaner) Keep(ctx context.Context, obj CleanupObject) error {
+	return clearCandidateMark(ctx, c.clientset, c.namespace, obj.Meta, c.opts)
+}
+
+// Prepare marks the secret in mark-then-sweep mode, and fetches it in full
+// as it may have been listed as metadata.
+func (c *secretCleaner) Prepare(ctx context.Context, obj CleanupObject) (CleanupObject, bool, error) {
+	secret := obj.Object.(v1.Secret)
+	if ready, err := readyToSweep(ctx, c.clientset, c.namespace, secret, c.opts); err != nil || !ready {
+		return obj, false, err
+	}
+	full, err := completeSecret(ctx, c.clientset, secret)
+	if err != nil {
+		c.opts.recordSecret(secret, actionError, err.Error())
+		return obj, false, fmt.Errorf("error getting secret %s: %v", secret.Name, err)
+	}
+	if full == nil {
+		logger.Warn("Not deleting secret as it changed since it was listed", "namespace", c.namespace, "resource", "secret/"+secret.Name, "action", actionSkip)
+		c.opts.recordSecret(secret, actionSkip, changedReason)
+		return obj, false, nil
+	}
+	return secretObject(*full), true, nil
+}
+
+// quarantine writes the manifest of the secret to --quarantine-dir, and
+// returns the secret as annotated by quarantineSecret.
+func (c *secretCleaner) quarantine(ctx context.Context, obj CleanupObject, reason string) (*v1.Secret, error) {
+	secret := obj.Object.(v1.Secret)
+	if c.opts.quarantineDir == "" || !c.opts.mutates() {
+		return &secret, nil
+	}
+	return quarantineSecret(ctx, c.clientset, c.opts.quarantineDir, secret, reason)
+}
+
+func (c *secretCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	current, err := c.quarantine(ctx, obj, orphanedReason)
+	if err != nil {
+		return err
+	}
+	return c.clientset.CoreV1().Secrets(c.namespace).Delete(ctx, obj.Meta.Name, c.opts.deleteOptions(current.ObjectMeta))
+}
+
+// Queue labels the secret for deletion by Flush with --batch-delete.
+func (c *secretCleaner) Queue(ctx context.Context, obj CleanupObject) (bool, error) {
+	if !c.opts.batchDelete {
+		return false, nil
+	}
+	current, err := c.quarantine(ctx, obj, orphanedReason)
+	if err == nil {
+		current, err = labelForDeletion(ctx, c.clientset, *current, c.opts.runID)
+	}
+	if err != nil {
+		return false, err
+	}
+	c.batch = append(c.batch, *current)
+	return true, nil
+}
+
+func (c *secretCleaner) Flush(ctx context.Context) error {
+	return deleteLabeledSecrets(ctx, c.clientset, c.namespace, c.batch, c.opts)
+}
+
+func (c *secretCleaner) Abort(ctx context.Context) {
+	unlabelSecrets(ctx, c.clientset, c.batch)
+}
+
+func (c *secretCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "Secret", reason, err)
+}
+
+// defaultPodNamePattern matches pods named "<10 character prefix>-an-<suffix>".
+const defaultPodNamePattern = `^(.{10})-an-`
+
+// compilePodNamePattern compiles the pod name pattern and makes sure it has a
+// capture group to extract the prefix from.
+func compilePodNamePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("pattern %q has no capture group for the prefix", pattern)
+	}
+	return re, nil
+}
+
+// skipWithoutPrefixes reports whether a namespace should be left alone because
+// no pod prefixes were found in it. An empty prefix list usually means the pods
+// are being evicted or rescheduled, and would make every secret look orphaned.
+func skipWithoutPrefixes(podPrefixes []string, namespace string, opts options) bool {
+	if len(podPrefixes) > 0 || opts.forceEmpty {
+		return false
+	}
+	logger.Info("Skipping namespace as no matching pods were found in it", "namespace", namespace, "action", actionSkip)
+	return true
+}
+
+func gatherPods(ctx context.Context, clientset kubernetes.Interface, namespace string, podNamePattern *regexp.Regexp) ([]string, error) {
+	var podPrefixes []string
+
+	pods, err := listPods(ctx, clientset, namespace)
+	if err != nil {
+		return podPrefixes, fmt.Errorf("Error listing pods: %v\n", err)
+	}
+
+	// Extract the first part of the pod name
+	for _, pod := range pods {
+		if match := podNamePattern.FindStringSubmatch(pod.Name); match != nil && match[1] != "" {
+			podPrefixes = append(podPrefixes, match[1])
+		}
+	}
+	return podPrefixes, nil
+}
+
+// serviceCleaner cleans up the services whose selector matches no pod.
+type serviceCleaner struct {
+	clientset   kubernetes.Interface
+	podPrefixes []string
+	namespace   string
+	opts        options
+	backends    *serviceBackends
+}
+
+func newServiceCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &serviceCleaner{clientset: clientset, podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+func (c *serviceCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	// List all services in the namespace
+	services, err := listServices(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing services: %v\n", err)
+	}
+	if c.backends, err = gatherServiceBackends(ctx, c.clientset, c.namespace, c.opts); err != nil {
+		return nil, err
+	}
+	objects := make([]CleanupObject, 0, len(services))
+	for _, service := range services {
+		service := service
+		objects = append(objects, CleanupObject{
+			Kind:   "Service",
+			Meta:   service.ObjectMeta,
+			Type:   string(service.Spec.Type),
+			Object: service,
+			Export: func() interface{} { return exportableService(service) },
+			Backup: func() interface{} { return backupService(service) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *serviceCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decideService(obj.Object.(v1.Service), c.podPrefixes, c.backends, c.opts)
+	return shouldDelete, reason, nil
+}
+
+func (c *serviceCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	return c.clientset.CoreV1().Services(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *serviceCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "Service", reason, err)
+}
@@ -0,0 +1,99 @@
+package cleaner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// With --server-dry-run the deletions are sent as dry runs, and nothing that
+// goes with them is persisted: no mark, quarantine annotation or backup.
+func TestServerDryRunPersistsNothing(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "delete", args: []string{"--quarantine=DIR/quarantine", "--backup-dir=DIR/backups", "--backup-recipient=age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}},
+		{name: "mark then sweep", args: []string{"--mark-grace=1h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var detect detectFlags
+			var clean cleanFlags
+			fs := pflag.NewFlagSet("clean", pflag.ContinueOnError)
+			detect.register(fs)
+			clean.register(fs)
+			args := []string{"--namespace=team-a", "--server-dry-run"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "DIR", dir))
+			}
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			opts, err := detect.options()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := clean.apply(&opts); err != nil {
+				t.Fatal(err)
+			}
+			if opts.backup != nil {
+				t.Error("backup written for a server dry run")
+			}
+
+			created := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+			meta := metav1.ObjectMeta{Name: "abcdefghij-certificate", Namespace: "team-a", UID: "1", ResourceVersion: "1", CreationTimestamp: created}
+			clientset := fake.NewSimpleClientset(&v1.Secret{ObjectMeta: meta})
+			scheme := metadatafake.NewTestScheme()
+			if err := metav1.AddMetaToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			opts.metadata = metadatafake.NewSimpleMetadataClient(scheme, &metav1.PartialObjectMetadata{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: meta,
+			})
+			listKinds := map[schema.GroupVersionResource]string{}
+			for _, resources := range [][]schema.GroupVersionResource{gatewayResources, referenceGrantResources, certificateResources, secretProviderClassResources} {
+				for _, resource := range resources {
+					listKinds[resource] = "List"
+				}
+			}
+			opts.dynamic = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+			opts.resources = cleanupScope{resourceSecrets: true}
+			opts.maxDeletionPercent = 100
+			if err := cleanupNamespace(context.Background(), clientset, []string{"klmnopqrst"}, "team-a", opts, opts.resources); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, action := range clientset.Actions() {
+				switch action := action.(type) {
+				case k8stesting.DeleteActionImpl:
+					if !reflect.DeepEqual(action.DeleteOptions.DryRun, []string{metav1.DryRunAll}) {
+						t.Errorf("delete of %s sent without dry run", action.Name)
+					}
+				case k8stesting.GetActionImpl, k8stesting.ListActionImpl:
+				default:
+					t.Errorf("unexpected %s of %s", action.GetVerb(), action.GetResource().Resource)
+				}
+			}
+			if entries, _ := os.ReadDir(filepath.Join(dir, "quarantine")); len(entries) > 0 {
+				t.Errorf("quarantined %d secrets in a server dry run", len(entries))
+			}
+		})
+	}
+}
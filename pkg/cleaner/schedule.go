@@ -0,0 +1,204 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed standard five field cron expression: minute, hour,
+// day of month, month and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// A day matches either field when both day fields are restricted, as in
+	// cron(8).
+	domRestricted, dowRestricted bool
+}
+
+// cronDescriptors are the supported shorthands for common schedules.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression such as "*/15 2-4 * * 1,3" or @daily.
+func parseCron(expr string) (*cronSchedule, error) {
+	if descriptor, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = descriptor
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	s := &cronSchedule{}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	// Both 0 and 7 stand for Sunday
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps
+// into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart = part[:i]
+		}
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end in steps of 15
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time matching the schedule strictly after t, or the
+// zero time if there is none within five years. The candidates step on the
+// wall clock of the location of t, so a time skipped by a daylight saving
+// time change never matches and a repeated one matches once, the first time.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	after := t
+	loc := t.Location()
+	t = wallClock(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = wallClock(t.Year(), t.Month()+1, 1, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = wallClock(t.Year(), t.Month(), t.Day()+1, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = wallClock(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, loc)
+			continue
+		}
+		// In the repeated hour of a change, the wall clock may resolve to the
+		// first occurrence, before after
+		if s.minute&(1<<uint(t.Minute())) == 0 || !t.After(after) {
+			t = wallClock(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, loc)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// wallClock returns the time of a wall clock reading in loc. A reading skipped
+// by a daylight saving time change is moved forward by the length of the gap,
+// whichever side of it time.Date resolves it to, so stepping the wall clock
+// always moves forward.
+func wallClock(year int, month time.Month, day, hour, min int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, loc)
+	want := time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if got.Before(want) {
+		t = t.Add(want.Sub(got))
+	}
+	return t
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// runScheduled calls runOnce at every time matching schedule, delayed by a
+// random jitter, until ctx is done. Runs never overlap: the times passing
+// while a run is in progress are skipped. A failed run is logged and does not
+// stop the schedule.
+func runScheduled(ctx context.Context, schedule *cronSchedule, jitter time.Duration, runOnce func() error) error {
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("the schedule matches no time in the next five years")
+		}
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		logger.Info("Waiting for the next scheduled run", "time", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		if err := runOnce(); err != nil {
+			logger.Error("Scheduled run failed", "error", err)
+		}
+		if skipped := schedule.between(next, time.Now()); skipped > 0 {
+			logger.Warn("Skipped scheduled runs while the previous one was in progress", "count", skipped)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// between counts the times matching the schedule after from and up to to.
+func (s *cronSchedule) between(from, to time.Time) int {
+	count := 0
+	for t := s.next(from); !t.IsZero() && !t.After(to); t = s.next(t) {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,115 @@
+package cleaner
+
+import (
+	"testing"
+	"time"
+	// The zones of the DST cases must not depend on the host
+	_ "time/tzdata"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "*/15 2-4 * * 1,3"},
+		{expr: "@daily"},
+		{expr: "5/20 * * * 7"},
+		{expr: "* * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 5-2 * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "@often", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseCron(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, 1, 10, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{name: "every minute", expr: "* * * * *", from: from, want: time.Date(2024, 1, 10, 10, 8, 0, 0, time.UTC)},
+		{name: "strictly after", expr: "* * * * *", from: time.Date(2024, 1, 10, 10, 8, 0, 0, time.UTC), want: time.Date(2024, 1, 10, 10, 9, 0, 0, time.UTC)},
+		{name: "steps", expr: "*/15 * * * *", from: from, want: time.Date(2024, 1, 10, 10, 15, 0, 0, time.UTC)},
+		{name: "steps from an offset", expr: "5/20 * * * *", from: from, want: time.Date(2024, 1, 10, 10, 25, 0, 0, time.UTC)},
+		{name: "next day", expr: "0 3 * * *", from: from, want: time.Date(2024, 1, 11, 3, 0, 0, 0, time.UTC)},
+		{name: "descriptor", expr: "@monthly", from: from, want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "next year", expr: "0 0 1 1 *", from: from, want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "day of week", expr: "30 2 * * 1", from: from, want: time.Date(2024, 1, 15, 2, 30, 0, 0, time.UTC)},
+		{name: "sunday as 7", expr: "0 0 * * 7", from: from, want: time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{name: "either day field", expr: "0 0 13 * 5", from: from, want: time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{name: "leap day", expr: "0 0 29 2 *", from: from, want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "never", expr: "0 0 31 2 *", from: from, want: time.Time{}},
+		// Half-hour offsets from UTC
+		{name: "Asia/Kolkata", expr: "0 12 * * *", from: in("Asia/Kolkata", 2024, 1, 10, 10, 7), want: in("Asia/Kolkata", 2024, 1, 10, 12, 0)},
+		{name: "Australia/Adelaide", expr: "0 3 * * *", from: in("Australia/Adelaide", 2024, 1, 10, 10, 7), want: in("Australia/Adelaide", 2024, 1, 11, 3, 0)},
+		// Clocks go from 02:00 to 03:00 on 2024-03-10 in New York and on
+		// 2024-10-06 in Adelaide: the times in between are skipped
+		{name: "gap skipped", expr: "30 2 * * *", from: in("America/New_York", 2024, 3, 10, 0, 0), want: in("America/New_York", 2024, 3, 11, 2, 30)},
+		{name: "gap hourly", expr: "0 * * * *", from: in("America/New_York", 2024, 3, 10, 1, 30), want: in("America/New_York", 2024, 3, 10, 3, 0)},
+		{name: "gap in Adelaide", expr: "30 2 * * *", from: in("Australia/Adelaide", 2024, 10, 6, 0, 0), want: in("Australia/Adelaide", 2024, 10, 7, 2, 30)},
+		// Clocks go from 02:00 back to 01:00 on 2024-11-03 in New York: the
+		// repeated hour matches once
+		{name: "overlap once", expr: "30 1 * * *", from: in("America/New_York", 2024, 11, 3, 1, 30), want: in("America/New_York", 2024, 11, 4, 1, 30)},
+		{name: "overlap steps", expr: "*/30 * * * *", from: in("America/New_York", 2024, 11, 3, 1, 45), want: time.Date(2024, 11, 3, 7, 0, 0, 0, time.UTC)},
+		{name: "overlap from the second occurrence", expr: "*/15 * * * *", from: time.Date(2024, 11, 3, 6, 20, 0, 0, time.UTC).In(location("America/New_York")), want: time.Date(2024, 11, 3, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func location(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// in returns a wall clock time of a location, the first one when it is
+// repeated.
+func in(name string, year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, location(name))
+}
+
+func TestCronScheduleBetween(t *testing.T) {
+	schedule, err := parseCron("*/15 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		to   time.Time
+		want int
+	}{
+		{to: from.Add(10 * time.Minute), want: 0},
+		{to: from.Add(15 * time.Minute), want: 1},
+		{to: from.Add(time.Hour), want: 4},
+	}
+	for _, tt := range tests {
+		if got := schedule.between(from, tt.to); got != tt.want {
+			t.Errorf("between(%s, %s) = %d, want %d", from, tt.to, got, tt.want)
+		}
+	}
+}
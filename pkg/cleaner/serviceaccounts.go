@@ -0,0 +1,184 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultServiceAccount is created in every namespace by the control plane.
+const defaultServiceAccount = "default"
+
+// decideServiceAccount decides whether a ServiceAccount is orphaned, and
+// explains why. Like ConfigMaps, ServiceAccounts are considered per instance
+// when their name matches the pod name pattern. A ServiceAccount bound to
+// roles from other namespaces is granted access no one in this namespace
+// knows about, so it is always kept.
+func decideServiceAccount(sa v1.ServiceAccount, podPrefixes []string, users, bindings map[string]string, opts options) (bool, string) {
+	if sa.Name == defaultServiceAccount {
+		return false, "the default service account"
+	}
+	if user, ok := users[sa.Name]; ok {
+		return false, "used by " + user
+	}
+	if binding, ok := bindings[sa.Name]; ok {
+		return false, "bound by " + binding
+	}
+	match := opts.podNamePattern.FindStringSubmatch(sa.Name)
+	if match == nil || match[1] == "" {
+		return false, "not named after an instance"
+	}
+	for _, prefix := range podPrefixes {
+		if prefix == match[1] {
+			return false, fmt.Sprintf("matches pod prefix %s", prefix)
+		}
+	}
+	return true, orphanedReason
+}
+
+// gatherServiceAccountUsers maps the names of the ServiceAccounts run as by
+// the pods of a namespace, or by the pods its StatefulSets and Deployments
+// would create when scaled up, to the first of them.
+func gatherServiceAccountUsers(ctx context.Context, clientset kubernetes.Interface, namespace string, opts options) (map[string]string, error) {
+	users := map[string]string{}
+	add := func(name, user string) {
+		if _, found := users[name]; name != "" && !found {
+			users[name] = user
+		}
+	}
+	pods, err := listPods(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %v", err)
+	}
+	for _, pod := range pods {
+		add(pod.Spec.ServiceAccountName, "pod/"+pod.Name)
+	}
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %v", err)
+	}
+	for _, sts := range statefulSets.Items {
+		add(sts.Spec.Template.Spec.ServiceAccountName, "statefulset/"+sts.Name)
+	}
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %v", err)
+	}
+	for _, deployment := range deployments.Items {
+		add(deployment.Spec.Template.Spec.ServiceAccountName, "deployment/"+deployment.Name)
+	}
+	return users, nil
+}
+
+// gatherExternalBindings maps the names of the ServiceAccounts of a namespace
+// bound by RoleBindings of other namespaces or by ClusterRoleBindings to the
+// first such binding.
+func gatherExternalBindings(ctx context.Context, clientset kubernetes.Interface, namespace string, opts options) (map[string]string, error) {
+	bindings := map[string]string{}
+	add := func(subjects []rbacv1.Subject, binding string) {
+		for _, subject := range subjects {
+			if subject.Kind != rbacv1.ServiceAccountKind || subject.Namespace != namespace {
+				continue
+			}
+			if _, found := bindings[subject.Name]; !found {
+				bindings[subject.Name] = binding
+			}
+		}
+	}
+	roleBindings, err := clientset.RbacV1().RoleBindings(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing rolebindings: %v", err)
+	}
+	for _, binding := range roleBindings.Items {
+		if binding.Namespace != namespace {
+			add(binding.Subjects, fmt.Sprintf("rolebinding %s/%s", binding.Namespace, binding.Name))
+		}
+	}
+	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing clusterrolebindings: %v", err)
+	}
+	for _, binding := range clusterRoleBindings.Items {
+		add(binding.Subjects, "clusterrolebinding/"+binding.Name)
+	}
+	return bindings, nil
+}
+
+// serviceAccountCleaner cleans up the orphaned ServiceAccounts of a
+// namespace.
+type serviceAccountCleaner struct {
+	clientset   kubernetes.Interface
+	podPrefixes []string
+	namespace   string
+	opts        options
+	users       map[string]string
+	bindings    map[string]string
+}
+
+func newServiceAccountCleaner(clientset kubernetes.Interface, podPrefixes []string, namespace string, opts options) ResourceCleaner {
+	return &serviceAccountCleaner{clientset: clientset, podPrefixes: podPrefixes, namespace: namespace, opts: opts}
+}
+
+func (c *serviceAccountCleaner) Discover(ctx context.Context) ([]CleanupObject, error) {
+	serviceAccounts, err := listServiceAccounts(ctx, c.clientset, c.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing serviceaccounts: %v", err)
+	}
+	if c.users, err = gatherServiceAccountUsers(ctx, c.clientset, c.namespace, c.opts); err != nil {
+		return nil, err
+	}
+	if c.bindings, err = gatherExternalBindings(ctx, c.clientset, c.namespace, c.opts); err != nil {
+		return nil, err
+	}
+	objects := make([]CleanupObject, 0, len(serviceAccounts))
+	for _, sa := range serviceAccounts {
+		sa := sa
+		objects = append(objects, CleanupObject{
+			Kind:   "ServiceAccount",
+			Meta:   sa.ObjectMeta,
+			Object: sa,
+			Export: func() interface{} { return exportableServiceAccount(sa) },
+			Backup: func() interface{} { return backupServiceAccount(sa) },
+		})
+	}
+	return objects, nil
+}
+
+func (c *serviceAccountCleaner) Decide(ctx context.Context, obj CleanupObject) (bool, string, error) {
+	shouldDelete, reason := decideServiceAccount(obj.Object.(v1.ServiceAccount), c.podPrefixes, c.users, c.bindings, c.opts)
+	return shouldDelete, reason, nil
+}
+
+func (c *serviceAccountCleaner) Delete(ctx context.Context, obj CleanupObject, options metav1.DeleteOptions) error {
+	return c.clientset.CoreV1().ServiceAccounts(c.namespace).Delete(ctx, obj.Meta.Name, options)
+}
+
+func (c *serviceAccountCleaner) Event(obj CleanupObject, reason string, err error) (string, string) {
+	return orphanEvent(obj, "ServiceAccount", reason, err)
+}
+
+// backupServiceAccount returns the ServiceAccount as stored in backups.
+func backupServiceAccount(sa v1.ServiceAccount) *v1.ServiceAccount {
+	backup := sa.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// exportableServiceAccount strips the server populated fields of a
+// ServiceAccount. Its legacy token secrets are dropped, as they are deleted
+// along with it and a new one is issued on demand.
+func exportableServiceAccount(sa v1.ServiceAccount) *v1.ServiceAccount {
+	exported := sa.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	exported.Secrets = nil
+	return exported
+}
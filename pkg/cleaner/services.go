@@ -0,0 +1,136 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serviceBackends are what the services of a namespace may route to: its pods,
+// the pod templates of its workloads, and the EndpointSlices of each service.
+type serviceBackends struct {
+	pods []v1.Pod
+	// workloads holds the pod labels of the StatefulSets and Deployments,
+	// by kind/name, when the prefixes are gathered from workloads. A
+	// workload scaled to zero still counts as a backend.
+	workloads      map[string]map[string]string
+	endpointSlices map[string][]discoveryv1.EndpointSlice
+}
+
+// gatherServiceBackends lists the pods and EndpointSlices of a namespace.
+func gatherServiceBackends(ctx context.Context, clientset kubernetes.Interface, namespace string, opts options) (*serviceBackends, error) {
+	pods, err := listPods(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %v", err)
+	}
+	slices, err := listEndpointSlices(ctx, clientset, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing endpointslices: %v", err)
+	}
+	backends := &serviceBackends{pods: pods, endpointSlices: map[string][]discoveryv1.EndpointSlice{}}
+	for _, slice := range slices {
+		if service := slice.Labels[discoveryv1.LabelServiceName]; service != "" {
+			backends.endpointSlices[service] = append(backends.endpointSlices[service], slice)
+		}
+	}
+	if opts.prefixSource == prefixSourceWorkloads || opts.prefixSource == prefixSourceAll {
+		backends.workloads = map[string]map[string]string{}
+		statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error listing statefulsets: %v", err)
+		}
+		for _, sts := range statefulSets.Items {
+			backends.workloads["statefulset/"+sts.Name] = sts.Spec.Template.Labels
+		}
+		deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error listing deployments: %v", err)
+		}
+		for _, deployment := range deployments.Items {
+			backends.workloads["deployment/"+deployment.Name] = deployment.Spec.Template.Labels
+		}
+	}
+	return backends, nil
+}
+
+// selectedWorkload returns a workload whose pods match the selector of the
+// service, if any, whether it runs pods or not.
+func (b *serviceBackends) selectedWorkload(service v1.Service) (string, bool) {
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+	names := make([]string, 0, len(b.workloads))
+	for name := range b.workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if selector.Matches(labels.Set(b.workloads[name])) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// selectedPod returns a pod matching the selector of the service, if any.
+// Pods that are done never become ready again, so they do not count.
+func (b *serviceBackends) selectedPod(service v1.Service) (string, bool) {
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+	for _, pod := range b.pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return pod.Name, true
+		}
+	}
+	return "", false
+}
+
+// emptySince returns when the EndpointSlices of the service last changed
+// while having no endpoints, falling back to the creation of the service. It
+// returns false if a slice has endpoints.
+func (b *serviceBackends) emptySince(service v1.Service) (time.Time, string, bool) {
+	since := service.CreationTimestamp.Time
+	for _, slice := range b.endpointSlices[service.Name] {
+		if len(slice.Endpoints) > 0 {
+			return time.Time{}, "endpointslice/" + slice.Name, false
+		}
+		if changed, err := time.Parse(time.RFC3339, slice.Annotations[v1.EndpointsLastChangeTriggerTime]); err == nil && changed.After(since) {
+			since = changed
+		}
+	}
+	return since, "", true
+}
+
+// selectorOrphaned decides whether a service is orphaned from what it routes
+// to: a service is orphaned once its selector matches no pod and its
+// EndpointSlices have been empty for the grace period. Services without a
+// selector have their endpoints managed by someone else and are kept.
+func selectorOrphaned(service v1.Service, backends *serviceBackends, grace time.Duration) (bool, string) {
+	if service.Spec.Type == v1.ServiceTypeExternalName {
+		return false, "an ExternalName service"
+	}
+	if len(service.Spec.Selector) == 0 {
+		return false, "has no selector"
+	}
+	if pod, ok := backends.selectedPod(service); ok {
+		return false, "selects pod/" + pod
+	}
+	if workload, ok := backends.selectedWorkload(service); ok {
+		return false, "selects the pods of " + workload
+	}
+	since, slice, empty := backends.emptySince(service)
+	if !empty {
+		return false, "has endpoints in " + slice
+	}
+	if time.Since(since) < grace {
+		return false, fmt.Sprintf("selects no pods for less than %s", grace)
+	}
+	return true, orphanedReason
+}
@@ -0,0 +1,105 @@
+package cleaner
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDecideServiceSafetyChecks(t *testing.T) {
+	zero := int32(0)
+	clientset := fake.NewSimpleClientset(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "team-a"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &zero,
+			Template: v1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "db"}}},
+		},
+	})
+	protected, err := parseNamePattern("*-keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := func(name string, selector, annotations map[string]string) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "team-a",
+				Annotations:       annotations,
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+			},
+			Spec: v1.ServiceSpec{Selector: selector},
+		}
+	}
+	tests := []struct {
+		name         string
+		service      v1.Service
+		prefixSource string
+		want         bool
+		reason       string
+	}{
+		{
+			name:         "workload scaled to zero",
+			service:      service("db", map[string]string{"app": "db"}, nil),
+			prefixSource: prefixSourceWorkloads,
+			reason:       "statefulset/db",
+		},
+		{
+			name:         "workloads ignored with the pods prefix source",
+			service:      service("db", map[string]string{"app": "db"}, nil),
+			prefixSource: prefixSourcePods,
+			want:         true,
+		},
+		{
+			name:         "keep annotation",
+			service:      service("web", map[string]string{"app": "web"}, map[string]string{defaultKeepAnnotation: "true"}),
+			prefixSource: prefixSourcePods,
+			reason:       "annotated",
+		},
+		{
+			name:         "protected",
+			service:      service("web-keep", map[string]string{"app": "web"}, nil),
+			prefixSource: prefixSourcePods,
+			reason:       "protected",
+		},
+		{
+			name:         "prefix of a live instance",
+			service:      service("abcdefghij-web", map[string]string{"app": "web"}, nil),
+			prefixSource: prefixSourcePods,
+			reason:       "prefix",
+		},
+		{
+			name:         "orphaned",
+			service:      service("web", map[string]string{"app": "web"}, nil),
+			prefixSource: prefixSourceAll,
+			want:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options{
+				prefixSource:   tt.prefixSource,
+				keepAnnotation: defaultKeepAnnotation,
+				protected:      []namePattern{protected},
+			}
+			backends, err := gatherServiceBackends(context.Background(), clientset, "team-a", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The shared checks run before the service ones
+			reason, kept := opts.guard(CleanupObject{Meta: tt.service.ObjectMeta}, false)
+			got := false
+			if !kept {
+				got, reason = decideService(tt.service, []string{"abcdefghij"}, backends, opts)
+			}
+			if got != tt.want || !strings.Contains(reason, tt.reason) {
+				t.Errorf("decideService = %v, %q, want %v, %q", got, reason, tt.want, tt.reason)
+			}
+		})
+	}
+}
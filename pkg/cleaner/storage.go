@@ -0,0 +1,225 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// secretsStoreDriver is the Secrets Store CSI driver, which mounts secrets of
+// external stores and optionally syncs them to Kubernetes secrets.
+const secretsStoreDriver = "secrets-store.csi.k8s.io"
+
+// secretProviderClassResources are the SecretProviderClasses telling the
+// Secrets Store CSI driver which secrets to sync.
+var secretProviderClassResources = []schema.GroupVersionResource{
+	{Group: "secrets-store.csi.x-k8s.io", Version: "v1", Resource: "secretproviderclasses"},
+}
+
+// storageClassSecretParameters are the StorageClass parameters the external
+// CSI provisioners read secrets from, without their -name and -namespace
+// suffixes.
+var storageClassSecretParameters = []string{
+	"csi.storage.k8s.io/provisioner-secret",
+	"csi.storage.k8s.io/controller-publish-secret",
+	"csi.storage.k8s.io/node-stage-secret",
+	"csi.storage.k8s.io/node-publish-secret",
+	"csi.storage.k8s.io/controller-expand-secret",
+	"csi.storage.k8s.io/node-expand-secret",
+}
+
+// storageSecret is a secret used by a PersistentVolume or a StorageClass.
+type storageSecret struct {
+	name, user string
+}
+
+// storageClassTemplate is a secret of a StorageClass whose name is templated
+// per claim, like ${pvc.name}-credentials.
+type storageClassTemplate struct {
+	class           string
+	name, namespace string
+}
+
+// storageReferences indexes the secrets used by the PersistentVolumes and
+// StorageClasses by namespace. These are cluster scoped, so they are listed
+// once per run, the first time a namespace needs them, instead of once per
+// namespace.
+type storageReferences struct {
+	once sync.Once
+	err  error
+	// secrets maps the namespaces to their secrets in use, in the order the
+	// volumes and classes were listed.
+	secrets map[string][]storageSecret
+	// anyNamespace are the secrets of the StorageClasses in the namespace of
+	// the claim, whatever it is.
+	anyNamespace []storageSecret
+	// templates are resolved against the claims of each namespace.
+	templates []storageClassTemplate
+}
+
+// load lists the PersistentVolumes and StorageClasses on its first call.
+func (s *storageReferences) load(ctx context.Context, clientset kubernetes.Interface) error {
+	s.once.Do(func() {
+		s.secrets = map[string][]storageSecret{}
+		volumes, err := listPersistentVolumes(ctx, clientset)
+		if err != nil {
+			s.err = fmt.Errorf("error listing persistentvolumes: %v", err)
+			return
+		}
+		for _, volume := range volumes {
+			csi := volume.Spec.CSI
+			if csi == nil {
+				continue
+			}
+			user := fmt.Sprintf("persistentvolume/%s", volume.Name)
+			for _, ref := range []*v1.SecretReference{csi.ControllerPublishSecretRef, csi.NodeStageSecretRef, csi.NodePublishSecretRef, csi.ControllerExpandSecretRef, csi.NodeExpandSecretRef} {
+				if ref != nil {
+					s.secrets[ref.Namespace] = append(s.secrets[ref.Namespace], storageSecret{name: ref.Name, user: user})
+				}
+			}
+		}
+
+		classes, err := listStorageClasses(ctx, clientset)
+		if err != nil {
+			s.err = fmt.Errorf("error listing storageclasses: %v", err)
+			return
+		}
+		for _, class := range classes {
+			user := fmt.Sprintf("storageclass/%s", class.Name)
+			for _, parameter := range storageClassSecretParameters {
+				name := class.Parameters[parameter+"-name"]
+				namespace := class.Parameters[parameter+"-namespace"]
+				switch {
+				case name == "":
+				case strings.Contains(name, "${"):
+					s.templates = append(s.templates, storageClassTemplate{class: class.Name, name: name, namespace: namespace})
+				case namespace == "${pvc.namespace}":
+					s.anyNamespace = append(s.anyNamespace, storageSecret{name: name, user: user})
+				case !strings.Contains(namespace, "${"):
+					s.secrets[namespace] = append(s.secrets[namespace], storageSecret{name: name, user: user})
+				default:
+					// Only known once the volume is provisioned
+					s.templates = append(s.templates, storageClassTemplate{class: class.Name, name: name, namespace: namespace})
+				}
+			}
+		}
+	})
+	return s.err
+}
+
+// storageTemplateVariable matches the variables of the StorageClass secret
+// parameters.
+var storageTemplateVariable = regexp.MustCompile(`\$\{(pvc\.name|pvc\.namespace|pv\.name|pvc\.annotations\['([^']*)'\])\}`)
+
+// resolveStorageTemplate resolves a StorageClass secret parameter for a claim,
+// as the external provisioner does. It fails when the claim is not bound yet
+// and the parameter names its volume.
+func resolveStorageTemplate(template string, pvc v1.PersistentVolumeClaim) (string, bool) {
+	resolved := true
+	value := storageTemplateVariable.ReplaceAllStringFunc(template, func(variable string) string {
+		match := storageTemplateVariable.FindStringSubmatch(variable)
+		switch match[1] {
+		case "pvc.name":
+			return pvc.Name
+		case "pvc.namespace":
+			return pvc.Namespace
+		case "pv.name":
+			if pvc.Spec.VolumeName == "" {
+				resolved = false
+			}
+			return pvc.Spec.VolumeName
+		}
+		return pvc.Annotations[match[2]]
+	})
+	return value, resolved && !strings.Contains(value, "${")
+}
+
+// addStorageReferences records the secrets of namespace used by the CSI
+// drivers: the ones of the PersistentVolumes and StorageClasses, including the
+// ones named after the claims of the namespace, and the ones synced by the
+// Secrets Store CSI driver for the pods of the namespace.
+func addStorageReferences(ctx context.Context, clientset kubernetes.Interface, client dynamic.Interface, storage *storageReferences, refs *secretReferences, namespace string) error {
+	if err := storage.load(ctx, clientset); err != nil {
+		return err
+	}
+	for _, secret := range storage.secrets[namespace] {
+		refs.add(secret.name, secret.user)
+	}
+	for _, secret := range storage.anyNamespace {
+		refs.add(secret.name, secret.user)
+	}
+	if len(storage.templates) > 0 {
+		pvcs, err := listPVCs(ctx, clientset, namespace)
+		if err != nil {
+			return fmt.Errorf("error listing persistentvolumeclaims: %v", err)
+		}
+		for _, pvc := range pvcs {
+			if pvc.Spec.StorageClassName == nil {
+				continue
+			}
+			for _, template := range storage.templates {
+				if template.class != *pvc.Spec.StorageClassName {
+					continue
+				}
+				// Protected in the namespace of the claim when the class does
+				// not tell where the secret is
+				secretNamespace := namespace
+				if template.namespace != "" {
+					var ok bool
+					if secretNamespace, ok = resolveStorageTemplate(template.namespace, pvc); !ok {
+						continue
+					}
+				}
+				name, ok := resolveStorageTemplate(template.name, pvc)
+				if ok && secretNamespace == namespace {
+					refs.add(name, fmt.Sprintf("storageclass/%s for persistentvolumeclaim/%s", template.class, pvc.Name))
+				}
+			}
+		}
+	}
+
+	if len(refs.secretProviderClasses) == 0 {
+		return nil
+	}
+	providerClasses, err := listOptional(ctx, client, secretProviderClassResources, namespace)
+	if err != nil {
+		return fmt.Errorf("error listing secretproviderclasses: %v", err)
+	}
+	for _, providerClass := range providerClasses {
+		user, used := refs.secretProviderClasses[providerClass.GetName()]
+		if !used {
+			continue
+		}
+		secretObjects, _, _ := unstructured.NestedSlice(providerClass.Object, "spec", "secretObjects")
+		for _, secretObject := range secretObjects {
+			secretObject, _ := secretObject.(map[string]interface{})
+			name, _ := secretObject["secretName"].(string)
+			refs.add(name, fmt.Sprintf("%s through secretproviderclass/%s", user, providerClass.GetName()))
+		}
+	}
+	return nil
+}
+
+// addCSIVolumeReferences records the secrets of an inline CSI volume of a pod,
+// and the SecretProviderClass it mounts with the Secrets Store CSI driver.
+func addCSIVolumeReferences(refs *secretReferences, csi *v1.CSIVolumeSource, user string) {
+	if csi.NodePublishSecretRef != nil {
+		refs.add(csi.NodePublishSecretRef.Name, user)
+	}
+	if csi.Driver != secretsStoreDriver {
+		return
+	}
+	if providerClass := csi.VolumeAttributes["secretProviderClass"]; providerClass != "" {
+		if _, found := refs.secretProviderClasses[providerClass]; !found {
+			refs.secretProviderClasses[providerClass] = user
+		}
+	}
+}
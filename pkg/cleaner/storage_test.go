@@ -0,0 +1,99 @@
+package cleaner
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStorageReferences(t *testing.T) {
+	csiClass := "csi-fast"
+	objects := []runtime.Object{
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{
+				Driver:             "ebs.csi.aws.com",
+				NodeStageSecretRef: &v1.SecretReference{Name: "stage-creds", Namespace: "team-a"},
+			}}},
+		},
+		&storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{Name: "static"},
+			Parameters: map[string]string{
+				"csi.storage.k8s.io/provisioner-secret-name":       "provisioner-creds",
+				"csi.storage.k8s.io/provisioner-secret-namespace":  "team-b",
+				"csi.storage.k8s.io/node-publish-secret-name":      "publish-creds",
+				"csi.storage.k8s.io/node-publish-secret-namespace": "${pvc.namespace}",
+			},
+		},
+		&storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{Name: csiClass},
+			Parameters: map[string]string{
+				"csi.storage.k8s.io/node-stage-secret-name":             "${pvc.name}-stage",
+				"csi.storage.k8s.io/node-stage-secret-namespace":        "${pvc.namespace}",
+				"csi.storage.k8s.io/controller-expand-secret-name":      "${pvc.annotations['team']}-resize",
+				"csi.storage.k8s.io/controller-expand-secret-namespace": "${pvc.namespace}",
+				"csi.storage.k8s.io/node-expand-secret-name":            "${pv.name}-expand",
+				"csi.storage.k8s.io/node-expand-secret-namespace":       "${pvc.namespace}",
+			},
+		},
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "team-a", Annotations: map[string]string{"team": "search"}},
+			Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &csiClass, VolumeName: "pv-1"},
+		},
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "pending", Namespace: "team-b"},
+			Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &csiClass},
+		},
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	dynamic := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	storage := &storageReferences{}
+
+	tests := []struct {
+		namespace string
+		secret    string
+		want      string
+	}{
+		{namespace: "team-a", secret: "stage-creds", want: "persistentvolume/pv-1"},
+		{namespace: "team-b", secret: "stage-creds"},
+		{namespace: "team-b", secret: "provisioner-creds", want: "storageclass/static"},
+		{namespace: "team-a", secret: "provisioner-creds"},
+		{namespace: "team-a", secret: "publish-creds", want: "storageclass/static"},
+		{namespace: "team-a", secret: "data-stage", want: "storageclass/csi-fast for persistentvolumeclaim/data"},
+		{namespace: "team-a", secret: "search-resize", want: "storageclass/csi-fast for persistentvolumeclaim/data"},
+		{namespace: "team-a", secret: "pv-1-expand", want: "storageclass/csi-fast for persistentvolumeclaim/data"},
+		{namespace: "team-b", secret: "pending-stage", want: "storageclass/csi-fast for persistentvolumeclaim/pending"},
+		// Not bound to a volume yet
+		{namespace: "team-b", secret: "-expand"},
+		{namespace: "team-b", secret: "data-stage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.secret, func(t *testing.T) {
+			refs := newSecretReferences()
+			if err := addStorageReferences(context.Background(), clientset, dynamic, storage, refs, tt.namespace); err != nil {
+				t.Fatal(err)
+			}
+			if got := refs.users[tt.secret]; got != tt.want {
+				t.Errorf("user = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	lists := map[string]int{}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "list" {
+			lists[action.GetResource().Resource]++
+		}
+	}
+	for _, resource := range []string{"persistentvolumes", "storageclasses"} {
+		if lists[resource] != 1 {
+			t.Errorf("listed %s %d times, want once per run", resource, lists[resource])
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package cleaner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// summaryKinds are the kinds listed in the summary, in order.
+var summaryKinds = []struct{ name, plural string }{
+	{"Secret", "Secrets"},
+	{"Service", "Services"},
+	{"ConfigMap", "ConfigMaps"},
+	{"PersistentVolumeClaim", "PersistentVolumeClaims"},
+	{"PersistentVolume", "PersistentVolumes"},
+	{"ServiceAccount", "ServiceAccounts"},
+	{"NetworkPolicy", "NetworkPolicies"},
+	{"Job", "Jobs"},
+	{"HorizontalPodAutoscaler", "HorizontalPodAutoscalers"},
+	{"EndpointSlice", "EndpointSlices"},
+	{"Endpoints", "Endpoints"},
+}
+
+// namespaceSummary holds the outcome of cleaning up one namespace.
+type namespaceSummary struct {
+	duration time.Duration
+	deleted  int
+	skipped  int
+	errors   int
+}
+
+// runSummary collects the outcome of a run for the report printed at its end.
+// It is safe for concurrent use, and its methods do nothing on a nil summary.
+type runSummary struct {
+	mu         sync.Mutex
+	start      time.Time
+	namespaces map[string]*namespaceSummary
+	// counts holds the number of decisions per kind and action.
+	counts map[string]map[string]int
+	// unprocessed lists the namespaces not started before the run timed out.
+	unprocessed []string
+	// cluster is the kubeconfig context of the run, when running against
+	// several clusters.
+	cluster string
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		start:      time.Now(),
+		namespaces: map[string]*namespaceSummary{},
+		counts:     map[string]map[string]int{},
+	}
+}
+
+func (s *runSummary) namespace(name string) *namespaceSummary {
+	ns, ok := s.namespaces[name]
+	if !ok {
+		ns = &namespaceSummary{}
+		s.namespaces[name] = ns
+	}
+	return ns
+}
+
+func (s *runSummary) record(d decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[d.Kind] == nil {
+		s.counts[d.Kind] = map[string]int{}
+	}
+	s.counts[d.Kind][d.Action]++
+	// Cluster scoped objects are not part of any namespace
+	if d.Namespace == "" {
+		return
+	}
+	ns := s.namespace(d.Namespace)
+	switch d.Action {
+	case actionDelete:
+		ns.deleted++
+	case actionSkip:
+		ns.skipped++
+	case actionError:
+		ns.errors++
+	}
+}
+
+// namespaceDone records how long processing a namespace took. A failure that
+// did not come with an error decision, e.g. a failed listing, is counted too.
+func (s *runSummary) namespaceDone(name string, duration time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns := s.namespace(name)
+	ns.duration = duration
+	if err != nil && ns.errors == 0 {
+		ns.errors++
+	}
+}
+
+// notStarted records a namespace that was not processed as the run timed out.
+func (s *runSummary) notStarted(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unprocessed = append(s.unprocessed, name)
+}
+
+// totals returns the number of namespaces processed and errors encountered.
+func (s *runSummary) totals() (namespaces, errors int) {
+	for _, ns := range s.namespaces {
+		errors += ns.errors
+	}
+	return len(s.namespaces), errors
+}
+
+// write prints the totals followed by a table of the namespaces.
+func (s *runSummary) write(w io.Writer) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespaces, errors := s.totals()
+	if s.cluster != "" {
+		fmt.Fprintf(w, "Cluster: %s\n", s.cluster)
+	}
+	fmt.Fprintf(w, "Namespaces processed: %d\n", namespaces)
+	for _, kind := range summaryKinds {
+		counts := s.counts[kind.name]
+		fmt.Fprintf(w, "%s: %d deleted, %d skipped, %d kept\n", kind.plural, counts[actionDelete], counts[actionSkip], counts[actionKeep])
+	}
+	// The kinds of the rules of --rules-file
+	known := map[string]bool{}
+	for _, kind := range summaryKinds {
+		known[kind.name] = true
+	}
+	var others []string
+	for kind := range s.counts {
+		if !known[kind] {
+			others = append(others, kind)
+		}
+	}
+	sort.Strings(others)
+	for _, kind := range others {
+		counts := s.counts[kind]
+		fmt.Fprintf(w, "%s objects: %d deleted, %d skipped, %d kept\n", kind, counts[actionDelete], counts[actionSkip], counts[actionKeep])
+	}
+	fmt.Fprintf(w, "Errors: %d\n", errors)
+	if len(s.unprocessed) > 0 {
+		fmt.Fprintf(w, "Unprocessed namespaces (%d): %s\n", len(s.unprocessed), strings.Join(s.unprocessed, ", "))
+	}
+	fmt.Fprintf(w, "Duration: %s\n\n", time.Since(s.start).Round(time.Millisecond))
+
+	sorted := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tDURATION\tDELETED\tSKIPPED\tERRORS")
+	for _, name := range sorted {
+		ns := s.namespaces[name]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", name, ns.duration.Round(time.Millisecond), ns.deleted, ns.skipped, ns.errors)
+	}
+	return tw.Flush()
+}
+
+// summaryTotals are the totals of a run, as passed to notifications.
+type summaryTotals struct {
+	Namespaces      int `json:"namespaces"`
+	SecretsDeleted  int `json:"secretsDeleted"`
+	ServicesDeleted int `json:"servicesDeleted"`
+	// The counts of the other kinds are only set when these kinds are cleaned
+	// up.
+	ConfigMapsDeleted      int    `json:"configMapsDeleted,omitempty"`
+	PVCsDeleted            int    `json:"pvcsDeleted,omitempty"`
+	ServiceAccountsDeleted int    `json:"serviceAccountsDeleted,omitempty"`
+	NetworkPoliciesDeleted int    `json:"networkPoliciesDeleted,omitempty"`
+	JobsDeleted            int    `json:"jobsDeleted,omitempty"`
+	HPAsDeleted            int    `json:"hpasDeleted,omitempty"`
+	Skipped                int    `json:"skipped"`
+	Errors                 int    `json:"errors"`
+	Unprocessed            int    `json:"unprocessed,omitempty"`
+	Duration               string `json:"duration"`
+}
+
+func (s *runSummary) snapshot() summaryTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	namespaces, errors := s.totals()
+	skipped := 0
+	for _, counts := range s.counts {
+		skipped += counts[actionSkip]
+	}
+	return summaryTotals{
+		Namespaces:             namespaces,
+		SecretsDeleted:         s.counts["Secret"][actionDelete],
+		ServicesDeleted:        s.counts["Service"][actionDelete],
+		ConfigMapsDeleted:      s.counts["ConfigMap"][actionDelete],
+		PVCsDeleted:            s.counts["PersistentVolumeClaim"][actionDelete],
+		ServiceAccountsDeleted: s.counts["ServiceAccount"][actionDelete],
+		NetworkPoliciesDeleted: s.counts["NetworkPolicy"][actionDelete],
+		JobsDeleted:            s.counts["Job"][actionDelete],
+		HPAsDeleted:            s.counts["HorizontalPodAutoscaler"][actionDelete],
+		Skipped:                skipped,
+		Errors:                 errors,
+		Unprocessed:            len(s.unprocessed),
+		Duration:               time.Since(s.start).Round(time.Second).String(),
+	}
+}
+
+// headline returns the totals as a single sentence.
+func (t summaryTotals) headline() string {
+	return fmt.Sprintf("%d namespaces processed, %d secrets and %d services deleted, %d skipped, %d errors in %s",
+		t.Namespaces, t.SecretsDeleted, t.ServicesDeleted, t.Skipped, t.Errors, t.Duration)
+}
+
+// log reports the totals as a single structured message, for log formats that
+// cannot carry a table.
+func (s *runSummary) log() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	namespaces, errors := s.totals()
+	l := logger
+	if s.cluster != "" {
+		l = l.With("cluster", s.cluster)
+	}
+	l.Info("Run finished",
+		"namespaces", namespaces,
+		"secretsDeleted", s.counts["Secret"][actionDelete],
+		"secretsSkipped", s.counts["Secret"][actionSkip],
+		"servicesDeleted", s.counts["Service"][actionDelete],
+		"servicesSkipped", s.counts["Service"][actionSkip],
+		"configMapsDeleted", s.counts["ConfigMap"][actionDelete],
+		"configMapsSkipped", s.counts["ConfigMap"][actionSkip],
+		"pvcsDeleted", s.counts["PersistentVolumeClaim"][actionDelete],
+		"pvcsSkipped", s.counts["PersistentVolumeClaim"][actionSkip],
+		"serviceAccountsDeleted", s.counts["ServiceAccount"][actionDelete],
+		"serviceAccountsSkipped", s.counts["ServiceAccount"][actionSkip],
+		"networkPoliciesDeleted", s.counts["NetworkPolicy"][actionDelete],
+		"networkPoliciesSkipped", s.counts["NetworkPolicy"][actionSkip],
+		"jobsDeleted", s.counts["Job"][actionDelete],
+		"jobsSkipped", s.counts["Job"][actionSkip],
+		"hpasDeleted", s.counts["HorizontalPodAutoscaler"][actionDelete],
+		"hpasSkipped", s.counts["HorizontalPodAutoscaler"][actionSkip],
+		"errors", errors,
+		"unprocessed", len(s.unprocessed),
+		"duration", time.Since(s.start).Round(time.Millisecond).String())
+}
+
+// writeFile writes the summary to path.
+func (s *runSummary) writeFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,115 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Supported values of the --color flag.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// actionColors are the ANSI colors of the actions in the table. They all have
+// the same length so that colored cells stay aligned.
+var actionColors = map[string]string{
+	actionDelete: "\x1b[31m",
+	actionKeep:   "\x1b[32m",
+	actionSkip:   "\x1b[33m",
+	actionMark:   "\x1b[36m",
+	actionError:  "\x1b[35m",
+}
+
+const colorReset = "\x1b[0m"
+
+// useColor decides whether to color output written to f.
+func useColor(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case colorAlways:
+		return true, nil
+	case colorNever:
+		return false, nil
+	case colorAuto:
+		if _, ok := os.LookupEnv("NO_COLOR"); ok {
+			return false, nil
+		}
+		info, err := f.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("unknown color mode %q, must be one of %s, %s or %s", mode, colorAuto, colorAlways, colorNever)
+}
+
+// tableRecorder collects the decisions and renders them as a table once the
+// run is over. Kept objects are only listed when debug logging is enabled, as
+// they usually outnumber the orphans by far.
+type tableRecorder struct {
+	mu    sync.Mutex
+	rows  []decision
+	color bool
+}
+
+func newTableRecorder(color bool) *tableRecorder {
+	return &tableRecorder{color: color}
+}
+
+func (t *tableRecorder) record(d decision) {
+	if d.Action == actionKeep && !logger.Enabled(context.TODO(), slog.LevelDebug) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rows = append(t.rows, d)
+}
+
+func (t *tableRecorder) write(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		a, b := t.rows[i], t.rows[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tAGE\tACTION\tREASON")
+	for _, d := range t.rows {
+		action := strings.ToUpper(d.Action)
+		if d.DryRun {
+			action += " (DRY RUN)"
+		}
+		if color, ok := actionColors[d.Action]; ok && t.color {
+			action = color + action + colorReset
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Namespace, d.Kind, d.Name, formatAge(d.Timestamp.Sub(d.Created)), action, d.Reason)
+	}
+	return tw.Flush()
+}
+
+// formatAge renders an age the way kubectl does, e.g. 45s, 10m, 5h or 3d.
+func formatAge(age time.Duration) string {
+	switch {
+	case age < 2*time.Minute:
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	case age < 2*time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(age.Hours()/24))
+}
@@ -0,0 +1,106 @@
+package cleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spf13/cobra"
+)
+
+// Build metadata, set when building a release with
+//
+//	go build -ldflags "-X github.com/minkimipt/orphaned-secrets-deleter/pkg/cleaner.version=v1.2.3 \
+//	  -X github.com/minkimipt/orphaned-secrets-deleter/pkg/cleaner.gitCommit=$(git rev-parse HEAD) \
+//	  -X github.com/minkimipt/orphaned-secrets-deleter/pkg/cleaner.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// The commit and date default to the VCS information Go stamps the binary
+// with.
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildDate = ""
+)
+
+// versionInfo describes the build of the cleaner.
+type versionInfo struct {
+	Version         string `json:"version"`
+	GitCommit       string `json:"gitCommit,omitempty"`
+	BuildDate       string `json:"buildDate,omitempty"`
+	GoVersion       string `json:"goVersion"`
+	ClientGoVersion string `json:"clientGoVersion,omitempty"`
+}
+
+// buildVersion is the version of the running binary.
+var buildVersion = readVersionInfo()
+
+func readVersionInfo() versionInfo {
+	info := versionInfo{Version: version, GitCommit: gitCommit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range build.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.GitCommit == "":
+			info.GitCommit = setting.Value
+		case setting.Key == "vcs.time" && info.BuildDate == "":
+			info.BuildDate = setting.Value
+		}
+	}
+	for _, dep := range build.Deps {
+		if dep.Path == "k8s.io/client-go" {
+			info.ClientGoVersion = dep.Version
+		}
+	}
+	return info
+}
+
+// fieldManager names the cleaner in the managedFields of the objects it
+// creates and modifies.
+const fieldManager = "orphaned-secrets-deleter"
+
+// userAgent returns the User-Agent of the requests, naming the cleaner, its
+// version and the run, if any, in the audit logs of the API server.
+func userAgent(runID string) string {
+	agent := "orphaned-secrets-deleter/" + buildVersion.Version
+	if runID != "" {
+		agent += "/" + runID
+	}
+	return agent
+}
+
+// logAttrs returns the version as attributes of a log message.
+func (v versionInfo) logAttrs() []any {
+	return []any{"version", v.Version, "commit", v.GitCommit, "buildDate", v.BuildDate}
+}
+
+// newVersionCommand prints the build metadata.
+func newVersionCommand() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, git commit and build date of the cleaner and the client-go version it uses",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w := cmd.OutOrStdout()
+			switch output {
+			case outputText:
+				fmt.Fprintf(w, "Version:    %s\n", buildVersion.Version)
+				fmt.Fprintf(w, "Git commit: %s\n", buildVersion.GitCommit)
+				fmt.Fprintf(w, "Build date: %s\n", buildVersion.BuildDate)
+				fmt.Fprintf(w, "Go:         %s\n", buildVersion.GoVersion)
+				fmt.Fprintf(w, "client-go:  %s\n", buildVersion.ClientGoVersion)
+				return nil
+			case outputJSON:
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				return enc.Encode(buildVersion)
+			}
+			return fmt.Errorf("Invalid --output: must be %s or %s", outputText, outputJSON)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", outputText, "Output format: text or json")
+	return cmd
+}
@@ -0,0 +1,236 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// What to do with the PersistentVolumes left Released by deleted namespaces.
+const (
+	// releasedVolumesDelete deletes the PersistentVolume object. The storage
+	// behind a Retain volume is left in place.
+	releasedVolumesDelete = "delete"
+	// releasedVolumesReclaim switches the reclaim policy to Delete, so the
+	// provisioner deletes the storage and then the PersistentVolume.
+	releasedVolumesReclaim = "reclaim"
+)
+
+func validateReleasedVolumes(mode string) error {
+	switch mode {
+	case "", releasedVolumesDelete, releasedVolumesReclaim:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, must be %s or %s", mode, releasedVolumesDelete, releasedVolumesReclaim)
+}
+
+// releasedSeenAnnotation records when a run first saw a volume Released by a
+// claim of a namespace it cleans up. The namespace of a volume is gone by the
+// time it is orphaned, so this is what tells the cleaner it was a customer
+// namespace.
+const releasedSeenAnnotation = "orphan-cleaner/released-seen"
+
+// decideVolume decides whether a PersistentVolume is orphaned, and explains
+// why. A Released volume is orphaned once the namespace of its claim, seen as
+// a namespace the run cleans up while it existed, is gone. Only Released
+// volumes are passed.
+func decideVolume(pv v1.PersistentVolume, namespaces map[string]v1.Namespace, opts options) (bool, string) {
+	if pv.Spec.ClaimRef == nil {
+		return false, "has no claimRef"
+	}
+	namespace := pv.Spec.ClaimRef.Namespace
+	if _, ok := namespaces[namespace]; ok {
+		return false, fmt.Sprintf("namespace %s of its claim exists", namespace)
+	}
+	if !opts.selectsNamespace(namespace) {
+		return false, fmt.Sprintf("namespace %s of its claim is not selected", namespace)
+	}
+	if opts.keepAnnotation != "" && pv.Annotations[opts.keepAnnotation] == "true" {
+		return false, fmt.Sprintf("annotated with %s=true", opts.keepAnnotation)
+	}
+	seen, err := time.Parse(time.RFC3339, pv.Annotations[releasedSeenAnnotation])
+	if err != nil {
+		return false, fmt.Sprintf("namespace %s of its claim was not seen as a cleaned up namespace", namespace)
+	}
+	// Give the namespace controller time to finish, and people a chance to
+	// recover from an accidental deletion. Without the feature gated time of
+	// the transition, the volume was released no later than first seen so.
+	released := seen
+	if transition := pv.Status.LastPhaseTransitionTime; transition != nil {
+		released = transition.Time
+	}
+	if time.Since(released) < opts.pvcMinAge {
+		return false, fmt.Sprintf("released for less than %s", opts.pvcMinAge)
+	}
+	return true, fmt.Sprintf("released by a claim of the deleted namespace %s", namespace)
+}
+
+// cleanedUpNamespace reports whether the run cleans up the namespace: one of
+// --namespaces-from or a labeled customer namespace, selected and opted in.
+func (o options) cleanedUpNamespace(namespace v1.Namespace) bool {
+	if !o.selectsNamespace(namespace.Name) || !o.optedIn(namespace) {
+		return false
+	}
+	if o.namespaceList != nil {
+		for _, name := range o.namespaceList {
+			if name == namespace.Name {
+				return true
+			}
+		}
+		return false
+	}
+	if o.optIn {
+		return true
+	}
+	selector, err := labels.Parse(customerNamespaceSelector)
+	return err == nil && selector.Matches(labels.Set(namespace.Labels))
+}
+
+// markReleasedVolume annotates a volume Released by a claim of a namespace the
+// run cleans up, which still exists, usually terminating, with the time it was
+// first seen so.
+func markReleasedVolume(ctx context.Context, clientset kubernetes.Interface, pv v1.PersistentVolume, opts options) error {
+	if _, ok := pv.Annotations[releasedSeenAnnotation]; ok || !opts.mutates() {
+		return nil
+	}
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, releasedSeenAnnotation, time.Now().UTC().Format(time.RFC3339))
+	_, err := clientset.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{FieldManager: fieldManager})
+	return err
+}
+
+// cleanupReleasedVolumes deletes or reclaims the Released PersistentVolumes
+// whose claims belonged to deleted namespaces, and reports the capacity this
+// frees.
+func cleanupReleasedVolumes(ctx context.Context, clientset kubernetes.Interface, opts options) error {
+	volumes, err := clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing persistentvolumes: %v", err)
+	}
+	namespaceList, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing namespaces: %v", err)
+	}
+	namespaces := map[string]v1.Namespace{}
+	for _, namespace := range namespaceList.Items {
+		namespaces[namespace.Name] = namespace
+	}
+
+	reclaimable := resource.Quantity{}
+	count := 0
+	for _, pv := range volumes.Items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Bound and available volumes are none of the cleaner's business
+		if pv.Status.Phase != v1.VolumeReleased {
+			continue
+		}
+		if pv.Spec.ClaimRef != nil {
+			if namespace, ok := namespaces[pv.Spec.ClaimRef.Namespace]; ok && opts.cleanedUpNamespace(namespace) {
+				if err := markReleasedVolume(ctx, clientset, pv, opts); err != nil {
+					return fmt.Errorf("error annotating persistentvolume %s: %v", pv.Name, err)
+				}
+			}
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		shouldDelete, reason := decideVolume(pv, namespaces, opts)
+		if !shouldDelete {
+			logger.Debug("Keeping persistentvolume", "resource", "persistentvolume/"+pv.Name, "action", actionKeep, "reason", reason)
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionKeep, reason)
+			continue
+		}
+		count++
+		reclaimable.Add(capacity)
+		if opts.report != nil {
+			continue
+		}
+		if opts.script != nil {
+			if opts.releasedVolumes == releasedVolumesReclaim {
+				opts.script.reclaimVolume(pv.Name)
+			} else {
+				opts.script.delete("persistentvolume", "", pv.Name)
+			}
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionDelete, reason)
+			continue
+		}
+		if opts.export != nil {
+			if err := opts.export.add("PersistentVolume", "", pv.Name, exportableVolume(pv)); err != nil {
+				return err
+			}
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionDelete, reason)
+			continue
+		}
+		logger.Log(ctx, levelDeletion, "Cleaning up persistentvolume", "resource", "persistentvolume/"+pv.Name, "action", actionDelete, "mode", opts.releasedVolumes, "reason", reason, "capacity", capacity.String(), "dryRun", opts.readOnly())
+		if opts.readOnly() {
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionDelete, reason)
+			continue
+		}
+		// Volumes are backed up under the namespace of their claim
+		if opts.backup != nil {
+			if err := opts.backup.add("PersistentVolume", "persistentvolumes", pv.Spec.ClaimRef.Namespace, pv.Name, backupVolume(pv)); err != nil {
+				return err
+			}
+			if err := opts.backup.sync(ctx); err != nil {
+				return err
+			}
+		}
+		if opts.releasedVolumes == releasedVolumesReclaim {
+			err = reclaimVolume(ctx, clientset, pv, opts)
+		} else {
+			err = clientset.CoreV1().PersistentVolumes().Delete(ctx, pv.Name, opts.deleteOptions(pv.ObjectMeta))
+		}
+		if errors.IsConflict(err) {
+			logger.Warn("Not cleaning up persistentvolume as it changed since it was listed", "resource", "persistentvolume/"+pv.Name, "action", actionSkip)
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionSkip, changedReason)
+		} else if err != nil {
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionError, err.Error())
+			return fmt.Errorf("error cleaning up persistentvolume %s: %v", pv.Name, err)
+		} else {
+			opts.record("PersistentVolume", pv.ObjectMeta, int(capacity.Value()), actionDelete, reason)
+		}
+	}
+	logger.Info("Released persistent volumes of deleted namespaces", "count", count, "reclaimableCapacity", reclaimable.String(), "mode", opts.releasedVolumes)
+	return nil
+}
+
+// reclaimVolume sets the reclaim policy of a volume to Delete. The patch is
+// conditional on the resource version, like the deletions.
+func reclaimVolume(ctx context.Context, clientset kubernetes.Interface, pv v1.PersistentVolume, opts options) error {
+	patch := fmt.Sprintf(`{"metadata":{"resourceVersion":%q},"spec":{"persistentVolumeReclaimPolicy":%q}}`, pv.ResourceVersion, v1.PersistentVolumeReclaimDelete)
+	patchOptions := metav1.PatchOptions{FieldManager: fieldManager}
+	if opts.serverDryRun {
+		patchOptions.DryRun = []string{metav1.DryRunAll}
+	}
+	_, err := clientset.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, []byte(patch), patchOptions)
+	return err
+}
+
+// backupVolume returns the volume as stored in backups.
+func backupVolume(pv v1.PersistentVolume) *v1.PersistentVolume {
+	backup := pv.DeepCopy()
+	backup.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	backup.ManagedFields = nil
+	return backup
+}
+
+// exportableVolume strips the server populated fields of a volume. The claim
+// reference is kept, so that a restored volume is Released again rather than
+// bound to a new claim.
+func exportableVolume(pv v1.PersistentVolume) *v1.PersistentVolume {
+	exported := pv.DeepCopy()
+	exported.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	exported.ResourceVersion = ""
+	exported.UID = ""
+	exported.CreationTimestamp = metav1.Time{}
+	exported.ManagedFields = nil
+	exported.Status = v1.PersistentVolumeStatus{}
+	return exported
+}
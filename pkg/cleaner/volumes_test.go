@@ -0,0 +1,93 @@
+package cleaner
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func releasedVolume(namespace string, seen time.Time, transition *metav1.Time) v1.PersistentVolume {
+	pv := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv", Annotations: map[string]string{}},
+		Spec:       v1.PersistentVolumeSpec{ClaimRef: &v1.ObjectReference{Namespace: namespace, Name: "data"}},
+		Status:     v1.PersistentVolumeStatus{Phase: v1.VolumeReleased, LastPhaseTransitionTime: transition},
+	}
+	if !seen.IsZero() {
+		pv.Annotations[releasedSeenAnnotation] = seen.UTC().Format(time.RFC3339)
+	}
+	return pv
+}
+
+func TestDecideVolume(t *testing.T) {
+	opts := options{pvcMinAge: time.Hour}
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name       string
+		pv         v1.PersistentVolume
+		namespaces map[string]v1.Namespace
+		want       bool
+		reason     string
+	}{
+		{
+			name:       "namespace exists",
+			pv:         releasedVolume("team-a", old, nil),
+			namespaces: map[string]v1.Namespace{"team-a": {}},
+			reason:     "exists",
+		},
+		{
+			name:   "namespace never seen as cleaned up",
+			pv:     releasedVolume("kube-system", time.Time{}, &metav1.Time{Time: old}),
+			reason: "not seen as a cleaned up namespace",
+		},
+		{
+			name:   "transition time unknown and seen recently",
+			pv:     releasedVolume("team-a", recent, nil),
+			reason: "released for less than",
+		},
+		{
+			name:   "transition time unknown and seen long ago",
+			pv:     releasedVolume("team-a", old, nil),
+			want:   true,
+			reason: "deleted namespace team-a",
+		},
+		{
+			name:   "released recently",
+			pv:     releasedVolume("team-a", old, &metav1.Time{Time: recent}),
+			reason: "released for less than",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := decideVolume(tt.pv, tt.namespaces, opts)
+			if got != tt.want || !strings.Contains(reason, tt.reason) {
+				t.Errorf("decideVolume = %v, %q, want %v, %q", got, reason, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCleanedUpNamespace(t *testing.T) {
+	customer := v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"cloud.timescale.com/is-customer-resource": "true"}}}
+	other := v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}}
+	optedIn := v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Annotations: map[string]string{enabledAnnotation: "true"}}}
+
+	if !(options{}).cleanedUpNamespace(customer) {
+		t.Error("a customer namespace is not cleaned up")
+	}
+	if (options{}).cleanedUpNamespace(other) {
+		t.Error("a namespace without the customer label is cleaned up")
+	}
+	if !(options{optIn: true}).cleanedUpNamespace(optedIn) {
+		t.Error("an opted in namespace is not cleaned up with --opt-in")
+	}
+	if (options{optIn: true}).cleanedUpNamespace(customer) {
+		t.Error("a namespace that did not opt in is cleaned up with --opt-in")
+	}
+	if (options{namespaceList: []string{"team-b"}}).cleanedUpNamespace(customer) {
+		t.Error("a namespace missing from --namespaces-from is cleaned up")
+	}
+}
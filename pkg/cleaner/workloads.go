@@ -0,0 +1,86 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Sources the pod prefixes can be extracted from.
+const (
+	prefixSourcePods      = "pods"
+	prefixSourceWorkloads = "workloads"
+	prefixSourceAll       = "all"
+)
+
+func validatePrefixSource(source string) error {
+	switch source {
+	case prefixSourcePods, prefixSourceWorkloads, prefixSourceAll:
+		return nil
+	}
+	return fmt.Errorf("unknown prefix source %q, must be one of %s, %s or %s", source, prefixSourcePods, prefixSourceWorkloads, prefixSourceAll)
+}
+
+// gatherPrefixes collects the prefixes of everything that is still alive in
+// the namespace, according to the configured prefix source.
+func gatherPrefixes(ctx context.Context, clientset kubernetes.Interface, namespace string, opts options) ([]string, error) {
+	var prefixes []string
+	if opts.prefixSource == prefixSourcePods || opts.prefixSource == prefixSourceAll {
+		podPrefixes, err := gatherPods(ctx, clientset, namespace, opts.podNamePattern)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, podPrefixes...)
+	}
+	if opts.prefixSource == prefixSourceWorkloads || opts.prefixSource == prefixSourceAll {
+		workloadPrefixes, err := gatherWorkloads(ctx, clientset, namespace, opts.podNamePattern)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, workloadPrefixes...)
+	}
+	logger.Debug("Found prefixes of live instances", "namespace", namespace, "prefixes", prefixes)
+	return prefixes, nil
+}
+
+// gatherWorkloads extracts prefixes from StatefulSets and Deployments, so that
+// secrets are kept for as long as their owning workload exists even if none of
+// its pods are currently running. Workload names are matched against the pod
+// name pattern as if they were the name of one of their pods, since the
+// controllers name pods "<workload name>-<suffix>".
+func gatherWorkloads(ctx context.Context, clientset kubernetes.Interface, namespace string, podNamePattern *regexp.Regexp) ([]string, error) {
+	var prefixes []string
+
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %v", err)
+	}
+	for _, sts := range statefulSets.Items {
+		prefixes = appendWorkloadPrefix(prefixes, podNamePattern, sts.Name, sts.Spec.Template.ObjectMeta)
+	}
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %v", err)
+	}
+	for _, deployment := range deployments.Items {
+		prefixes = appendWorkloadPrefix(prefixes, podNamePattern, deployment.Name, deployment.Spec.Template.ObjectMeta)
+	}
+
+	return prefixes, nil
+}
+
+func appendWorkloadPrefix(prefixes []string, podNamePattern *regexp.Regexp, name string, template metav1.ObjectMeta) []string {
+	for _, candidate := range []string{name + "-", template.Name, template.GenerateName} {
+		if candidate == "" {
+			continue
+		}
+		if match := podNamePattern.FindStringSubmatch(candidate); match != nil && match[1] != "" {
+			return append(prefixes, match[1])
+		}
+	}
+	return prefixes
+}